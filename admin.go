@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// maxAdminRequest bounds the body of an admin request, which is read to check
+// its NIP-98 payload hash.
+const maxAdminRequest = 64 * 1024
+
+// adminRoutes are the operational routes, each served only to admins.
+func (r *Relay) adminRoutes(enablePprof bool, metrics http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		r.reload()
+	})
+	mux.Handle("/metrics", metrics)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// authorizeAdmin returns who sent req: "token" for a request with the admin
+// bearer token, or else the admin pubkey that signed it with NIP-98. body is
+// what has been read of the request body.
+func (r *Relay) authorizeAdmin(req *http.Request, body []byte) (string, error) {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		if r.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.adminToken)) != 1 {
+			return "", errors.New("invalid token")
+		}
+		return "token", nil
+	}
+	pubkey, err := validateHTTPAuth(req, body, time.Now())
+	if err != nil {
+		return pubkey, err
+	}
+	if _, ok := r.adminPubkeys[pubkey]; !ok {
+		return pubkey, errors.New("not an admin")
+	}
+	return pubkey, nil
+}
+
+// requireAdmin serves next to admins only and logs every call.
+func (r *Relay) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxAdminRequest))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		admin, err := r.authorizeAdmin(req, body)
+		if err != nil {
+			slog.Warn("admin request refused", "method", req.Method, "path", req.URL.Path, "remote", r.clientIP(req), "admin", admin, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer, Nostr`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		slog.Info("admin request", "method", req.Method, "path", req.URL.Path, "remote", r.clientIP(req), "admin", admin, "status", rec.status, "took", time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which the
+// profiles need to extend their write deadline.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
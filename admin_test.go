@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// adminRequest sends GET path with the given Authorization header and returns
+// the status.
+func adminRequest(handler http.Handler, path, authorization string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://relay.example.com"+path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+// nip98Authorization returns an Authorization header for GET url signed by
+// secret.
+func nip98Authorization(secret, url string) string {
+	auth := nostr.Event{
+		Kind:      nostr.KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", url}, {"method", "GET"}},
+	}
+	auth.Sign(secret)
+	b, _ := json.Marshal(auth)
+	return "Nostr " + base64.StdEncoding.EncodeToString(b)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	admin := bytes32Hex(0x01)
+	adminPubkey, _ := nostr.GetPublicKey(admin)
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}, adminToken: "s3cret"}
+	r.Storage(context.Background()).Init()
+	r.ready()
+	r.adminPubkeys = map[string]struct{}{adminPubkey: {}}
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	handler := r.requireAdmin(r.adminRoutes(false, metrics))
+
+	for _, tt := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no authorization", "", http.StatusUnauthorized},
+		{"token", "Bearer s3cret", http.StatusOK},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"admin", nip98Authorization(admin, "https://relay.example.com/metrics"), http.StatusOK},
+		{"other path", nip98Authorization(admin, "https://relay.example.com/reload"), http.StatusUnauthorized},
+		{"not an admin", nip98Authorization(bytes32Hex(0x02), "https://relay.example.com/metrics"), http.StatusUnauthorized},
+	} {
+		if code := adminRequest(handler, "/metrics", tt.authorization); code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, code)
+		}
+	}
+
+	// without a token configured, no bearer token is accepted
+	r.adminToken = ""
+	if code := adminRequest(handler, "/metrics", "Bearer "); code != http.StatusUnauthorized {
+		t.Errorf("expected an empty token to be refused, got %d", code)
+	}
+}
+
+func TestAdminRoutesPprof(t *testing.T) {
+	r := &Relay{adminToken: "s3cret"}
+	metrics := http.NotFoundHandler()
+	if code := adminRequest(r.requireAdmin(r.adminRoutes(false, metrics)), "/debug/pprof/", "Bearer s3cret"); code != http.StatusNotFound {
+		t.Fatalf("expected pprof to be off, got %d", code)
+	}
+	if code := adminRequest(r.requireAdmin(r.adminRoutes(true, metrics)), "/debug/pprof/", "Bearer s3cret"); code != http.StatusOK {
+		t.Fatalf("expected pprof to be served, got %d", code)
+	}
+	if code := adminRequest(r.requireAdmin(r.adminRoutes(true, metrics)), "/debug/pprof/", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected pprof to need authorization, got %d", code)
+	}
+}
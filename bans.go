@@ -0,0 +1,528 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The types of ban, by what their value is matched against.
+const (
+	banPubkey  = "pubkey"  // the author of an event
+	banEvent   = "event"   // the id of an event
+	banKind    = "kind"    // the kind of an event
+	banIP      = "ip"      // the client address, an IP or a CIDR range
+	banRegex   = "regex"   // a regular expression found in the content
+	banKeyword = "keyword" // a word found in the content, regardless of case
+)
+
+// banTypes are the types of ban in the order they are checked.
+var banTypes = []string{banPubkey, banEvent, banKind, banIP, banRegex, banKeyword}
+
+// banMessages are what an event or a client is refused with when its ban
+// gives no reason.
+var banMessages = map[string]string{
+	banPubkey:  "pubkey is banned",
+	banEvent:   "event is banned",
+	banKind:    "kind is banned",
+	banIP:      "address is banned",
+	banRegex:   "content is banned",
+	banKeyword: "content is banned",
+}
+
+// ban keeps out what its value matches until it expires. There is at most
+// one ban for a type and value.
+type ban struct {
+	Type      string          `json:"type" db:"type"`
+	Value     string          `json:"value" db:"value"`
+	Reason    string          `json:"reason,omitempty" db:"reason"`
+	Creator   string          `json:"creator,omitempty" db:"creator"`
+	CreatedAt nostr.Timestamp `json:"created_at" db:"created_at"`
+	ExpiresAt nostr.Timestamp `json:"expires_at,omitempty" db:"expires_at"`
+}
+
+// expired reports whether b no longer applies at now. A ban without expiry
+// never expires.
+func (b ban) expired(now nostr.Timestamp) bool {
+	return b.ExpiresAt != 0 && b.ExpiresAt <= now
+}
+
+// message is what the relay refuses what b matches with.
+func (b ban) message() string {
+	if b.Reason != "" {
+		return "blocked: " + b.Reason
+	}
+	return "blocked: " + banMessages[b.Type]
+}
+
+// normalizeBan checks the value of b against its type and puts it in the
+// form it is stored and matched in.
+func normalizeBan(b ban) (ban, error) {
+	value := strings.TrimSpace(b.Value)
+	switch b.Type {
+	case banPubkey, banEvent:
+		value = strings.ToLower(value)
+		if !nostr.IsValid32ByteHex(value) {
+			return b, fmt.Errorf("invalid %s: %q", b.Type, b.Value)
+		}
+	case banKind:
+		kind, err := strconv.Atoi(value)
+		if err != nil || kind < 0 || kind > 65535 {
+			return b, fmt.Errorf("invalid kind: %q", b.Value)
+		}
+		value = strconv.Itoa(kind)
+	case banIP:
+		prefix, err := parseIPPrefix(value)
+		if err != nil {
+			return b, err
+		}
+		if prefix.IsSingleIP() {
+			value = prefix.Addr().String()
+		} else {
+			value = prefix.String()
+		}
+	case banRegex:
+		if _, err := regexp.Compile(value); err != nil {
+			return b, fmt.Errorf("invalid regex: %w", err)
+		}
+	case banKeyword:
+		value = strings.ToLower(value)
+		if value == "" {
+			return b, errors.New("empty keyword")
+		}
+	default:
+		return b, fmt.Errorf("unknown ban type: %q", b.Type)
+	}
+	b.Value = value
+	return b, nil
+}
+
+// parseIPPrefix parses an IP address, as a range of one, or a CIDR range.
+func parseIPPrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid CIDR range: %q", value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address: %q", value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// banSet holds the bans in effect, indexed for matching. Bans that expire
+// while it is in effect stop matching at once.
+type banSet struct {
+	bans     []ban
+	pubkeys  map[string]ban
+	events   map[string]ban
+	kinds    map[int]ban
+	prefixes []prefixBan
+	patterns []patternBan
+	keywords []ban
+}
+
+type prefixBan struct {
+	prefix netip.Prefix
+	ban    ban
+}
+
+type patternBan struct {
+	re  *regexp.Regexp
+	ban ban
+}
+
+// newBanSet indexes bans, leaving out those that expired and, with a
+// warning, those that cannot be matched, such as a bad regex in a file.
+func newBanSet(bans []ban, now nostr.Timestamp) *banSet {
+	s := &banSet{
+		pubkeys: map[string]ban{},
+		events:  map[string]ban{},
+		kinds:   map[int]ban{},
+	}
+	for _, b := range bans {
+		if b.expired(now) {
+			continue
+		}
+		b, err := normalizeBan(b)
+		if err != nil {
+			slog.Warn("ignoring ban", "error", err)
+			continue
+		}
+		switch b.Type {
+		case banPubkey:
+			s.pubkeys[b.Value] = b
+		case banEvent:
+			s.events[b.Value] = b
+		case banKind:
+			kind, _ := strconv.Atoi(b.Value)
+			s.kinds[kind] = b
+		case banIP:
+			prefix, _ := parseIPPrefix(b.Value)
+			s.prefixes = append(s.prefixes, prefixBan{prefix, b})
+		case banRegex:
+			s.patterns = append(s.patterns, patternBan{regexp.MustCompile(b.Value), b})
+		case banKeyword:
+			s.keywords = append(s.keywords, b)
+		}
+		s.bans = append(s.bans, b)
+	}
+	slices.SortFunc(s.bans, func(a, b ban) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(banTypes, a.Type), slices.Index(banTypes, b.Type)),
+			cmp.Compare(a.Value, b.Value),
+		)
+	})
+	return s
+}
+
+// matchEvent returns the ban evt falls under: of its author, its id, its kind
+// or its content, in that order.
+func (s *banSet) matchEvent(evt *nostr.Event, now nostr.Timestamp) (ban, bool) {
+	if s == nil {
+		return ban{}, false
+	}
+	if b, ok := s.pubkeys[evt.PubKey]; ok && !b.expired(now) {
+		return b, true
+	}
+	if b, ok := s.events[evt.ID]; ok && !b.expired(now) {
+		return b, true
+	}
+	if b, ok := s.kinds[evt.Kind]; ok && !b.expired(now) {
+		return b, true
+	}
+	for _, p := range s.patterns {
+		if !p.ban.expired(now) && p.re.MatchString(evt.Content) {
+			return p.ban, true
+		}
+	}
+	if len(s.keywords) > 0 {
+		content := strings.ToLower(evt.Content)
+		for _, b := range s.keywords {
+			if !b.expired(now) && strings.Contains(content, b.Value) {
+				return b, true
+			}
+		}
+	}
+	return ban{}, false
+}
+
+// banned reports whether value, a pubkey or an event id, is banned as typ.
+func (s *banSet) banned(typ, value string, now nostr.Timestamp) bool {
+	if s == nil {
+		return false
+	}
+	var b ban
+	var ok bool
+	switch typ {
+	case banPubkey:
+		b, ok = s.pubkeys[value]
+	case banEvent:
+		b, ok = s.events[value]
+	}
+	return ok && !b.expired(now)
+}
+
+// matchIP returns the ban of the range addr is in.
+func (s *banSet) matchIP(addr string, now nostr.Timestamp) (ban, bool) {
+	if s == nil || len(s.prefixes) == 0 {
+		return ban{}, false
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ban{}, false
+	}
+	ip = ip.Unmap()
+	for _, p := range s.prefixes {
+		if !p.ban.expired(now) && p.prefix.Contains(ip) {
+			return p.ban, true
+		}
+	}
+	return ban{}, false
+}
+
+// list returns the bans of typ in effect at now, or all of them if typ is
+// empty.
+func (s *banSet) list(typ string, now nostr.Timestamp) []ban {
+	bans := []ban{}
+	if s == nil {
+		return bans
+	}
+	for _, b := range s.bans {
+		if (typ == "" || b.Type == typ) && !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	return bans
+}
+
+// putBan stores b, replacing the ban of the same type and value, and puts it
+// in effect.
+func (r *Relay) putBan(b ban) error {
+	return r.updateLists(func(lists *relayLists) error { return r.putBanIn(lists, b) })
+}
+
+// removeBan lifts the ban of typ on value.
+func (r *Relay) removeBan(typ, value string) error {
+	return r.updateLists(func(lists *relayLists) error { return r.removeBanIn(lists, typ, value) })
+}
+
+// putBanIn stores b and puts it in lists, for updateLists.
+func (r *Relay) putBanIn(lists *relayLists, b ban) error {
+	b, err := normalizeBan(b)
+	if err != nil {
+		return err
+	}
+	return r.changeBansIn(lists, func(bans []ban) ([]ban, error) {
+		if err := r.listStore.putBan(b); err != nil {
+			return nil, err
+		}
+		bans = slices.DeleteFunc(bans, func(old ban) bool { return old.Type == b.Type && old.Value == b.Value })
+		return append(bans, b), nil
+	})
+}
+
+// removeBanIn deletes the ban of typ on value and takes it out of lists, for
+// updateLists.
+func (r *Relay) removeBanIn(lists *relayLists, typ, value string) error {
+	b, err := normalizeBan(ban{Type: typ, Value: value})
+	if err != nil {
+		return err
+	}
+	return r.changeBansIn(lists, func(bans []ban) ([]ban, error) {
+		if !slices.ContainsFunc(bans, func(old ban) bool { return old.Type == b.Type && old.Value == b.Value }) {
+			return bans, nil
+		}
+		if err := r.listStore.removeBan(b.Type, b.Value); err != nil {
+			return nil, err
+		}
+		return slices.DeleteFunc(bans, func(old ban) bool { return old.Type == b.Type && old.Value == b.Value }), nil
+	})
+}
+
+// changeBansIn replaces the bans in lists with what change makes of them,
+// after it has stored the change.
+func (r *Relay) changeBansIn(lists *relayLists, change func([]ban) ([]ban, error)) error {
+	bans, err := change(slices.Clone(lists.bans.list("", nostr.Now())))
+	if err != nil {
+		return err
+	}
+	lists.bans = newBanSet(bans, nostr.Now())
+	return nil
+}
+
+// loadBans returns the bans in the listStore, deleting those that expired.
+func (r *Relay) loadBans() ([]ban, error) {
+	bans, err := r.listStore.loadBans()
+	if err != nil {
+		return nil, err
+	}
+	now := nostr.Now()
+	for _, b := range bans {
+		if b.expired(now) {
+			if err := r.listStore.removeBan(b.Type, b.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bans, nil
+}
+
+// legacyBanLists are the lists bans took the place of, with the type of ban
+// their entries become and the column their SQL tables held them in.
+var legacyBanLists = []struct{ list, typ, column string }{
+	{"eventblocklist", banEvent, "id"},
+	{"ipblocklist", banIP, "ip"},
+}
+
+// migrateLegacyBans bans what entries holds, which were on list, unless it is
+// banned already. Entries that are not valid for a ban are dropped.
+func migrateLegacyBans(store listStore, list, typ string, entries []string) error {
+	existing, err := store.loadBans()
+	if err != nil {
+		return err
+	}
+	now := nostr.Now()
+	for _, value := range entries {
+		if value == "" || strings.HasPrefix(value, "#") {
+			continue
+		}
+		b, err := normalizeBan(ban{Type: typ, Value: value, CreatedAt: now})
+		if err != nil {
+			slog.Warn("dropped an entry that cannot be banned", "list", list, "error", err)
+			continue
+		}
+		if slices.ContainsFunc(existing, func(old ban) bool { return old.Type == b.Type && old.Value == b.Value }) {
+			continue
+		}
+		if err := store.putBan(b); err != nil {
+			return err
+		}
+		existing = append(existing, b)
+	}
+	slog.Info("moved a list to the bans", "list", list, "entries", len(entries))
+	return nil
+}
+
+// migrateLegacyTables moves the tables of legacyBanLists to the bans table and
+// drops them.
+func (l *sqlLists) migrateLegacyTables() error {
+	for _, legacy := range legacyBanLists {
+		var exists int
+		var err error
+		switch l.db.DriverName() {
+		case "postgres":
+			err = l.db.Get(&exists, `SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1`, legacy.list)
+		case "mysql":
+			err = l.db.Get(&exists, `SELECT count(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`, legacy.list)
+		default:
+			err = l.db.Get(&exists, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, legacy.list)
+		}
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			continue
+		}
+		var entries []string
+		if err := l.db.Select(&entries, `SELECT `+legacy.column+` FROM `+legacy.list); err != nil {
+			return err
+		}
+		if err := migrateLegacyBans(l, legacy.list, legacy.typ, entries); err != nil {
+			return err
+		}
+		if _, err := l.db.Exec(`DROP TABLE IF EXISTS ` + legacy.list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacyFiles moves the files of legacyBanLists to the bans file and
+// removes them.
+func (l *fileLists) migrateLegacyFiles() error {
+	for _, legacy := range legacyBanLists {
+		path := filepath.Join(l.dir, legacy.list)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		entries, err := l.readFile(legacy.list)
+		if err != nil {
+			return err
+		}
+		if err := migrateLegacyBans(l, legacy.list, legacy.typ, entries); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBans returns the bans in the bans table.
+func (l *sqlLists) loadBans() ([]ban, error) {
+	var bans []ban
+	err := l.db.Select(&bans, `SELECT type, value, reason, creator, created_at, expires_at FROM bans`)
+	return bans, err
+}
+
+func (l *sqlLists) putBan(b ban) error {
+	tx, err := l.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM bans WHERE type = ? AND value = ?`), b.Type, b.Value); err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(`INSERT INTO bans (type, value, reason, creator, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		b.Type, b.Value, b.Reason, b.Creator, b.CreatedAt, b.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *sqlLists) removeBan(typ, value string) error {
+	_, err := l.db.Exec(l.db.Rebind(`DELETE FROM bans WHERE type = ? AND value = ?`), typ, value)
+	return err
+}
+
+// loadBans returns the bans in the file named bans, one JSON object per line.
+func (l *fileLists) loadBans() ([]ban, error) {
+	lines, err := l.readFile("bans")
+	if err != nil {
+		return nil, err
+	}
+	var bans []ban
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var b ban
+		if err := json.Unmarshal([]byte(line), &b); err != nil {
+			return nil, fmt.Errorf("invalid ban %s: %w", line, err)
+		}
+		bans = append(bans, b)
+	}
+	return bans, nil
+}
+
+func (l *fileLists) putBan(b ban) error {
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return l.rewrite("bans", sameBan(b.Type, b.Value), string(line))
+}
+
+func (l *fileLists) removeBan(typ, value string) error {
+	return l.rewrite("bans", sameBan(typ, value), "")
+}
+
+// sameBan returns whether a line of the bans file holds the ban of typ on
+// value.
+func sameBan(typ, value string) func(string) bool {
+	return func(line string) bool {
+		var b ban
+		return json.Unmarshal([]byte(line), &b) == nil && b.Type == typ && b.Value == value
+	}
+}
+
+func (l *memoryLists) loadBans() ([]ban, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.bans), nil
+}
+
+func (l *memoryLists) putBan(b ban) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans = slices.DeleteFunc(l.bans, func(old ban) bool { return old.Type == b.Type && old.Value == b.Value })
+	l.bans = append(l.bans, b)
+	return nil
+}
+
+func (l *memoryLists) removeBan(typ, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans = slices.DeleteFunc(l.bans, func(old ban) bool { return old.Type == typ && old.Value == value })
+	return nil
+}
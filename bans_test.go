@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBanSet(t *testing.T) {
+	now := nostr.Timestamp(1_700_000_000)
+	author := bytes32Hex(0x01)
+	bans := newBanSet([]ban{
+		{Type: banPubkey, Value: strings.ToUpper(author), Reason: "spammer"},
+		{Type: banKind, Value: "4"},
+		{Type: banIP, Value: "2001:db8::/32"},
+		{Type: banIP, Value: "::ffff:203.0.113.9"},
+		{Type: banRegex, Value: `https?://scam\.example`},
+		{Type: banKeyword, Value: "Viagra", ExpiresAt: now + 60},
+		{Type: banKeyword, Value: "expired", ExpiresAt: now},
+		{Type: banRegex, Value: "(unclosed"},
+	}, now)
+
+	for _, tt := range []struct {
+		name    string
+		evt     nostr.Event
+		message string
+	}{
+		{"author", nostr.Event{PubKey: author, Kind: 1}, "blocked: spammer"},
+		{"kind", nostr.Event{Kind: 4}, "blocked: kind is banned"},
+		{"regex", nostr.Event{Kind: 1, Content: "see http://scam.example/"}, "blocked: content is banned"},
+		{"keyword", nostr.Event{Kind: 1, Content: "cheap VIAGRA"}, "blocked: content is banned"},
+		{"expired keyword", nostr.Event{Kind: 1, Content: "expired"}, ""},
+		{"nothing", nostr.Event{Kind: 1, Content: "hello"}, ""},
+	} {
+		b, banned := bans.matchEvent(&tt.evt, now)
+		if message := map[bool]string{true: b.message()}[banned]; message != tt.message {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.message, message)
+		}
+	}
+	if _, banned := bans.matchEvent(&nostr.Event{Content: "viagra"}, now+60); banned {
+		t.Error("expected the keyword ban to expire")
+	}
+
+	for addr, want := range map[string]bool{
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+		"203.0.113.9":        true,
+		"::ffff:203.0.113.9": true,
+		"203.0.113.10":       false,
+		"not an address":     false,
+	} {
+		if _, banned := bans.matchIP(addr, now); banned != want {
+			t.Errorf("%s: expected banned %v", addr, want)
+		}
+	}
+
+	if n := len(bans.list("", now)); n != 6 {
+		t.Fatalf("expected the expired and invalid bans to be left out, got %d", n)
+	}
+	if ips := bans.list(banIP, now); ips[0].Value != "2001:db8::/32" || ips[1].Value != "203.0.113.9" {
+		t.Fatalf("expected addresses to be normalized, got %v", ips)
+	}
+}
+
+func TestFileListsBans(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bans"), []byte("# bans\n"+`{"type":"kind","value":"4"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &fileLists{dir: dir}
+	if err := l.putBan(ban{Type: banKind, Value: "4", Reason: "no DMs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.putBan(ban{Type: banKeyword, Value: "casino", ExpiresAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	bans, err := l.loadBans()
+	if err != nil || len(bans) != 2 || bans[0].Reason != "no DMs" {
+		t.Fatalf("expected the ban to be replaced, got %v %v", bans, err)
+	}
+
+	r := &Relay{driverName: "lmdb", listStore: l}
+	r.reload()
+	if bans := r.currentLists().bans.list("", nostr.Now()); len(bans) != 1 {
+		t.Fatalf("expected only the kind to be banned, got %v", bans)
+	}
+	if err := r.removeBan(banKind, "04"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "bans")); string(b) != "# bans\n" {
+		t.Fatalf("expected the expired ban to be deleted and the comment kept, got %q", b)
+	}
+}
+
+func TestBannedEventsLeftOutOfQueries(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	r.Storage(context.Background()).Init()
+	r.ready()
+	evt := signedEvent(t, bytes32Hex(0x01), 1, "hello")
+	if r.skipEvent(evt) {
+		t.Fatal("expected the event to be served")
+	}
+	if err := r.putBan(ban{Type: banEvent, Value: evt.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.skipEvent(evt) {
+		t.Fatal("expected the banned event to be left out")
+	}
+}
+
+func TestLegacyBanListsMigrated(t *testing.T) {
+	id := bytes32Hex(0x01)
+	check := func(t *testing.T, l listStore) {
+		t.Helper()
+		bans, err := l.loadBans()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, b := range bans {
+			got[b.Type] += b.Value
+		}
+		if len(bans) != 2 || got[banEvent] != id || got[banIP] != "203.0.113.9" {
+			t.Fatalf("expected the event and the address to be banned, got %v", bans)
+		}
+	}
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "eventblocklist"), []byte("# events\n"+id+"\nnot an id\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "ipblocklist"), []byte("203.0.113.9\n"), 0644)
+		l := &fileLists{dir: dir}
+		if err := l.init(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, l)
+		if _, err := os.Stat(filepath.Join(dir, "eventblocklist")); !os.IsNotExist(err) {
+			t.Fatalf("expected the old file to be removed, got %v", err)
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "bans.sqlite")}
+		if err := backend.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		for _, stmt := range []string{
+			`CREATE TABLE eventblocklist (id text NOT NULL)`,
+			`INSERT INTO eventblocklist (id) VALUES ('` + id + `')`,
+			`CREATE TABLE ipblocklist (ip text NOT NULL)`,
+			`INSERT INTO ipblocklist (ip) VALUES ('203.0.113.9')`,
+		} {
+			if _, err := backend.DB.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l := &sqlLists{db: backend.DB}
+		if err := l.init(); err != nil {
+			t.Fatal(err)
+		}
+		// a second start finds nothing left to move
+		if err := l.init(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, l)
+	})
+}
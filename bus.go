@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eventBus carries the events saved on one relay instance to the others
+// sharing its database, so that live subscriptions see events no matter which
+// instance they were published through.
+type eventBus interface {
+	// publish sends evt to the other instances.
+	publish(ctx context.Context, evt *nostr.Event) error
+	// publishListsChanged tells the instances that the lists, bans or
+	// moderation actions in the listStore have changed.
+	publishListsChanged(ctx context.Context) error
+	// listen calls deliver with the events published by any instance,
+	// including this one, and reload when any instance changed the lists,
+	// until ctx is done.
+	listen(ctx context.Context, deliver func(*nostr.Event), reload func()) error
+}
+
+// newEventBus returns the bus named kind, or nil if kind is empty.
+func (r *Relay) newEventBus(kind, url string) (eventBus, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "postgresql":
+		return newPostgresBus(url, r.eventByID)
+	default:
+		return nil, fmt.Errorf("unsupported event bus: %s", kind)
+	}
+}
+
+// eventByID loads an event sent over the bus by id. It is read from the
+// primary, since the replica may not have the event that was just saved yet.
+func (r *Relay) eventByID(ctx context.Context, id string) (*nostr.Event, error) {
+	store := r.Storage(ctx).(*relayStore)
+	events, err := queryAll(ctx, store.Store, nostr.Filter{IDs: []string{id}})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+// publishToBus sends an event saved, or for ephemeral kinds broadcast, on this
+// instance to the others.
+func (r *Relay) publishToBus(evt *nostr.Event) {
+	if r.bus == nil {
+		return
+	}
+	// this instance has delivered it already
+	r.busSeen.add(evt.ID)
+	r.tasks.spawn(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.bus.publish(ctx, evt); err != nil {
+			slog.Warn("failed to publish event to bus", "id", evt.ID, "error", err)
+		}
+	})
+}
+
+// publishListsChanged tells the other instances to reload their lists after
+// this one changed them.
+func (r *Relay) publishListsChanged() {
+	if r.bus == nil {
+		return
+	}
+	r.tasks.spawn(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.bus.publishListsChanged(ctx); err != nil {
+			slog.Warn("failed to publish list change to bus", "error", err)
+		}
+	})
+}
+
+// listenToBus delivers the events saved on other instances to the live
+// subscriptions of this one, and reloads the lists when another instance
+// changed them, until ctx is done. Each event is delivered once, however many
+// times it arrives; the lists are reloaded after changes made here too, which
+// does no harm.
+func (r *Relay) listenToBus(ctx context.Context) {
+	err := r.bus.listen(ctx, func(evt *nostr.Event) {
+		r.deliverFromBus(evt)
+	}, r.reload)
+	if err != nil && ctx.Err() == nil {
+		slog.Error("event bus stopped", "error", err)
+	}
+}
+
+// deliverFromBus hands evt to the server for its live subscriptions unless it
+// has been delivered already, and reports whether it did.
+func (r *Relay) deliverFromBus(evt *nostr.Event) bool {
+	if !r.busSeen.add(evt.ID) {
+		return false
+	}
+	r.InjectEvents() <- *evt
+	return true
+}
+
+// InjectEvents implements relayer.Injector. The server delivers the events
+// arriving over the bus to the live subscriptions of this instance.
+func (r *Relay) InjectEvents() chan nostr.Event {
+	r.busEventsOnce.Do(func() { r.busEvents = make(chan nostr.Event, 64) })
+	return r.busEvents
+}
+
+// recentIDs remembers the last size ids it was given.
+type recentIDs struct {
+	mu   sync.Mutex
+	size int
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+// add records id and reports whether it was new.
+func (s *recentIDs) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		if s.size == 0 {
+			s.size = 10000
+		}
+		s.ids = make(map[string]struct{}, s.size)
+		s.ring = make([]string, s.size)
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if old := s.ring[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.ring[s.next] = id
+	s.next = (s.next + 1) % s.size
+	s.ids[id] = struct{}{}
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// postgresBusChannel is the LISTEN/NOTIFY channel the relays share.
+	postgresBusChannel = "nostr_relay_events"
+	// postgresBusMaxPayload keeps notifications under the 8000 byte limit of
+	// NOTIFY. Larger events are sent by id and loaded from the database.
+	postgresBusMaxPayload = 7900
+)
+
+// postgresBus is an eventBus over PostgreSQL LISTEN/NOTIFY.
+type postgresBus struct {
+	url    string
+	db     *sqlx.DB
+	lookup func(ctx context.Context, id string) (*nostr.Event, error)
+}
+
+// postgresBusMessage carries either a whole event or, if it is too large for
+// a notification, only its id, or else the news that the lists have changed.
+type postgresBusMessage struct {
+	Event *nostr.Event `json:"event,omitempty"`
+	ID    string       `json:"id,omitempty"`
+	Lists bool         `json:"lists,omitempty"`
+}
+
+func newPostgresBus(url string, lookup func(context.Context, string) (*nostr.Event, error)) (*postgresBus, error) {
+	db, err := sqlx.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	return &postgresBus{url: url, db: db, lookup: lookup}, nil
+}
+
+func (b *postgresBus) publish(ctx context.Context, evt *nostr.Event) error {
+	payload, err := postgresBusPayload(evt)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresBusChannel, payload)
+	return err
+}
+
+func (b *postgresBus) publishListsChanged(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresBusChannel, `{"lists":true}`)
+	return err
+}
+
+func postgresBusPayload(evt *nostr.Event) (string, error) {
+	payload, err := json.Marshal(postgresBusMessage{Event: evt})
+	if err != nil {
+		return "", err
+	}
+	if len(payload) > postgresBusMaxPayload {
+		if nostr.IsEphemeralKind(evt.Kind) {
+			return "", fmt.Errorf("ephemeral event of %d bytes is too large for the bus", len(payload))
+		}
+		if payload, err = json.Marshal(postgresBusMessage{ID: evt.ID}); err != nil {
+			return "", err
+		}
+	}
+	return string(payload), nil
+}
+
+func (b *postgresBus) listen(ctx context.Context, deliver func(*nostr.Event), reload func()) error {
+	listener := pq.NewListener(b.url, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("event bus connection", "event", ev, "error", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(postgresBusChannel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			// nil after the connection was re-established; events sent in
+			// between are lost, list changes are caught up with
+			if n == nil {
+				reload()
+				continue
+			}
+			var msg postgresBusMessage
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				slog.Warn("malformed event bus message", "error", err)
+				continue
+			}
+			if msg.Lists {
+				reload()
+				continue
+			}
+			if msg.Event == nil && msg.ID != "" {
+				evt, err := b.lookup(ctx, msg.ID)
+				if err != nil || evt == nil {
+					slog.Warn("failed to load event from bus", "id", msg.ID, "error", err)
+					continue
+				}
+				msg.Event = evt
+			}
+			if msg.Event != nil {
+				deliver(msg.Event)
+			}
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeBus connects the instances listening to it in-process.
+type fakeBus struct {
+	mu        sync.Mutex
+	published []*nostr.Event
+	reloads   []func()
+}
+
+func (b *fakeBus) publish(ctx context.Context, evt *nostr.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, evt)
+	return nil
+}
+
+// waitPublished waits for n events to have been published.
+func (b *fakeBus) waitPublished(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		published := len(b.published)
+		b.mu.Unlock()
+		if published == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events to be published, got %d", n, published)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *fakeBus) publishListsChanged(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, reload := range b.reloads {
+		reload()
+	}
+	return nil
+}
+
+func (b *fakeBus) listen(ctx context.Context, deliver func(*nostr.Event), reload func()) error {
+	b.mu.Lock()
+	b.reloads = append(b.reloads, reload)
+	b.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEventBus(t *testing.T) {
+	bus := &fakeBus{}
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}, bus: bus}
+	store := r.Storage(context.Background()).(*relayStore)
+	store.Init()
+
+	local := signedEvent(t, bytes32Hex(0x11), 1, "local")
+	store.AfterSave(local)
+	bus.waitPublished(t, 1)
+
+	if r.deliverFromBus(local) {
+		t.Fatal("expected an event saved here not to be delivered again")
+	}
+	remote := signedEvent(t, bytes32Hex(0x22), 1, "remote")
+	if !r.deliverFromBus(remote) {
+		t.Fatal("expected an event from another instance to be delivered")
+	}
+	if injected := <-r.InjectEvents(); injected.ID != remote.ID {
+		t.Fatalf("expected %s to be handed to the server, got %s", remote.ID, injected.ID)
+	}
+	if r.deliverFromBus(remote) {
+		t.Fatal("expected a duplicate to be dropped")
+	}
+}
+
+func TestEventBusEphemeral(t *testing.T) {
+	bus := &fakeBus{}
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}, bus: bus}
+	r.Storage(context.Background()).Init()
+	r.ready()
+
+	// NIP-46 requests are never saved, so AfterSave does not see them
+	evt := signedEvent(t, bytes32Hex(0x11), 24133, "request")
+	if accepted, msg := r.AcceptEvent(context.Background(), evt); !accepted {
+		t.Fatalf("expected the event to be accepted, got %q", msg)
+	}
+	bus.waitPublished(t, 1)
+	if r.deliverFromBus(evt) {
+		t.Fatal("expected an event broadcast here not to be delivered again")
+	}
+
+	if _, err := postgresBusPayload(signedEvent(t, bytes32Hex(0x11), 24133, strings.Repeat("x", postgresBusMaxPayload))); err == nil {
+		t.Fatal("expected a large ephemeral event to be refused by the bus, which cannot load it")
+	}
+}
+
+func TestListChangesReachOtherInstances(t *testing.T) {
+	bus := &fakeBus{}
+	path := filepath.Join(t.TempDir(), "shared.sqlite")
+	instances := make([]*Relay, 2)
+	for i := range instances {
+		r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: path}, bus: bus}
+		if err := r.Storage(context.Background()).Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Storage(context.Background()).Close()
+		r.ready()
+		instances[i] = r
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go instances[1].listenToBus(ctx)
+	for {
+		bus.mu.Lock()
+		listening := len(bus.reloads)
+		bus.mu.Unlock()
+		if listening == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spammer := bytes32Hex(0x01)
+	if err := instances[0].changeList("blocklist", spammer, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := instances[0].putBan(ban{Type: banEvent, Value: spammer}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lists := instances[1].currentLists()
+		if _, blocked := lists.blocklist[spammer]; blocked && lists.bans.banned(banEvent, spammer, nostr.Now()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the other instance to reload the changed lists")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	s := recentIDs{size: 2}
+	for _, id := range []string{"a", "b", "c"} {
+		if !s.add(id) {
+			t.Fatalf("expected %s to be new", id)
+		}
+	}
+	if !s.add("a") {
+		t.Fatal("expected the oldest id to be forgotten")
+	}
+	if s.add("c") {
+		t.Fatal("expected a recent id to be remembered")
+	}
+}
+
+func TestPostgresBusPayload(t *testing.T) {
+	small := signedEvent(t, bytes32Hex(0x11), 1, "hello")
+	large := signedEvent(t, bytes32Hex(0x11), 1, strings.Repeat("x", postgresBusMaxPayload))
+	for _, evt := range []*nostr.Event{small, large} {
+		payload, err := postgresBusPayload(evt)
+		if err != nil {
+			t.Fatalf("payload: %v", err)
+		}
+		if len(payload) > postgresBusMaxPayload {
+			t.Fatalf("payload of %d bytes is too large for NOTIFY", len(payload))
+		}
+		var msg postgresBusMessage
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if evt == small && (msg.Event == nil || msg.Event.ID != small.ID) {
+			t.Fatalf("expected the small event to be sent whole, got %s", payload)
+		}
+		if evt == large && (msg.Event != nil || msg.ID != large.ID) {
+			t.Fatalf("expected the large event to be sent by id, got %s", payload)
+		}
+	}
+}
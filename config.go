@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"gopkg.in/yaml.v3"
+)
+
+// relayConfig is what the configuration file and the environment set. The
+// info and limits sections and the quota setting can be reloaded while the
+// relay runs; the other flags are applied once, at startup.
+type relayConfig struct {
+	// path is the configuration file, empty when there is none
+	path  string
+	flags map[string]string
+	// given holds the flags given on the command line, which the file
+	// does not change
+	given  map[string]bool
+	info   nip11.RelayInformationDocument
+	limits relayLimits
+}
+
+// relayLimits are the NIP-11 limitations along with the limits that are not
+// advertised.
+type relayLimits struct {
+	nip11.RelayLimitationDocument
+
+	// MaxFilters is the most filters a REQ may have.
+	MaxFilters int `json:"max_filters"`
+	// MessagesPerSecond and MessageBurst limit how fast each connection
+	// is read from.
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst"`
+}
+
+// loadConfig reads the configuration file at path over the defaults and the
+// NOSTR_RELAY_* environment, so the info section of the file takes precedence
+// over the environment. An empty path gives the configuration without a file.
+// Top-level keys other than info and limits must name a flag of fs.
+func loadConfig(path string, fs *flag.FlagSet) (*relayConfig, error) {
+	return readConfig(path, fs, true)
+}
+
+// loadSubcommandConfig is loadConfig for subcommands, which have only some of
+// the relay's flags: keys naming other flags are left for the relay to check.
+func loadSubcommandConfig(path string, fs *flag.FlagSet) (*relayConfig, error) {
+	return readConfig(path, fs, false)
+}
+
+func readConfig(path string, fs *flag.FlagSet, strict bool) (*relayConfig, error) {
+	cfg := &relayConfig{
+		path:  path,
+		flags: map[string]string{},
+		limits: relayLimits{
+			RelayLimitationDocument: defaultLimits,
+			MaxFilters:              200,
+			MessagesPerSecond:       5,
+			MessageBurst:            1,
+		},
+	}
+	cfg.info = nip11.RelayInformationDocument{
+		Name:           "nostr-relay",
+		Description:    "relay powered by the relayer framework",
+		PubKey:         "2c7cc62a697ea3a7826521f3fd34f0cb273693cbe5e9310f35449f43622a5cdc",
+		Contact:        "mattn.jp@gmail.com",
+		SupportedNIPs:  supportedNIPs,
+		Software:       "https://github.com/mattn/nostr-relay",
+		Icon:           "https://nostr.compile-error.net/logo.png",
+		Version:        version,
+		Limitation:     &cfg.limits.RelayLimitationDocument,
+		RelayCountries: []string{"JP"},
+		LanguageTags:   []string{},
+		Tags:           []string{},
+		PostingPolicy:  "",
+		PaymentsURL:    "",
+		Fees: &nip11.RelayFeesDocument{
+			Admission: []struct {
+				Amount int    "json:\"amount\""
+				Unit   string "json:\"unit\""
+			}{},
+		},
+	}
+	if err := envconfig.Process("NOSTR_RELAY", &cfg.info); err != nil {
+		return nil, fmt.Errorf("failed to read from env: %w", err)
+	}
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]any
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, value := range file {
+		switch key {
+		case "info":
+			err = decodeSection(value, &cfg.info)
+		case "limits":
+			err = decodeSection(value, &cfg.limits)
+		default:
+			if fs == nil || fs.Lookup(key) == nil || key == "config" {
+				if !strict && key != "config" {
+					continue
+				}
+				err = fmt.Errorf("unknown setting")
+				break
+			}
+			switch value.(type) {
+			case map[string]any, []any:
+				err = fmt.Errorf("must be a single value")
+			default:
+				cfg.flags[key] = fmt.Sprint(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	switch {
+	case cfg.limits.MaxLimit < 1:
+		return nil, fmt.Errorf("%s: limits: max_limit must be positive", path)
+	case cfg.limits.MaxFilters < 1:
+		return nil, fmt.Errorf("%s: limits: max_filters must be positive", path)
+	case cfg.limits.MessagesPerSecond <= 0 || cfg.limits.MessageBurst < 1:
+		return nil, fmt.Errorf("%s: limits: messages_per_second and message_burst must be positive", path)
+	}
+	return cfg, nil
+}
+
+// decodeSection decodes a section of the configuration file into v by way of
+// its JSON field names. Keys the section leaves out keep their value.
+func decodeSection(section, v any) error {
+	if section == nil {
+		return nil
+	}
+	b, err := json.Marshal(section)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// setFlags sets the flags of fs named in the file, except those given on the
+// command line. The file thus takes precedence over the environment variables
+// the flags fall back to.
+func (cfg *relayConfig) setFlags(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	cfg.given = given
+	for name, value := range cfg.flags {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Relay) currentConfig() *relayConfig {
+	if cfg := r.config.Load(); cfg != nil {
+		return cfg
+	}
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		log.Fatalf("failed to read from env: %v", err)
+	}
+	r.config.CompareAndSwap(nil, cfg)
+	return r.config.Load()
+}
+
+// applyConfig puts a reloaded configuration in effect. Flags other than quota
+// and the limits handed to the backends and the server at startup keep their
+// values until restart.
+func (r *Relay) applyConfig(cfg *relayConfig) {
+	old := r.currentConfig()
+	flags := maps.Clone(old.flags)
+	if quota, ok := cfg.flags["quota"]; quota != old.flags["quota"] && !old.given["quota"] {
+		if r.reloadQuotas(quota, ok) {
+			flags["quota"] = quota
+			if !ok {
+				delete(flags, "quota")
+			}
+		}
+	}
+	others, before := maps.Clone(cfg.flags), maps.Clone(old.flags)
+	delete(others, "quota")
+	delete(before, "quota")
+	if !maps.Equal(others, before) {
+		slog.Warn("flags in the configuration file other than quota take effect after restart")
+	}
+	cfg.flags, cfg.given = flags, old.given
+
+	fixed := old.limits
+	if cfg.limits.MaxLimit != fixed.MaxLimit || cfg.limits.MaxEventTags != fixed.MaxEventTags ||
+		cfg.limits.MessagesPerSecond != fixed.MessagesPerSecond || cfg.limits.MessageBurst != fixed.MessageBurst {
+		slog.Warn("max_limit, max_event_tags, messages_per_second and message_burst take effect after restart")
+	}
+	cfg.limits.MaxLimit = fixed.MaxLimit
+	cfg.limits.MaxEventTags = fixed.MaxEventTags
+	cfg.limits.MessagesPerSecond = fixed.MessagesPerSecond
+	cfg.limits.MessageBurst = fixed.MessageBurst
+	r.config.Store(cfg)
+}
+
+// reloadQuotas puts the quota rules of a reloaded configuration file in
+// effect, or those of $QUOTA if the file no longer sets any, and reports
+// whether it did. OpenSearch only keeps the usage while there are quotas, so
+// quotas are not turned on or off there until restart.
+func (r *Relay) reloadQuotas(spec string, inFile bool) bool {
+	if !inFile {
+		spec = os.Getenv("QUOTA")
+	}
+	rules, err := parseQuotas(spec)
+	if err != nil {
+		slog.Error("failed to reload quotas", "error", err)
+		return false
+	}
+	if r.driverName == "opensearch" && (len(rules) == 0) != (len(r.quotaRules()) == 0) {
+		slog.Warn("turning quotas on or off takes effect after restart with opensearch")
+		return false
+	}
+	r.quotas.Store(&rules)
+	slog.Info("quotas reloaded", "rules", len(rules))
+	return true
+}
+
+func (r *Relay) reloadConfig(path string) {
+	if path == "" {
+		return
+	}
+	cfg, err := loadConfig(path, flag.CommandLine)
+	if err != nil {
+		slog.Error("failed to reload configuration", "error", err)
+		return
+	}
+	r.applyConfig(cfg)
+	slog.Info("configuration reloaded", "path", path)
+}
+
+// watchConfig reloads the configuration file and the lists on SIGHUP and
+// whenever the file is modified, until ctx is done. Connections stay open.
+func (r *Relay) watchConfig(ctx context.Context, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := configModTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			modified = configModTime(path)
+			r.reloadConfig(path)
+			r.reload()
+		case <-ticker.C:
+			if t := configModTime(path); path != "" && !t.Equal(modified) {
+				modified = t
+				r.reloadConfig(path)
+				r.reload()
+			}
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	driver := fs.String("driver", "sqlite3", "")
+	database := fs.String("database", "nostr-relay.sqlite", "")
+	fs.Parse([]string{"-database", "from-command-line"})
+
+	path := writeConfig(t, `
+driver: postgresql
+database: postgres://localhost/nostr
+info:
+  name: my relay
+  relay_countries: [US, CA]
+limits:
+  max_content_length: 1000
+  max_filters: 10
+`)
+	cfg, err := loadConfig(path, fs)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.info.Name != "my relay" || strings.Join(cfg.info.RelayCountries, ",") != "US,CA" {
+		t.Fatalf("unexpected info: %+v", cfg.info)
+	}
+	if cfg.info.Contact == "" {
+		t.Fatal("expected info left out of the file to keep its default")
+	}
+	if cfg.limits.MaxContentLength != 1000 || cfg.limits.MaxFilters != 10 || cfg.limits.MaxLimit != defaultLimits.MaxLimit {
+		t.Fatalf("unexpected limits: %+v", cfg.limits)
+	}
+	if cfg.info.Limitation.MaxContentLength != 1000 {
+		t.Fatal("expected NIP-11 to advertise the configured limits")
+	}
+
+	if err := cfg.setFlags(fs); err != nil {
+		t.Fatalf("set flags: %v", err)
+	}
+	if *driver != "postgresql" {
+		t.Fatalf("expected the driver from the file, got %s", *driver)
+	}
+	if *database != "from-command-line" {
+		t.Fatalf("expected the command line to take precedence, got %s", *database)
+	}
+
+	for _, content := range []string{
+		"no-such-flag: 1",
+		"info:\n  no_such_field: x",
+		"limits:\n  max_filters: 0",
+		"driver: [a, b]",
+	} {
+		if _, err := loadConfig(writeConfig(t, content), fs); err == nil {
+			t.Fatalf("expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	r.Storage(context.Background()).Init()
+	ctx := context.Background()
+
+	long := signedEvent(t, bytes32Hex(0x11), 1, strings.Repeat("x", 2000))
+	if ok, _ := r.AcceptEvent(ctx, long); !ok {
+		t.Fatal("expected the event to be accepted with the default limits")
+	}
+	future := signedEvent(t, bytes32Hex(0x11), 1, "future")
+	future.CreatedAt = nostr.Now() + 3600
+	if ok, _ := r.AcceptEvent(ctx, future); ok {
+		t.Fatal("expected an event an hour ahead to be rejected")
+	}
+
+	cfg, err := loadConfig(writeConfig(t, `
+info:
+  name: renamed
+limits:
+  max_content_length: 1000
+  max_filters: 1
+  created_at_upper_limit: 7200
+  max_limit: 5
+`), nil)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	r.applyConfig(cfg)
+
+	if ok, _ := r.AcceptEvent(ctx, long); ok {
+		t.Fatal("expected the reloaded content limit to apply")
+	}
+	if ok, _ := r.AcceptEvent(ctx, future); !ok {
+		t.Fatal("expected the reloaded created_at limit to apply")
+	}
+	if r.AcceptReq(ctx, "sub", nostr.Filters{{}, {}}, "") {
+		t.Fatal("expected the reloaded filter limit to apply")
+	}
+	info := r.GetNIP11InformationDocument()
+	if info.Name != "renamed" {
+		t.Fatalf("expected the reloaded name, got %s", info.Name)
+	}
+	if info.Limitation.MaxLimit != defaultLimits.MaxLimit {
+		t.Fatalf("expected max_limit to wait for a restart, got %d", info.Limitation.MaxLimit)
+	}
+}
+
+func TestWatchConfigReloadsLists(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	r.Storage(context.Background()).Init()
+	r.ready()
+	path := writeConfig(t, "info:\n  name: before\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watchConfig(ctx, path, 10*time.Millisecond)
+
+	pubkey, _ := nostr.GetPublicKey(bytes32Hex(0x11))
+	if err := r.listStore.add("blocklist", pubkey); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("info:\n  name: after\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; ; i++ {
+		if _, ok := r.lists.Load().blocklist[pubkey]; ok && r.GetNIP11InformationDocument().Name == "after" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the file change to reload the configuration and the lists")
+		}
+		// the watch may have started after the write, so the file is touched
+		// until it is seen modified
+		modified := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadQuotas(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx)
+	store.Init()
+	r.ready()
+	if err := r.setQuotas("1:1:0"); err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes32Hex(0x11)
+	store.SaveEvent(ctx, signedEvent(t, secret, 1, "one"))
+	second := signedEvent(t, secret, 1, "two")
+	if ok, _ := r.AcceptEvent(ctx, second); ok {
+		t.Fatal("expected the quota to be enforced")
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("quota", "", "")
+	cfg, err := loadConfig(writeConfig(t, `quota: "1:1:0;1:2:0:`+second.PubKey+`"`), fs)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	r.applyConfig(cfg)
+	if ok, msg := r.AcceptEvent(ctx, second); !ok {
+		t.Fatalf("expected the reloaded quota to raise the limit, got %q", msg)
+	}
+
+	cfg, err = loadConfig(writeConfig(t, `quota: "1:x:0"`), fs)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	r.applyConfig(cfg)
+	if ok, _ := r.AcceptEvent(ctx, second); !ok {
+		t.Fatal("expected invalid quotas to leave the running ones in place")
+	}
+}
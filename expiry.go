@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eventExpiration returns the NIP-40 expiration of evt, if it has one.
+func eventExpiration(evt *nostr.Event) (nostr.Timestamp, bool) {
+	for _, ex := range evt.Tags.GetAll([]string{"expiration"}) {
+		v, err := strconv.ParseUint(ex.Value(), 10, 64)
+		if err == nil {
+			return nostr.Timestamp(v), true
+		}
+	}
+	return 0, false
+}
+
+// expirationReaper deletes events whose NIP-40 expiration has passed. The
+// backends cannot look events up by expiration, so the ids and expirations of
+// the events that have one are kept in an expirationIndex as they are saved.
+type expirationReaper struct {
+	index expirationIndex
+	// created is set when the index was created by this instance and so
+	// lacks the events stored before
+	created bool
+
+	deleted atomic.Int64
+	runs    atomic.Int64
+	lastRun atomic.Int64
+	scanned atomic.Bool
+}
+
+// reaperStats is reported in the reaper field of /info.
+type reaperStats struct {
+	Pending int64 `json:"pending"`
+	Expired int64 `json:"expired"`
+	Deleted int64 `json:"deleted"`
+	Runs    int64 `json:"runs"`
+	LastRun int64 `json:"last_run,omitempty"`
+	Scanned bool  `json:"scanned"`
+}
+
+func (e *expirationReaper) track(evt *nostr.Event) {
+	expiration, ok := eventExpiration(evt)
+	if !ok || e.index == nil {
+		return
+	}
+	if err := e.index.put(evt.ID, expiration); err != nil {
+		slog.Error("failed to index expiration", "id", evt.ID, "error", err)
+	}
+}
+
+// expired returns the ids of up to limit indexed events that have expired by
+// now, or all of them if limit is 0.
+func (e *expirationReaper) expired(now nostr.Timestamp, limit int) ([]string, error) {
+	if e.index == nil {
+		return nil, nil
+	}
+	return e.index.expired(now, limit)
+}
+
+func (e *expirationReaper) stats() reaperStats {
+	stats := reaperStats{
+		Deleted: e.deleted.Load(),
+		Runs:    e.runs.Load(),
+		LastRun: e.lastRun.Load(),
+		Scanned: e.scanned.Load(),
+	}
+	if e.index != nil {
+		var err error
+		if stats.Pending, stats.Expired, err = e.index.count(nostr.Now()); err != nil {
+			slog.Warn("failed to count indexed expirations", "error", err)
+		}
+	}
+	return stats
+}
+
+// expirationIndex keeps the ids and expirations of the events that have one.
+type expirationIndex interface {
+	// init prepares the index and reports whether it was created just now,
+	// without the events stored before.
+	init() (created bool, err error)
+	// put records that the event with id expires at expiration.
+	put(id string, expiration nostr.Timestamp) error
+	// expired returns the ids of up to limit events that have expired by
+	// now, or all of them if limit is 0.
+	expired(now nostr.Timestamp, limit int) ([]string, error)
+	// remove forgets the events with ids.
+	remove(ids []string) error
+	// count returns how many events are indexed and how many of them have
+	// expired by now.
+	count(now nostr.Timestamp) (pending, expired int64, err error)
+}
+
+// newExpirationIndex returns where the expirations of the driver are kept:
+// in a table next to the events of SQL backends, which the instances sharing
+// them share as well, in a file next to the lists of the key-value backends,
+// and in memory otherwise.
+func (r *Relay) newExpirationIndex() expirationIndex {
+	switch r.driverName {
+	case "lmdb":
+		return &memoryExpirations{file: &fileLists{dir: r.lmdbStorage.Path}}
+	case "badger":
+		return &memoryExpirations{file: &fileLists{dir: r.badgerStorage.Path}}
+	}
+	if db := r.DB(); db != nil {
+		return &sqlExpirations{db: db}
+	}
+	return &memoryExpirations{}
+}
+
+// sqlExpirations keeps the expirations in the expirations table.
+type sqlExpirations struct {
+	db *sqlx.DB
+}
+
+func (x *sqlExpirations) init() (bool, error) {
+	if _, err := x.db.Exec(`SELECT 1 FROM expirations WHERE 1 = 0`); err == nil {
+		return false, nil
+	}
+	// MySQL has no CREATE INDEX IF NOT EXISTS
+	if x.db.DriverName() == "mysql" {
+		_, err := x.db.Exec(`
+    CREATE TABLE IF NOT EXISTS expirations (
+      id varchar(64) NOT NULL,
+      expires_at bigint NOT NULL,
+      INDEX expirations_id (id),
+      INDEX expirations_expires_at (expires_at)
+    );
+    `)
+		return true, err
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS expirations (id text NOT NULL, expires_at bigint NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS expirations_id ON expirations (id)`,
+		`CREATE INDEX IF NOT EXISTS expirations_expires_at ON expirations (expires_at)`,
+	} {
+		if _, err := x.db.Exec(stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (x *sqlExpirations) put(id string, expiration nostr.Timestamp) error {
+	tx, err := x.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM expirations WHERE id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(tx.Rebind(`INSERT INTO expirations (id, expires_at) VALUES (?, ?)`), id, expiration); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (x *sqlExpirations) expired(now nostr.Timestamp, limit int) ([]string, error) {
+	query, args := `SELECT id FROM expirations WHERE expires_at <= ? ORDER BY expires_at`, []any{now}
+	if limit > 0 {
+		query, args = query+` LIMIT ?`, append(args, limit)
+	}
+	var ids []string
+	err := x.db.Select(&ids, x.db.Rebind(query), args...)
+	return ids, err
+}
+
+func (x *sqlExpirations) remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(`DELETE FROM expirations WHERE id IN (?)`, ids)
+	if err != nil {
+		return err
+	}
+	_, err = x.db.Exec(x.db.Rebind(query), args...)
+	return err
+}
+
+func (x *sqlExpirations) count(now nostr.Timestamp) (pending, expired int64, err error) {
+	err = x.db.QueryRow(x.db.Rebind(`SELECT count(*), count(CASE WHEN expires_at <= ? THEN 1 END) FROM expirations`), now).Scan(&pending, &expired)
+	return pending, expired, err
+}
+
+// memoryExpirations keeps the expirations in memory, and in the file named
+// expirations of file if it is set, one id and expiration per line. An index
+// without a file is created anew on every start.
+type memoryExpirations struct {
+	file *fileLists
+
+	mu      sync.Mutex
+	pending map[string]nostr.Timestamp
+}
+
+func (x *memoryExpirations) init() (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.pending = make(map[string]nostr.Timestamp)
+	if x.file == nil {
+		return true, nil
+	}
+	if err := x.file.init(); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(x.file.dir, "expirations")); errors.Is(err, fs.ErrNotExist) {
+		// created now so that a restart does not take it for missing
+		return true, x.file.append("expirations", "# id expiration")
+	}
+	lines, err := x.file.readFile("expirations")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, v, _ := strings.Cut(line, " ")
+		expiration, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid expiration %s: %w", line, err)
+		}
+		x.pending[id] = nostr.Timestamp(expiration)
+	}
+	return false, nil
+}
+
+func (x *memoryExpirations) put(id string, expiration nostr.Timestamp) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.pending == nil {
+		x.pending = make(map[string]nostr.Timestamp)
+	}
+	x.pending[id] = expiration
+	if x.file == nil {
+		return nil
+	}
+	return x.file.append("expirations", fmt.Sprintf("%s %d", id, expiration))
+}
+
+func (x *memoryExpirations) expired(now nostr.Timestamp, limit int) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var ids []string
+	for id, expiration := range x.pending {
+		if expiration <= now {
+			ids = append(ids, id)
+			if len(ids) == limit {
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (x *memoryExpirations) remove(ids []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, id := range ids {
+		delete(x.pending, id)
+	}
+	if x.file == nil || len(ids) == 0 {
+		return nil
+	}
+	drop := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		drop[id] = struct{}{}
+	}
+	return x.file.rewrite("expirations", func(line string) bool {
+		id, _, _ := strings.Cut(line, " ")
+		_, ok := drop[id]
+		return ok
+	}, "")
+}
+
+func (x *memoryExpirations) count(now nostr.Timestamp) (pending, expired int64, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, expiration := range x.pending {
+		if expiration <= now {
+			expired++
+		}
+	}
+	return int64(len(x.pending)), expired, nil
+}
+
+// reapExpired indexes the events stored before the expiration index was
+// created, if it was just now, and then deletes expired events every
+// interval, batchSize at a time, until ctx is done.
+func (r *Relay) reapExpired(ctx context.Context, interval time.Duration, batchSize int) {
+	if r.reaper.created {
+		if err := r.scanExpirations(ctx); err != nil {
+			slog.Error("failed to scan for expiring events", "error", err)
+		}
+	}
+	r.reaper.scanned.Store(true)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.reapOnce(ctx, batchSize)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) reapOnce(ctx context.Context, batchSize int) {
+	defer func() {
+		r.reaper.runs.Add(1)
+		r.reaper.lastRun.Store(int64(nostr.Now()))
+	}()
+
+	store := r.Storage(ctx)
+	for {
+		ids, err := r.reaper.expired(nostr.Now(), batchSize)
+		if err != nil {
+			slog.Error("failed to look up expired events", "error", err)
+			return
+		}
+		if len(ids) == 0 {
+			return
+		}
+		// ids that are no longer found were deleted some other way
+		events, err := queryAll(ctx, store, nostr.Filter{IDs: ids, Limit: len(ids)})
+		if err != nil {
+			slog.Error("failed to query expired events", "error", err)
+			return
+		}
+		for _, evt := range events {
+			if err := store.DeleteEvent(ctx, evt); err != nil {
+				slog.Error("failed to delete expired event", "id", evt.ID, "error", err)
+				return
+			}
+			r.reaper.deleted.Add(1)
+		}
+		if err := r.reaper.index.remove(ids); err != nil {
+			slog.Error("failed to unindex expired events", "error", err)
+			return
+		}
+		slog.Debug("deleted expired events", "count", len(events))
+	}
+}
+
+// scanExpirations indexes the expirations of the events already stored. It
+// runs once, when the index is created, except for OpenSearch, whose index is
+// kept in memory but which can find the events with an expiration tag by
+// itself: it indexes the values of every tag, names included, and matches a
+// tag filter by value alone.
+func (r *Relay) scanExpirations(ctx context.Context) error {
+	store := r.Storage(ctx).(*relayStore)
+	var src eventstore.Store = store
+	filter := nostr.Filter{}
+	if r.driverName == "opensearch" {
+		src, filter = store.Store, nostr.Filter{Tags: nostr.TagMap{"expiration": {"expiration"}}}
+	}
+	return walkEvents(ctx, src, filter, relayLimitationDocument.MaxLimit, func(events []*nostr.Event, _ nostr.Timestamp) error {
+		for _, evt := range events {
+			if expiration, ok := eventExpiration(evt); ok {
+				if err := r.reaper.index.put(evt.ID, expiration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// countExpired returns how many of the events matching filter have expired but
+// not been deleted yet.
+func (s *relayStore) countExpired(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if s.relay == nil {
+		return 0, nil
+	}
+	ids, err := s.relay.reaper.expired(nostr.Now(), 0)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	if filter.IDs != nil {
+		var both []string
+		for _, id := range ids {
+			for _, want := range filter.IDs {
+				if id == want {
+					both = append(both, id)
+				}
+			}
+		}
+		if len(both) == 0 {
+			return 0, nil
+		}
+		ids = both
+	}
+	// backends limit the number of ids in a filter
+	var count int64
+	for chunk := range slices.Chunk(ids, relayLimitationDocument.MaxLimit) {
+		filter.IDs = chunk
+		n, err := s.countStored(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func expiringEvent(t *testing.T, secret string, expiration nostr.Timestamp) *nostr.Event {
+	t.Helper()
+	evt := &nostr.Event{
+		CreatedAt: nostr.Now() - 10,
+		Kind:      1,
+		Tags:      nostr.Tags{{"expiration", strconv.FormatInt(int64(expiration), 10)}},
+		Content:   "soon gone",
+	}
+	if err := evt.Sign(secret); err != nil {
+		t.Fatalf("sign event: %v", err)
+	}
+	return evt
+}
+
+func TestExpiredEventsAreReaped(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx).(*relayStore)
+	store.Init()
+	r.ready()
+
+	// saved before the reaper starts, so only its scan can find it
+	store.SaveEvent(ctx, expiringEvent(t, bytes32Hex(0x11), nostr.Now()-5))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go r.reapExpired(runCtx, time.Hour, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.reaper.stats().Runs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reaper did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	live := signedEvent(t, bytes32Hex(0x22), 1, "stays")
+	later := expiringEvent(t, bytes32Hex(0x33), nostr.Now()+3600)
+	expired := expiringEvent(t, bytes32Hex(0x44), nostr.Now()-1)
+	for _, evt := range []*nostr.Event{live, later, expired} {
+		store.SaveEvent(ctx, evt)
+		store.AfterSave(evt)
+	}
+
+	count, err := store.CountEvents(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil || count != 2 {
+		t.Fatalf("expected the expired event not to be counted, got %d (%v)", count, err)
+	}
+	if count, _ := r.countEvents(ctx); count != 2 {
+		t.Fatalf("expected /info to leave out the expired event, got %d", count)
+	}
+
+	r.reapOnce(ctx, 1)
+	stats := r.reaper.stats()
+	if stats.Deleted != 2 || stats.Pending != 1 || stats.Expired != 0 || !stats.Scanned {
+		t.Fatalf("unexpected reaper stats: %+v", stats)
+	}
+	if n, _ := r.memoryStorage.CountEvents(ctx, nostr.Filter{}); n != 2 {
+		t.Fatalf("expected expired events to be deleted, %d left", n)
+	}
+}
+
+func TestExpirationIndexSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "relay.sqlite")
+	open := func() *Relay {
+		r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: path}}
+		if err := r.Storage(ctx).Init(); err != nil {
+			t.Fatal(err)
+		}
+		r.ready()
+		return r
+	}
+
+	r := open()
+	if !r.reaper.created {
+		t.Fatal("expected the index to be created on the first start")
+	}
+	store := r.Storage(ctx).(*relayStore)
+	for _, evt := range []*nostr.Event{expiringEvent(t, bytes32Hex(0x11), nostr.Now()-5), expiringEvent(t, bytes32Hex(0x22), nostr.Now()+3600)} {
+		store.SaveEvent(ctx, evt)
+		store.AfterSave(evt)
+	}
+	r.Storage(ctx).Close()
+
+	r = open()
+	defer r.Storage(ctx).Close()
+	if r.reaper.created {
+		t.Fatal("expected the index to be found again rather than rebuilt")
+	}
+	if stats := r.reaper.stats(); stats.Pending != 2 || stats.Expired != 1 {
+		t.Fatalf("unexpected reaper stats: %+v", stats)
+	}
+	r.reapOnce(ctx, 10)
+	if stats := r.reaper.stats(); stats.Pending != 1 || stats.Deleted != 1 {
+		t.Fatalf("unexpected reaper stats: %+v", stats)
+	}
+}
+
+func TestFileExpirations(t *testing.T) {
+	dir := t.TempDir()
+	x := &memoryExpirations{file: &fileLists{dir: dir}}
+	if created, err := x.init(); err != nil || !created {
+		t.Fatalf("expected the file to be created, got %v %v", created, err)
+	}
+	x.put("a", 10)
+	x.put("b", 20)
+	x.remove([]string{"a"})
+
+	x = &memoryExpirations{file: &fileLists{dir: dir}}
+	if created, err := x.init(); err != nil || created {
+		t.Fatalf("expected the file to be read, got %v %v", created, err)
+	}
+	if ids, _ := x.expired(30, 0); len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("unexpected expired ids %v", ids)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip70"
+)
+
+// maxImportLineSize bounds a single line of an import file. It is well above
+// the relay's message size limit, so that events accepted elsewhere still fit.
+const maxImportLineSize = 16 * 1024 * 1024
+
+// openRelayFlags registers the -driver and -database flags of the export and
+// import subcommands, which mean the same as for the relay itself.
+func openRelayFlags(flags *flag.FlagSet, r *Relay, databaseURL *string) {
+	flags.StringVar(&r.driverName, "driver", "sqlite3", "driver name (sqlite3/turso/postgresql/mysql/opensearch/lmdb/badger/memory)")
+	flags.StringVar(databaseURL, "database", envDef("DATABASE_URL", "nostr-relay.sqlite"), "connection string")
+}
+
+// runExport writes the events matching a filter as newline-delimited JSON,
+// oldest first, in the same format as strfry export.
+func runExport(args []string) error {
+	var r Relay
+	var databaseURL, filterJSON, output string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	openRelayFlags(flags, &r, &databaseURL)
+	flags.StringVar(&filterJSON, "filter", "{}", "nostr filter selecting the events to export")
+	flags.StringVar(&output, "o", "", "output file (default stdout)")
+	flags.Parse(args)
+
+	var filter nostr.Filter
+	if err := json.Unmarshal([]byte(filterJSON), &filter); err != nil {
+		return fmt.Errorf("parse filter: %w", err)
+	}
+	if err := r.configureStorage(databaseURL, 0, migratePageSize); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	store := r.Storage(ctx)
+	if err := store.Init(); err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer store.Close()
+
+	out := io.Writer(os.Stdout)
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	var exported int64
+	write := func(events []*nostr.Event, _ nostr.Timestamp) error {
+		for _, evt := range events {
+			b, err := json.Marshal(evt)
+			if err != nil {
+				return err
+			}
+			w.Write(b)
+			if err := w.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		exported += int64(len(events))
+		return nil
+	}
+
+	// with a limit, export the newest events up to it, like a REQ would
+	var err error
+	if filter.Limit > 0 {
+		var events []*nostr.Event
+		if events, err = queryAll(ctx, store, filter); err != nil {
+			return fmt.Errorf("query events: %w", err)
+		}
+		slices.Reverse(events)
+		err = write(events, 0)
+	} else {
+		err = walkEvents(ctx, store, filter, migratePageSize, write)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	slog.Info("export finished", "exported", exported)
+	return nil
+}
+
+// runImport reads newline-delimited event JSON, such as the output of export
+// or strfry export, and stores the events. Every event must have a valid id
+// and signature. Unless -bypass-policy is given, events are also subject to
+// the same checks as events published by clients, under the configuration
+// file, quotas, lists and bans of the relay, and NIP-70 protected events,
+// which only their authenticated author may publish, are rejected. Stored
+// events have their expirations indexed and reports acted on as the relay
+// would.
+func runImport(args []string) error {
+	var r Relay
+	var databaseURL, configPath string
+	var policy policyFlags
+	var bypass bool
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	openRelayFlags(flags, &r, &databaseURL)
+	flags.StringVar(&configPath, "config", envDef("CONFIG_FILE", ""), "configuration file (YAML) of the relay")
+	policy.registerFlags(flags)
+	flags.BoolVar(&bypass, "bypass-policy", false, "store events the relay would reject from clients")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nostr-relay import [flags] [file ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := loadSubcommandConfig(configPath, flags)
+	if err != nil {
+		return fmt.Errorf("load configuration: %w", err)
+	}
+	if err := cfg.setFlags(flags); err != nil {
+		return fmt.Errorf("load configuration: %w", err)
+	}
+	r.config.Store(cfg)
+	*relayLimitationDocument = cfg.limits.RelayLimitationDocument
+	if err := policy.apply(&r); err != nil {
+		return fmt.Errorf("parse %w", err)
+	}
+
+	if err := r.configureStorage(databaseURL, 0, relayLimitationDocument.MaxLimit); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	store := r.Storage(ctx)
+	if err := store.Init(); err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer store.Close()
+	r.ready()
+	// reports are acted on in the background, before the storage closes
+	defer r.tasks.close(ctx)
+	// what the relay would do at startup, so that quotas are enforced and
+	// the events already stored are not missed once the import is done
+	if r.tracksUsage() {
+		r.scanUsage(ctx)
+	}
+	if r.reaper.created {
+		if err := r.scanExpirations(ctx); err != nil {
+			return fmt.Errorf("scan for expiring events: %w", err)
+		}
+	}
+
+	var stats importStats
+	if flags.NArg() == 0 {
+		if err := r.importEvents(ctx, os.Stdin, bypass, &stats); err != nil {
+			return err
+		}
+	}
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = r.importEvents(ctx, f, bypass, &stats)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	slog.Info("import finished", "imported", stats.imported, "rejected", stats.rejected, "invalid", stats.invalid)
+	return nil
+}
+
+type importStats struct {
+	imported int64
+	rejected int64
+	invalid  int64
+}
+
+func (r *Relay) importEvents(ctx context.Context, in io.Reader, bypass bool, stats *importStats) error {
+	store := r.Storage(ctx)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var evt nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			slog.Warn("skipping malformed event", "line", line, "error", err)
+			stats.invalid++
+			continue
+		}
+		if !evt.CheckID() {
+			slog.Warn("skipping event with invalid id", "line", line, "id", evt.ID)
+			stats.invalid++
+			continue
+		}
+		if ok, _ := evt.CheckSignature(); !ok {
+			slog.Warn("skipping event with invalid signature", "line", line, "id", evt.ID)
+			stats.invalid++
+			continue
+		}
+
+		if !bypass {
+			if nostr.IsEphemeralKind(evt.Kind) || skipEventFunc(&evt) {
+				stats.rejected++
+				continue
+			}
+			// no one is authenticated as the author of an imported event, so
+			// NIP-70 protected events would only be turned away for that
+			if nip70.IsProtected(evt) {
+				slog.Debug("event rejected", "line", line, "id", evt.ID, "reason", "protected events need -bypass-policy")
+				stats.rejected++
+				continue
+			}
+			if accepted, reason := r.AcceptEvent(ctx, &evt); !accepted {
+				slog.Debug("event rejected", "line", line, "id", evt.ID, "reason", reason)
+				stats.rejected++
+				continue
+			}
+		}
+
+		stored, err := storeEvent(ctx, store, &evt)
+		if err != nil {
+			return fmt.Errorf("line %d: save event %s: %w", line, evt.ID, err)
+		}
+		if stored {
+			// as the relay does after a save, but there are no subscribers
+			// nor notifications to tell
+			r.storeWithHooks.AfterSave(&evt)
+		}
+		stats.imported++
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("line longer than %d bytes: %w", maxImportLineSize, err)
+		}
+		return err
+	}
+	return nil
+}
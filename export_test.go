@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "relay.sqlite")
+
+	r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: database}}
+	store := r.Storage(context.Background())
+	if err := store.Init(); err != nil {
+		t.Fatalf("init storage: %v", err)
+	}
+	for i, kind := range []int{1, 7, 1} {
+		evt := signedEvent(t, bytes32Hex(0x11), kind, "hello")
+		evt.CreatedAt = nostr.Timestamp(1000 + i)
+		evt.Sign(bytes32Hex(0x11))
+		store.SaveEvent(context.Background(), evt)
+	}
+	store.Close()
+
+	output := filepath.Join(dir, "export.jsonl")
+	if err := runExport([]string{"-database", database, "-filter", `{"kinds":[1]}`, "-o", output}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	var last nostr.Timestamp
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var evt nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			t.Fatalf("export wrote invalid JSON: %v", err)
+		}
+		if evt.Kind != 1 || evt.CreatedAt < last {
+			t.Fatalf("expected kind 1 events oldest first, got kind %d at %d", evt.Kind, evt.CreatedAt)
+		}
+		last = evt.CreatedAt
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 exported events, got %d", len(lines))
+	}
+
+	forged := signedEvent(t, bytes32Hex(0x22), 1, "forged")
+	forged.Content = "tampered"
+	forged.ID = forged.GetID()
+	b, _ := json.Marshal(forged)
+	blocked, _ := json.Marshal(signedEvent(t, bytes32Hex(0x33), 1, "blocked"))
+	protected := signedEvent(t, bytes32Hex(0x44), 1, "protected")
+	protected.Tags = nostr.Tags{{"-"}}
+	protected.Sign(bytes32Hex(0x44))
+	p, _ := json.Marshal(protected)
+	input := strings.Join(append(lines, string(b), "not json", string(blocked), string(p)), "\n")
+
+	dst := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	dst.Storage(context.Background()).Init()
+	dst.ready()
+	blockedKey, _ := nostr.GetPublicKey(bytes32Hex(0x33))
+	dst.listStore.add("blocklist", blockedKey)
+	dst.reload()
+
+	var stats importStats
+	if err := dst.importEvents(context.Background(), strings.NewReader(input), false, &stats); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if stats.imported != 2 || stats.invalid != 2 || stats.rejected != 2 {
+		t.Fatalf("unexpected import stats: %+v", stats)
+	}
+
+	stats = importStats{}
+	if err := dst.importEvents(context.Background(), strings.NewReader(input), true, &stats); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if count, _ := dst.countEvents(context.Background()); count != 4 || stats.invalid != 2 {
+		t.Fatalf("expected bypass to store the blocklisted and protected events, got %d events, %+v", count, stats)
+	}
+}
+
+func TestImportAppliesRelayConfiguration(t *testing.T) {
+	defer func(limits nip11.RelayLimitationDocument) { *relayLimitationDocument = limits }(*relayLimitationDocument)
+	dir := t.TempDir()
+	database := filepath.Join(dir, "relay.sqlite")
+	config := writeConfig(t, `
+addr: 127.0.0.1:7447
+quota: "1:2:0"
+limits:
+  max_content_length: 100
+`)
+
+	secret := bytes32Hex(0x11)
+	expiring := signedEvent(t, secret, 1, "expiring")
+	expiring.Tags = nostr.Tags{{"expiration", fmt.Sprint(nostr.Now() + 3600)}}
+	expiring.Sign(secret)
+	long := signedEvent(t, secret, 1, strings.Repeat("x", 200))
+	var lines []string
+	for _, evt := range []*nostr.Event{
+		expiring,
+		long,
+		signedEvent(t, secret, 1, "second"),
+		signedEvent(t, secret, 1, "over the quota"),
+	} {
+		b, _ := json.Marshal(evt)
+		lines = append(lines, string(b))
+	}
+	input := filepath.Join(dir, "import.jsonl")
+	if err := os.WriteFile(input, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runImport([]string{"-config", config, "-database", database, input}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: database}}
+	if err := r.Storage(context.Background()).Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Storage(context.Background()).Close()
+	r.ready()
+	if count, _ := r.countEvents(context.Background()); count != 2 {
+		t.Fatalf("expected the content limit and the quota to reject two events, got %d stored", count)
+	}
+	if events, _ := queryAll(context.Background(), r.Storage(context.Background()), nostr.Filter{IDs: []string{long.ID}}); len(events) != 0 {
+		t.Fatal("expected the content limit of the configuration file to apply")
+	}
+	if used, _ := r.usage.used(context.Background(), expiring.PubKey, nil); used.events != 2 {
+		t.Fatalf("expected the imported events in the usage, got %+v", used)
+	}
+	if pending, _, _ := r.reaper.index.count(nostr.Now()); pending != 1 {
+		t.Fatalf("expected the expiration to be indexed, got %d", pending)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// framePrefixSize is how much of each text message a frameScanner keeps, which
+// is plenty for the type and the subscription id NIP-01 caps at 64 characters.
+const framePrefixSize = 256
+
+// frameScanner follows the websocket frames sent in one direction of a
+// connection and calls message with the start of every text message. The
+// relayer answers REQ, CLOSE and COUNT without telling the relay about all of
+// them, so this is how the relay learns what the clients asked for.
+type frameScanner struct {
+	message func(prefix []byte)
+	// handshake is set until the end of the HTTP response that comes before
+	// the frames the server sends
+	handshake bool
+	tail      []byte
+
+	header  []byte
+	inFrame bool
+	fin     bool
+	opcode  byte
+	masked  bool
+	mask    [4]byte
+	offset  uint64
+	payload uint64
+	text    bool
+	prefix  []byte
+}
+
+// scan takes the next bytes sent over the connection.
+func (s *frameScanner) scan(b []byte) {
+	if s.handshake {
+		s.tail = append(s.tail, b...)
+		end := bytes.Index(s.tail, []byte("\r\n\r\n"))
+		if end < 0 {
+			// keep what may be the start of the terminator
+			s.tail = s.tail[max(0, len(s.tail)-3):]
+			return
+		}
+		b = s.tail[end+4:]
+		s.handshake, s.tail = false, nil
+	}
+	for len(b) > 0 {
+		if !s.inFrame {
+			s.header = append(s.header, b[0])
+			b = b[1:]
+			if s.startFrame() && s.payload == 0 {
+				s.endFrame()
+			}
+			continue
+		}
+		n := min(uint64(len(b)), s.payload)
+		s.read(b[:n])
+		b = b[n:]
+		s.payload -= n
+		if s.payload == 0 {
+			s.endFrame()
+		}
+	}
+}
+
+// startFrame parses the frame header read so far and reports whether it is
+// complete.
+func (s *frameScanner) startFrame() bool {
+	h := s.header
+	if len(h) < 2 {
+		return false
+	}
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	masked := h[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	if len(h) < size {
+		return false
+	}
+
+	s.payload = uint64(h[1] & 0x7f)
+	switch s.payload {
+	case 126:
+		s.payload = uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		s.payload = binary.BigEndian.Uint64(h[2:10])
+	}
+	s.fin, s.opcode, s.masked, s.offset = h[0]&0x80 != 0, h[0]&0x0f, masked, 0
+	if masked {
+		copy(s.mask[:], h[size-4:size])
+	}
+	switch s.opcode {
+	case websocketText:
+		s.text, s.prefix = true, s.prefix[:0]
+	case websocketBinary:
+		s.text = false
+	}
+	s.header, s.inFrame = s.header[:0], true
+	return true
+}
+
+// read takes payload bytes of the current frame, keeping the start of text
+// messages. Control frames, which may come between the frames of a message,
+// are skipped.
+func (s *frameScanner) read(b []byte) {
+	if s.opcode >= websocketClose || !s.text {
+		return
+	}
+	for _, c := range b[:min(len(b), framePrefixSize-len(s.prefix))] {
+		if s.masked {
+			c ^= s.mask[s.offset%4]
+		}
+		s.prefix = append(s.prefix, c)
+		s.offset++
+	}
+}
+
+func (s *frameScanner) endFrame() {
+	s.inFrame = false
+	if s.opcode < websocketClose && s.fin && s.text {
+		s.text = false
+		s.message(s.prefix)
+	}
+}
+
+// The websocket opcodes a frameScanner tells apart.
+const (
+	websocketText   = 1
+	websocketBinary = 2
+	websocketClose  = 8
+)
+
+// nostrMessage returns the type of the NIP-01 message starting with prefix
+// and its second element if that is a string, such as a subscription id.
+func nostrMessage(prefix []byte) (typ, id string, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(prefix))
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return "", "", false
+	}
+	t, err := dec.Token()
+	if typ, ok = t.(string); err != nil || !ok {
+		return "", "", false
+	}
+	if t, err := dec.Token(); err == nil {
+		id, _ = t.(string)
+	}
+	return typ, id, true
+}
+
+// watchedConn is a websocket connection whose messages are shown to a
+// connWatcher as they are read and written.
+type watchedConn struct {
+	net.Conn
+	in, out frameScanner
+	close   sync.Once
+	closed  func()
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.scan(b[:n])
+	return n, err
+}
+
+func (c *watchedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.scan(b[:n])
+	return n, err
+}
+
+func (c *watchedConn) Close() error {
+	c.close.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// connWatcher is told about the NIP-01 messages of a websocket connection:
+// received for those from the client, sent for those to it, and closed when
+// the connection closes.
+type connWatcher interface {
+	received(typ, id string)
+	sent(typ, id string)
+	closed()
+}
+
+// watchingWriter hands the connection taken over for a websocket to a
+// watcher made by watch.
+type watchingWriter struct {
+	http.ResponseWriter
+	watch func() connWatcher
+}
+
+func (w *watchingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	watcher := w.watch()
+	message := func(notify func(typ, id string)) func([]byte) {
+		return func(prefix []byte) {
+			if typ, id, ok := nostrMessage(prefix); ok {
+				notify(typ, id)
+			}
+		}
+	}
+	return &watchedConn{
+		Conn:   conn,
+		in:     frameScanner{message: message(watcher.received)},
+		out:    frameScanner{message: message(watcher.sent), handshake: true},
+		closed: watcher.closed,
+	}, brw, nil
+}
+
+func (w *watchingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// watchConnections shows the messages of the websocket connections next
+// serves to a watcher made by watch for each. Other requests go to next as
+// they are.
+func watchConnections(next http.Handler, watch func() connWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(&watchingWriter{ResponseWriter: w, watch: watch}, req)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frame encodes a websocket frame, masked as clients send them if masked.
+func frame(opcode byte, fin, masked bool, payload string) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	p := []byte(payload)
+	if masked {
+		mask := []byte{0x12, 0x34, 0x56, 0x78}
+		b = append(b, mask...)
+		for i := range p {
+			p[i] ^= mask[i%4]
+		}
+	}
+	return append(b, p...)
+}
+
+func TestFrameScanner(t *testing.T) {
+	for _, masked := range []bool{true, false} {
+		var b []byte
+		if !masked {
+			b = append(b, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"...)
+		}
+		b = append(b, frame(websocketText, true, masked, `["REQ","sub",{"kinds":[1]}]`)...)
+		// a ping between the frames of a message
+		b = append(b, frame(websocketText, false, masked, `["CLOSE",`)...)
+		b = append(b, frame(0x9, true, masked, "")...)
+		b = append(b, frame(0, true, masked, `"sub"]`)...)
+		b = append(b, frame(websocketBinary, true, masked, `["REQ","binary"]`)...)
+		b = append(b, frame(websocketText, true, masked, `["EVENT","sub",{"content":"`+string(bytes.Repeat([]byte("x"), 70000))+`"}]`)...)
+		b = append(b, frame(websocketText, true, masked, `["COUNT","c",{}]`)...)
+
+		var got []string
+		s := frameScanner{message: func(prefix []byte) {
+			typ, id, _ := nostrMessage(prefix)
+			got = append(got, typ+" "+id)
+		}, handshake: !masked}
+		// a byte at a time, as the connection may split them anywhere
+		for i := range b {
+			s.scan(b[i : i+1])
+		}
+		if len(got) != 4 || got[0] != "REQ sub" || got[1] != "CLOSE sub" || got[2] != "EVENT sub" || got[3] != "COUNT c" {
+			t.Fatalf("masked %v: unexpected messages %v", masked, got)
+		}
+	}
+}
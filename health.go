@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// healthCheckTimeout bounds each readiness check.
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck is the result of one readiness check.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthReport is the body of /healthz and /readyz. Status is "ok", or
+// "unavailable" if a required check failed, or "degraded" if only an optional
+// one did.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// readinessCheck is a check of something the relay depends on. The relay
+// keeps serving when an optional one fails.
+type readinessCheck struct {
+	name     string
+	optional bool
+	run      func(ctx context.Context) error
+}
+
+func (r *Relay) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "storage", run: r.checkStorage},
+		{name: "lists", run: r.checkLists},
+	}
+	if r.customSearchURL != "" {
+		// queries fall back to the backend while it is unreachable
+		checks = append(checks, readinessCheck{name: "custom_search", optional: true, run: r.checkCustomSearch})
+	}
+	return checks
+}
+
+// readiness runs every readiness check.
+func (r *Relay) readiness(ctx context.Context) healthReport {
+	report := healthReport{Status: "ok", Checks: map[string]healthCheck{}}
+	for _, check := range r.readinessChecks() {
+		err := runHealthCheck(ctx, check.run)
+		if err == nil {
+			report.Checks[check.name] = healthCheck{Status: "ok"}
+			continue
+		}
+		report.Checks[check.name] = healthCheck{Status: "error", Error: err.Error()}
+		switch {
+		case !check.optional:
+			report.Status = "unavailable"
+		case report.Status == "ok":
+			report.Status = "degraded"
+		}
+	}
+	return report
+}
+
+// runHealthCheck runs check, giving up after healthCheckTimeout even if the
+// check does not heed its context.
+func runHealthCheck(ctx context.Context, check func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Relay) checkStorage(ctx context.Context) error {
+	if db := r.DB(); db != nil {
+		return db.PingContext(ctx)
+	}
+	ch, err := r.Storage(ctx).QueryEvents(internalQuery(ctx), nostr.Filter{Limit: 1})
+	if err != nil {
+		return err
+	}
+	for range ch {
+	}
+	return nil
+}
+
+func (r *Relay) checkLists(ctx context.Context) error {
+	if r.listStore != nil && r.lists.Load() == nil {
+		return errors.New("allowlist and blocklist have not been loaded")
+	}
+	return nil
+}
+
+// checkCustomSearch reports whether the custom search endpoint answers at
+// all; any response short of a server error will do.
+func (r *Relay) checkCustomSearch(ctx context.Context) error {
+	if !r.searchGuard.allow() {
+		return errors.New("circuit breaker is open")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.customSearchURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *Relay) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeHealthReport(w, healthReport{Status: "ok"})
+}
+
+func (r *Relay) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	writeHealthReport(w, r.readiness(req.Context()))
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("content-type", "application/json")
+	if report.Status == "unavailable" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
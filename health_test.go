@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, healthReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	var report healthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return w.Code, report
+}
+
+func TestHealth(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	r.Storage(context.Background()).Init()
+
+	if code, report := getHealth(t, r.handleHealthz); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("expected /healthz to be ok, got %d %+v", code, report)
+	}
+
+	r.listStore = r.newListStore()
+	r.listStore.init()
+	code, report := getHealth(t, r.handleReadyz)
+	if code != http.StatusServiceUnavailable || report.Checks["lists"].Status != "error" || report.Checks["storage"].Status != "ok" {
+		t.Fatalf("expected not to be ready before the lists are loaded, got %d %+v", code, report)
+	}
+
+	r.reload()
+	if code, report := getHealth(t, r.handleReadyz); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("expected to be ready, got %d %+v", code, report)
+	}
+
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer search.Close()
+	r.customSearchURL = search.URL
+	code, report = getHealth(t, r.handleReadyz)
+	if code != http.StatusOK || report.Status != "degraded" || report.Checks["custom_search"].Error == "" {
+		t.Fatalf("expected an unreachable custom search to degrade readiness, got %d %+v", code, report)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// listColumns names the lists a listStore keeps, along with the column their
+// SQL tables hold the entries in:
+//
+//   - allowlist and blocklist hold pubkeys allowed to write, or not;
+//   - kindallowlist holds the kinds accepted, all of them while it is empty.
+var listColumns = map[string]string{
+	"allowlist":     "pubkey",
+	"blocklist":     "pubkey",
+	"kindallowlist": "kind",
+}
+
+// listNames are the keys of listColumns in a fixed order.
+var listNames = []string{"allowlist", "blocklist", "kindallowlist"}
+
+// listStore persists the allowlist, the blocklist and the other lists of
+// listColumns, along with the bans and the actions taken on reports. SQL
+// backends keep them in tables next to the events; the key-value backends have
+// no place for them, so they are kept in plain files instead, and the memory
+// driver keeps them in memory along with its events.
+type listStore interface {
+	// init creates whatever the store needs to hold the lists.
+	init() error
+	// load returns the entries of list.
+	load(list string) (map[string]struct{}, error)
+	// add puts value on list.
+	add(list, value string) error
+	// remove takes value off list.
+	remove(list, value string) error
+	// loadBans returns the bans, expired or not.
+	loadBans() ([]ban, error)
+	// putBan stores b in place of the ban of the same type and value.
+	putBan(b ban) error
+	// removeBan deletes the ban of typ on value.
+	removeBan(typ, value string) error
+	// loadActions returns the actions taken on reports.
+	loadActions() ([]moderationAction, error)
+	// putAction stores a in place of the action of the same id.
+	putAction(a moderationAction) error
+	// loadInfo returns the NIP-11 fields changed through the management API,
+	// by name.
+	loadInfo() (map[string]string, error)
+	// putInfo stores value for the NIP-11 field.
+	putInfo(field, value string) error
+}
+
+// sqlLists keeps each list in a table of the same name.
+type sqlLists struct {
+	db *sqlx.DB
+}
+
+func (l *sqlLists) init() error {
+	for _, list := range listNames {
+		_, err := l.db.Exec(`
+    CREATE TABLE IF NOT EXISTS ` + list + ` (
+      ` + listColumns[list] + ` text NOT NULL
+    );
+    `)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := l.db.Exec(`
+    CREATE TABLE IF NOT EXISTS bans (
+      type text NOT NULL,
+      value text NOT NULL,
+      reason text NOT NULL,
+      creator text NOT NULL,
+      created_at bigint NOT NULL,
+      expires_at bigint NOT NULL
+    );
+    `)
+	if err != nil {
+		return err
+	}
+	_, err = l.db.Exec(`
+    CREATE TABLE IF NOT EXISTS moderation_actions (
+      id text NOT NULL,
+      action text NOT NULL,
+      type text NOT NULL,
+      target text NOT NULL,
+      reason text NOT NULL,
+      reports integer NOT NULL,
+      weight double precision NOT NULL,
+      created_at bigint NOT NULL,
+      reversed_at bigint NOT NULL,
+      reversed_by text NOT NULL
+    );
+    `)
+	if err != nil {
+		return err
+	}
+	_, err = l.db.Exec(`
+    CREATE TABLE IF NOT EXISTS relay_info (
+      field text NOT NULL,
+      value text NOT NULL
+    );
+    `)
+	if err != nil {
+		return err
+	}
+	return l.migrateLegacyTables()
+}
+
+func (l *sqlLists) load(list string) (map[string]struct{}, error) {
+	if err := checkListName(list); err != nil {
+		return nil, err
+	}
+	rows, err := l.db.Query(`SELECT ` + listColumns[list] + ` FROM ` + list)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]struct{})
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		entries[value] = struct{}{}
+	}
+	return entries, rows.Err()
+}
+
+func (l *sqlLists) add(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	_, err := l.db.Exec(l.db.Rebind(`INSERT INTO `+list+` (`+listColumns[list]+`) VALUES (?)`), value)
+	return err
+}
+
+func (l *sqlLists) remove(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	_, err := l.db.Exec(l.db.Rebind(`DELETE FROM `+list+` WHERE `+listColumns[list]+` = ?`), value)
+	return err
+}
+
+// fileLists keeps each list as a file of the same name in dir, one entry per
+// line. Blank lines and lines starting with # are ignored.
+type fileLists struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (l *fileLists) init() error {
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+	return l.migrateLegacyFiles()
+}
+
+func (l *fileLists) load(list string) (map[string]struct{}, error) {
+	if err := checkListName(list); err != nil {
+		return nil, err
+	}
+	lines, err := l.readFile(list)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]struct{})
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries[line] = struct{}{}
+	}
+	return entries, nil
+}
+
+func (l *fileLists) add(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	return l.append(list, value)
+}
+
+// append adds line at the end of the file named name.
+func (l *fileLists) append(name, line string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(l.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// remove rewrites the file without the lines holding value, keeping comments.
+func (l *fileLists) remove(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	return l.rewrite(list, func(line string) bool { return line == value }, "")
+}
+
+// rewrite replaces the file named name with one without the lines drop
+// reports true for, and with line at the end unless it is empty.
+func (l *fileLists) rewrite(name string, drop func(string) bool, line string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines, err := l.readFile(name)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, old := range lines {
+		if !drop(old) {
+			b.WriteString(old + "\n")
+		}
+	}
+	if line != "" {
+		b.WriteString(line + "\n")
+	}
+	path := filepath.Join(l.dir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readFile returns the trimmed lines of the file of list, or none if there
+// is no such file.
+func (l *fileLists) readFile(list string) ([]string, error) {
+	f, err := os.Open(filepath.Join(l.dir, list))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	return lines, scanner.Err()
+}
+
+// memoryLists keeps the lists and the bans in memory only; they start out
+// empty and are lost on restart together with the events of the memory
+// driver.
+type memoryLists struct {
+	mu      sync.Mutex
+	lists   map[string]map[string]struct{}
+	bans    []ban
+	actions []moderationAction
+	info    map[string]string
+}
+
+func (l *memoryLists) init() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lists = make(map[string]map[string]struct{})
+	for _, list := range listNames {
+		l.lists[list] = make(map[string]struct{})
+	}
+	l.info = make(map[string]string)
+	return nil
+}
+
+func (l *memoryLists) load(list string) (map[string]struct{}, error) {
+	if err := checkListName(list); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.lists[list]), nil
+}
+
+func (l *memoryLists) add(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lists[list][value] = struct{}{}
+	return nil
+}
+
+func (l *memoryLists) remove(list, value string) error {
+	if err := checkListName(list); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.lists[list], value)
+	return nil
+}
+
+func checkListName(list string) error {
+	if _, ok := listColumns[list]; !ok {
+		return fmt.Errorf("unknown list: %s", list)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKeyValueDriversWithoutDB(t *testing.T) {
+	for _, driver := range []string{"lmdb", "badger"} {
+		t.Run(driver, func(t *testing.T) {
+			dir := t.TempDir()
+			r := &Relay{driverName: driver}
+			switch driver {
+			case "lmdb":
+				r.lmdbStorage = &lmdb.LMDBBackend{Path: dir, MapSize: 1 << 24}
+			case "badger":
+				r.badgerStorage = &badger.BadgerBackend{Path: dir}
+			}
+			store := r.Storage(context.Background())
+			if err := store.Init(); err != nil {
+				t.Fatalf("init storage: %v", err)
+			}
+			defer store.Close()
+
+			if err := os.WriteFile(filepath.Join(dir, "blocklist"), []byte("# spammers\nbad\n\n"), 0644); err != nil {
+				t.Fatalf("write blocklist: %v", err)
+			}
+			r.ready()
+
+			if _, blocked := r.currentLists().blocklist["bad"]; !blocked {
+				t.Fatal("expected blocklist to be loaded from file")
+			}
+			if accepted, _ := r.AcceptEvent(context.Background(), &nostr.Event{PubKey: "bad", CreatedAt: nostr.Now()}); accepted {
+				t.Fatal("expected blocklisted pubkey to be rejected")
+			}
+
+			evt := signedEvent(t, bytes32Hex(0x11), 1, "hello")
+			if err := store.SaveEvent(context.Background(), evt); err != nil {
+				t.Fatalf("save event: %v", err)
+			}
+			count, err := r.countEvents(context.Background())
+			if err != nil {
+				t.Fatalf("count events: %v", err)
+			}
+			if count != 1 {
+				t.Fatalf("expected 1 event, got %d", count)
+			}
+		})
+	}
+}
+
+func TestFileListsRemove(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "kindallowlist"), []byte("# notes\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &fileLists{dir: dir}
+	if err := l.add("kindallowlist", "7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.remove("kindallowlist", "1"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := l.load("kindallowlist")
+	if _, ok := entries["7"]; err != nil || len(entries) != 1 || !ok {
+		t.Fatalf("expected only 7 to be left, got %v %v", entries, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "kindallowlist")); string(b) != "# notes\n7\n" {
+		t.Fatalf("expected the comment to be kept, got %q", b)
+	}
+	if err := l.add("nolist", "x"); err == nil {
+		t.Fatal("expected an unknown list to be refused")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"flag"
@@ -11,10 +12,14 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
 	"github.com/fiatjaf/eventstore/mysql"
 	"github.com/fiatjaf/eventstore/opensearch"
 	"github.com/fiatjaf/eventstore/postgresql"
@@ -22,6 +27,9 @@ import (
 	"github.com/fiatjaf/eventstore/turso"
 	"github.com/fiatjaf/relayer/v2"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/cors"
+	"golang.org/x/time/rate"
 )
 
 const name = "nostr-relay"
@@ -36,8 +44,9 @@ var (
 	_ relayer.Informationer = (*Relay)(nil)
 	_ relayer.Logger        = (*Relay)(nil)
 	_ relayer.Auther        = (*Relay)(nil)
+	_ relayer.ShutdownAware = (*Relay)(nil)
 
-	supportedNIPs = []any{1, 2, 4, 9, 11, 12, 15, 16, 20, 22, 26, 28, 33, 40, 42, 45, 50, 59, 65, 70, 77}
+	supportedNIPs = []any{1, 2, 4, 9, 11, 12, 15, 16, 20, 22, 26, 28, 33, 40, 42, 45, 50, 59, 65, 70, 77, 86}
 
 	//go:embed static
 	assets embed.FS
@@ -51,6 +60,34 @@ func envDef(name, def string) string {
 	return def
 }
 
+// policyFlags holds the flags deciding which events are stored and how reports
+// are acted on, which import applies as well as the relay.
+type policyFlags struct {
+	quotas           string
+	reportThreshold  float64
+	reportAction     string
+	trustedReporters string
+}
+
+func (p *policyFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.quotas, "quota", envDef("QUOTA", ""), "per-pubkey quotas, e.g. *:10000:100M;1:5000:0")
+	fs.Float64Var(&p.reportThreshold, "report-threshold", 0, "weight of NIP-56 reports on a pubkey or event that triggers -report-action (0 disables)")
+	fs.StringVar(&p.reportAction, "report-action", actionQuarantine, "what reports past -report-threshold do: quarantine or ban")
+	fs.StringVar(&p.trustedReporters, "trusted-reporters", envDef("TRUSTED_REPORTERS", ""), "weights of reporters, e.g. npub1xxxxx:3,npub1yyyyy,*:0.2")
+}
+
+// apply sets the policy of r from the flags.
+func (p *policyFlags) apply(r *Relay) error {
+	if err := r.setQuotas(p.quotas); err != nil {
+		return fmt.Errorf("quotas: %w", err)
+	}
+	var err error
+	if r.reportPolicy, err = parseReportPolicy(p.reportThreshold, p.reportAction, p.trustedReporters); err != nil {
+		return fmt.Errorf("report policy: %w", err)
+	}
+	return nil
+}
+
 func init() {
 	level := new(slog.LevelVar)
 	level.Set(parseLogLevel(envDef("LOG_LEVEL", "info")))
@@ -73,67 +110,44 @@ func parseLogLevel(value string) slog.Level {
 }
 
 func skipEventFunc(ev *nostr.Event) bool {
-	now := nostr.Now()
-	for _, ex := range ev.Tags.GetAll([]string{"expiration"}) {
-		v, err := strconv.ParseUint(ex.Value(), 10, 64)
-		if err == nil && nostr.Timestamp(v) <= now {
-			return true
-		}
-	}
-	return false
+	expiration, ok := eventExpiration(ev)
+	return ok && expiration <= nostr.Now()
 }
 
-func main() {
-	var r Relay
-	var ver bool
-	var addr string
-	var databaseURL string
-
-	flag.StringVar(&addr, "addr", "0.0.0.0:7447", "listen address")
-	flag.StringVar(&r.driverName, "driver", "sqlite3", "driver name (sqlite3/turso/postgresql/mysql/opensearch)")
-	flag.StringVar(&databaseURL, "database", envDef("DATABASE_URL", "nostr-relay.sqlite"), "connection string")
-	flag.StringVar(&r.serviceURL, "service-url", envDef("SERVICE_URL", ""), "service URL")
-	flag.StringVar(&r.customSearchURL, "custom-search", envDef("CUSTOM_SEARCH_URL", ""), "custom search URL for NIP-50")
-	flag.BoolVar(&ver, "version", false, "show version")
-	flag.Parse()
-
-	if ver {
-		fmt.Println(version)
-		os.Exit(0)
+// skipEvent leaves the events skipEventFunc does, the banned ones and those
+// quarantined after reports out of query results.
+func (r *Relay) skipEvent(ev *nostr.Event) bool {
+	if skipEventFunc(ev) {
+		return true
 	}
-
-	host, sport, err := net.SplitHostPort(addr)
-	if err != nil {
-		log.Fatalf("failed to parse address: %v", err)
-	}
-	port, err := net.LookupPort("tcp", sport)
-	if err != nil {
-		log.Fatalf("failed to parse port number: %v", err)
-	}
-
-	if envDef("ENABLE_PPOROF", "no") == "yes" {
-		go func() {
-			log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-		}()
+	lists := r.currentLists()
+	if lists.bans.banned(banEvent, ev.ID, nostr.Now()) {
+		return true
 	}
+	_, quarantined := lists.moderation.quarantine(ev)
+	return quarantined
+}
 
+// configureStorage sets up the backend selected by r.driverName. queryLimit
+// caps the number of events a single query returns.
+func (r *Relay) configureStorage(databaseURL string, memoryMaxEvents, queryLimit int) error {
 	switch r.driverName {
 	case "sqlite3", "":
 		r.sqlite3Storage = &sqlite3.SQLite3Backend{
 			DatabaseURL:    databaseURL,
-			QueryLimit:     relayLimitationDocument.MaxLimit,
+			QueryLimit:     queryLimit,
 			QueryTagsLimit: relayLimitationDocument.MaxEventTags,
 		}
 	case "turso":
 		r.tursoStorage = &turso.TursoBackend{
 			DatabaseURL:    databaseURL,
-			QueryLimit:     relayLimitationDocument.MaxLimit,
+			QueryLimit:     queryLimit,
 			QueryTagsLimit: relayLimitationDocument.MaxEventTags,
 		}
 	case "postgresql":
 		r.postgresStorage = &postgresql.PostgresBackend{
 			DatabaseURL:       databaseURL,
-			QueryLimit:        relayLimitationDocument.MaxLimit,
+			QueryLimit:        queryLimit,
 			QueryTagsLimit:    relayLimitationDocument.MaxEventTags,
 			QueryAuthorsLimit: 1000,
 			QueryKindsLimit:   100,
@@ -142,7 +156,7 @@ func main() {
 	case "mysql":
 		r.mysqlStorage = &mysql.MySQLBackend{
 			DatabaseURL:    databaseURL,
-			QueryLimit:     relayLimitationDocument.MaxLimit,
+			QueryLimit:     queryLimit,
 			QueryTagsLimit: relayLimitationDocument.MaxEventTags,
 		}
 	case "opensearch":
@@ -151,50 +165,284 @@ func main() {
 			IndexName: "",
 			Insecure:  true,
 		}
+	case "lmdb":
+		r.lmdbStorage = &lmdb.LMDBBackend{
+			Path:     databaseURL,
+			MaxLimit: queryLimit,
+		}
+	case "badger":
+		r.badgerStorage = &badger.BadgerBackend{
+			Path:     databaseURL,
+			MaxLimit: queryLimit,
+		}
+	case "memory":
+		r.memoryStorage = &memoryStore{
+			MaxEvents: memoryMaxEvents,
+			MaxLimit:  queryLimit,
+		}
 	default:
-		fmt.Fprintln(os.Stderr, "unsupported backend driver:", r.driverName)
+		return fmt.Errorf("unsupported backend driver: %s", r.driverName)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		subcommands := map[string]func([]string) error{
+			"migrate":        runMigrate,
+			"export":         runExport,
+			"import":         runImport,
+			"rebuild-search": runRebuildSearch,
+		}
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	var r Relay
+	var ver bool
+	var configPath string
+	var addr string
+	var databaseURL string
+	var memoryMaxEvents int
+	var reapInterval time.Duration
+	var reapBatchSize int
+	var retention string
+	var retentionInterval time.Duration
+	var bus, busURL string
+	var readURL string
+	var readMaxLag time.Duration
+	var writePool, readPool poolConfig
+	var traceEndpoint string
+	var traceSampleRatio float64
+	var statsInterval time.Duration
+	var shutdownTimeout time.Duration
+	var adminPubkeys string
+	var adminAddr string
+	var trustedProxies string
+	var policy policyFlags
+	var notify, notifyFilter string
+	var notifyQueueSize, notifyRetries int
+
+	flag.StringVar(&configPath, "config", envDef("CONFIG_FILE", ""), "configuration file (YAML)")
+	flag.StringVar(&addr, "addr", "0.0.0.0:7447", "listen address")
+	flag.StringVar(&r.driverName, "driver", "sqlite3", "driver name (sqlite3/turso/postgresql/mysql/opensearch/lmdb/badger/memory)")
+	flag.StringVar(&databaseURL, "database", envDef("DATABASE_URL", "nostr-relay.sqlite"), "connection string")
+	flag.StringVar(&r.serviceURL, "service-url", envDef("SERVICE_URL", ""), "service URL")
+	flag.StringVar(&adminPubkeys, "admin-pubkeys", envDef("ADMIN_PUBKEYS", ""), "comma-separated pubkeys allowed to use the NIP-86 management API and the admin routes")
+	flag.StringVar(&r.adminToken, "admin-token", envDef("ADMIN_TOKEN", ""), "bearer token allowed to use the NIP-86 management API and the admin routes")
+	flag.StringVar(&trustedProxies, "trusted-proxies", envDef("TRUSTED_PROXIES", ""), "comma-separated addresses or CIDR ranges of proxies whose X-Forwarded-For and X-Real-Ip are believed")
+	flag.StringVar(&adminAddr, "admin-addr", envDef("ADMIN_ADDR", ""), "listen address of the admin routes (defaults to -addr)")
+	flag.StringVar(&r.customSearchURL, "custom-search", envDef("CUSTOM_SEARCH_URL", ""), "custom search URL for NIP-50")
+	flag.StringVar(&r.searchTokenizer, "search-tokenizer", envDef("SEARCH_TOKENIZER", "bigram"), "PostgreSQL NIP-50 tokenizer (bigram or a text search configuration)")
+	flag.IntVar(&memoryMaxEvents, "memory-max-events", 0, "maximum number of events kept by the memory driver (0 means unlimited)")
+	flag.DurationVar(&reapInterval, "expiration-reap-interval", time.Minute, "interval between deletions of NIP-40 expired events (0 disables)")
+	flag.IntVar(&reapBatchSize, "expiration-reap-batch", 500, "number of expired events deleted at a time")
+	flag.StringVar(&retention, "retention", envDef("RETENTION", ""), "retention rules, e.g. 1:365d;7:30d;1059:7d")
+	flag.DurationVar(&retentionInterval, "retention-interval", time.Hour, "interval between deletions of events past their retention")
+	policy.registerFlags(flag.CommandLine)
+	flag.StringVar(&notify, "notify", envDef("NOTIFY", ""), "notification targets separated by semicolons, e.g. webhook+https://example.com/hook?secret=xxx;nostr:npub1xxxxx")
+	flag.StringVar(&notifyFilter, "notify-filter", envDef("NOTIFY_FILTER", defaultNotifyFilter), "NIP-01 filter, or array of filters, selecting the events notified of")
+	flag.IntVar(&notifyQueueSize, "notify-queue", 100, "number of notifications waiting to be sent at most")
+	flag.IntVar(&notifyRetries, "notify-retries", 5, "number of times a failed notification is retried")
+	flag.StringVar(&bus, "bus", envDef("BUS", ""), "event bus shared with other instances (postgresql)")
+	flag.StringVar(&busURL, "bus-url", envDef("BUS_URL", ""), "connection string of the event bus (defaults to -database)")
+	flag.StringVar(&readURL, "database-read", envDef("DATABASE_READ_URL", ""), "connection string of a read replica for queries and counts")
+	flag.DurationVar(&readMaxLag, "database-read-max-lag", 10*time.Second, "replica lag above which reads go to the primary")
+	writePool.registerFlags("database", "database")
+	readPool.registerFlags("database-read", "read replica")
+	flag.DurationVar(&statsInterval, "stats-interval", 5*time.Minute, "interval between refreshes of the event statistics in /info")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", envDef("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""), "OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "ratio of requests traced")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "time allowed to drain connections and pending writes on SIGTERM/SIGINT")
+	flag.BoolVar(&ver, "version", false, "show version")
+	flag.Parse()
+
+	if ver {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	cfg, err := loadConfig(configPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+	if err := cfg.setFlags(flag.CommandLine); err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+	r.config.Store(cfg)
+	*relayLimitationDocument = cfg.limits.RelayLimitationDocument
+
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("failed to parse address: %v", err)
+	}
+	port, err := net.LookupPort("tcp", sport)
+	if err != nil {
+		log.Fatalf("failed to parse port number: %v", err)
+	}
+
+	if r.retention, err = parseRetention(retention); err != nil {
+		log.Fatalf("failed to parse retention rules: %v", err)
+	}
+	if r.adminPubkeys, err = parseAdminPubkeys(adminPubkeys); err != nil {
+		log.Fatalf("failed to parse admin pubkeys: %v", err)
+	}
+	if r.trustedProxies, err = parseTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+	if err := policy.apply(&r); err != nil {
+		log.Fatalf("failed to parse %v", err)
+	}
+	if r.notifier, err = r.newNotifyQueue(notify, notifyFilter, notifyQueueSize, notifyRetries); err != nil {
+		log.Fatalf("failed to parse notifications: %v", err)
+	}
+	if busURL == "" {
+		busURL = databaseURL
+	}
+	if r.bus, err = r.newEventBus(bus, busURL); err != nil {
+		log.Fatalf("failed to create event bus: %v", err)
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if traceEndpoint != "" {
+		if shutdownTracing, err = setupTracing(context.Background(), traceEndpoint, traceSampleRatio); err != nil {
+			log.Fatalf("failed to set up tracing: %v", err)
+		}
+	}
+
+	if err := r.configureStorage(databaseURL, memoryMaxEvents, relayLimitationDocument.MaxLimit); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
 
 	server, err := relayer.NewServer(
 		&r,
-		relayer.WithPerConnectionLimiter(5.0, 1),
-		relayer.WithSkipEventFunc(skipEventFunc),
+		relayer.WithPerConnectionLimiter(rate.Limit(cfg.limits.MessagesPerSecond), cfg.limits.MessageBurst),
+		relayer.WithSkipEventFunc(r.skipEvent),
 	)
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
 	r.ready()
-
+	r.openSearch()
+	r.started = time.Now()
 	if db := r.DB(); db != nil {
-		r.DB().SetConnMaxLifetime(1 * time.Minute)
-		r.DB().SetMaxOpenConns(80)
-		r.DB().SetMaxIdleConns(10)
-		r.DB().SetConnMaxIdleTime(30 * time.Second)
+		writePool.apply(db)
+	}
+	if readURL != "" {
+		if r.replica, err = r.openReplica(readURL, readMaxLag); err != nil {
+			log.Fatalf("failed to connect to read replica: %v", err)
+		}
+		readPool.apply(r.replica.db)
+	}
+
+	// the background goroutines stop when the relay shuts down
+	background := r.tasks.context()
+	if r.replica != nil {
+		r.tasks.spawn(func() { r.replica.monitor(background, 5*time.Second) })
+	}
+	if reapInterval > 0 {
+		r.tasks.spawn(func() { r.reapExpired(background, reapInterval, reapBatchSize) })
+	}
+	if len(r.retention) > 0 {
+		r.tasks.spawn(func() { r.enforceRetention(background, retentionInterval) })
 	}
 
+	if r.bus != nil {
+		r.tasks.spawn(func() { r.listenToBus(background) })
+	}
+	if r.notifier != nil {
+		r.tasks.spawn(func() { r.notifier.run(background, 2) })
+	}
+	r.tasks.spawn(func() {
+		// the statistics of these backends are taken from the usage
+		if r.tracksUsage() {
+			r.scanUsage(background)
+		}
+		r.refreshStats(background, statsInterval)
+	})
+	r.tasks.spawn(func() { r.watchConfig(background, configPath, 5*time.Second) })
+
 	sub, _ := fs.Sub(assets, "static")
 	server.Router().HandleFunc("/info", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("content-type", "application/json")
-		info := Info{
-			Version:       version,
-			SupportedNIPs: supportedNIPs,
-		}
-		if db := r.DB(); db != nil {
-			if err := db.QueryRow("select count(*) from event").Scan(&info.NumEvents); err != nil {
-				log.Println(err)
-			}
-			info.NumSessions = int64(r.DB().Stats().OpenConnections)
-		}
-		json.NewEncoder(w).Encode(info)
-	})
-	server.Router().HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
-		r.reload()
+		json.NewEncoder(w).Encode(r.info(server))
 	})
+	server.Router().HandleFunc("/healthz", r.handleHealthz)
+	server.Router().HandleFunc("/readyz", r.handleReadyz)
+	registerServerMetrics(server, &r.subscriptions)
 	server.Router().Handle("/", http.FileServer(http.FS(sub)))
 
+	// the operational routes are served to admins only, on their own
+	// listener if there is one
+	adminHandler := r.requireAdmin(r.adminRoutes(envDef("ENABLE_PPOROF", "no") == "yes", promhttp.Handler()))
+	var adminServer *http.Server
+	if adminAddr == "" {
+		server.Router().Handle("/reload", adminHandler)
+		server.Router().Handle("/metrics", adminHandler)
+		server.Router().Handle("/debug/pprof/", adminHandler)
+	} else {
+		adminServer = &http.Server{
+			Handler:     adminHandler,
+			Addr:        adminAddr,
+			ReadTimeout: 2 * time.Second,
+			IdleTimeout: 30 * time.Second,
+		}
+	}
+
 	server.Log = &r
-	if err := server.Start(host, port); err != nil {
+
+	// served here rather than by server.Start so that the listener can be
+	// closed before the subscriptions are, and NIP-86 requests answered
+	corsHandler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodHead, http.MethodGet, http.MethodPost},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Requested-With", "Authorization"},
+	})
+	httpServer := &http.Server{
+		Handler:      corsHandler.Handler(r.withIPBans(r.withManagement(r.subscriptions.watch(server)))),
+		Addr:         net.JoinHostPort(host, strconv.Itoa(port)),
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		IdleTimeout:  30 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- httpServer.ListenAndServe()
+	}()
+	if adminServer != nil {
+		go func() {
+			serverErr <- adminServer.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-serverErr:
 		log.Fatalf("server terminated: %v", err)
+	case <-ctx.Done():
+	}
+	// a second signal stops the relay at once
+	stop()
+
+	slog.Info("shutting down", "timeout", shutdownTimeout.String())
+	time.AfterFunc(shutdownTimeout+shutdownExitDelay, func() {
+		slog.Error("shutdown timed out")
+		os.Exit(1)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			slog.Warn("failed to stop the admin listener", "error", err)
+		}
+	}
+	r.shutdown(ctx, httpServer, server)
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("failed to flush traces", "error", err)
 	}
+	slog.Info("shut down")
 }
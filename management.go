@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// managementContentType is what NIP-86 requests are posted as, to the same
+// URL as the websocket.
+const managementContentType = "application/nostr+json+rpc"
+
+// maxManagementRequest bounds the body of a NIP-86 request.
+const maxManagementRequest = 64 * 1024
+
+// httpAuthWindow is how far the created_at of a NIP-98 event may be from now.
+const httpAuthWindow = time.Minute
+
+// managementMethods are the NIP-86 methods the relay answers.
+var managementMethods = []string{
+	"supportedmethods",
+	"banpubkey", "listbannedpubkeys", "allowpubkey", "listallowedpubkeys",
+	"listeventsneedingmoderation", "allowevent", "banevent", "listbannedevents",
+	"changerelayname", "changerelaydescription", "changerelayicon",
+	"allowkind", "disallowkind", "listallowedkinds",
+	"blockip", "unblockip", "listblockedips",
+	"ban", "unban", "listbans",
+	"listmoderationactions", "reversemoderationaction",
+}
+
+// parseAdminPubkeys parses a comma-separated list of pubkeys, in hex or npub
+// form, allowed to use the management API.
+func parseAdminPubkeys(value string) (map[string]struct{}, error) {
+	admins := map[string]struct{}{}
+	for _, pubkey := range strings.Split(value, ",") {
+		pubkey = strings.TrimSpace(pubkey)
+		if pubkey == "" {
+			continue
+		}
+		if strings.HasPrefix(pubkey, "npub1") {
+			_, decoded, err := nip19.Decode(pubkey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pubkey %s: %w", pubkey, err)
+			}
+			pubkey = decoded.(string)
+		}
+		if !nostr.IsValidPublicKey(pubkey) {
+			return nil, fmt.Errorf("invalid pubkey %s", pubkey)
+		}
+		admins[pubkey] = struct{}{}
+	}
+	return admins, nil
+}
+
+// withManagement answers NIP-86 requests and passes everything else to next.
+func (r *Relay) withManagement(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if req.Method != http.MethodPost || mediaType != managementContentType {
+			next.ServeHTTP(w, req)
+			return
+		}
+		r.handleManagement(w, req)
+	})
+}
+
+func (r *Relay) handleManagement(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxManagementRequest))
+	if err != nil {
+		writeManagementResponse(w, http.StatusBadRequest, nip86.Response{Error: "failed to read request"})
+		return
+	}
+	admin, err := r.authorizeAdmin(req, body)
+	if err != nil {
+		slog.Warn("management request refused", "remote", r.clientIP(req), "admin", admin, "error", err)
+		writeManagementResponse(w, http.StatusUnauthorized, nip86.Response{Error: "unauthorized: " + err.Error()})
+		return
+	}
+
+	var request nip86.Request
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeManagementResponse(w, http.StatusBadRequest, nip86.Response{Error: "invalid request"})
+		return
+	}
+	result, err := r.manage(req.Context(), admin, request)
+	if err != nil {
+		slog.Warn("management request failed", "method", request.Method, "params", request.Params, "remote", r.clientIP(req), "admin", admin, "error", err)
+		writeManagementResponse(w, http.StatusOK, nip86.Response{Error: err.Error()})
+		return
+	}
+	slog.Info("management request", "method", request.Method, "params", request.Params, "remote", r.clientIP(req), "admin", admin)
+	writeManagementResponse(w, http.StatusOK, nip86.Response{Result: result})
+}
+
+func writeManagementResponse(w http.ResponseWriter, status int, resp nip86.Response) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// manage runs a NIP-86 request from admin and returns its result.
+func (r *Relay) manage(ctx context.Context, admin string, request nip86.Request) (any, error) {
+	// checked first, since decoding some of the methods the relay does not
+	// support can panic on malformed params
+	if !slices.Contains(managementMethods, request.Method) {
+		return nil, fmt.Errorf("unsupported method: %s", request.Method)
+	}
+	switch request.Method {
+	case "ban", "unban", "listbans":
+		return r.manageBans(ctx, admin, request)
+	case "listmoderationactions":
+		return r.currentLists().moderation.list(), nil
+	case "reversemoderationaction":
+		id, _ := param(request, 0).(string)
+		if id == "" {
+			return nil, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+		return true, r.reverseModerationAction(id, admin)
+	}
+	params, err := nip86.DecodeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	now := nostr.Now()
+	newBan := func(typ, value, reason string) ban {
+		return ban{Type: typ, Value: value, Reason: reason, Creator: admin, CreatedAt: now}
+	}
+	lists := r.currentLists()
+	switch p := params.(type) {
+	case nip86.SupportedMethods:
+		return managementMethods, nil
+	case nip86.BanPubKey:
+		return true, r.updateLists(func(lists *relayLists) error {
+			if err := r.putBanIn(lists, newBan(banPubkey, p.PubKey, p.Reason)); err != nil {
+				return err
+			}
+			return r.changeListIn(lists, "allowlist", p.PubKey, false)
+		})
+	case nip86.AllowPubKey:
+		return true, r.updateLists(func(lists *relayLists) error {
+			if err := r.changeListIn(lists, "allowlist", p.PubKey, true); err != nil {
+				return err
+			}
+			if err := r.removeBanIn(lists, banPubkey, p.PubKey); err != nil {
+				return err
+			}
+			if err := r.liftQuarantineIn(lists, banPubkey, p.PubKey, admin); err != nil {
+				return err
+			}
+			return r.changeListIn(lists, "blocklist", p.PubKey, false)
+		})
+	case nip86.ListBannedPubKeys:
+		banned := pubkeyReasons(lists.blocklist)
+		for _, b := range lists.bans.list(banPubkey, now) {
+			if _, ok := lists.blocklist[b.Value]; !ok {
+				banned = append(banned, nip86.PubKeyReason{PubKey: b.Value, Reason: b.Reason})
+			}
+		}
+		slices.SortFunc(banned, func(a, b nip86.PubKeyReason) int { return strings.Compare(a.PubKey, b.PubKey) })
+		return banned, nil
+	case nip86.ListAllowedPubKeys:
+		return pubkeyReasons(lists.allowlist), nil
+	case nip86.ListEventsNeedingModeration:
+		pending := []nip86.IDReason{}
+		for _, a := range lists.moderation.quarantinedEvents() {
+			if !lists.bans.banned(banEvent, a.Target, now) {
+				pending = append(pending, nip86.IDReason{ID: a.Target, Reason: a.Reason})
+			}
+		}
+		return pending, nil
+	case nip86.BanEvent:
+		if err := r.putBan(newBan(banEvent, p.ID, p.Reason)); err != nil {
+			return nil, err
+		}
+		return true, r.deleteEventByID(ctx, p.ID)
+	case nip86.AllowEvent:
+		return true, r.updateLists(func(lists *relayLists) error {
+			if err := r.removeBanIn(lists, banEvent, p.ID); err != nil {
+				return err
+			}
+			return r.liftQuarantineIn(lists, banEvent, p.ID, admin)
+		})
+	case nip86.ListBannedEvents:
+		banned := []nip86.IDReason{}
+		for _, b := range lists.bans.list(banEvent, now) {
+			banned = append(banned, nip86.IDReason{ID: b.Value, Reason: b.Reason})
+		}
+		return banned, nil
+	case nip86.ChangeRelayName:
+		return true, r.changeInfo("name", p.Name)
+	case nip86.ChangeRelayDescription:
+		return true, r.changeInfo("description", p.Description)
+	case nip86.ChangeRelayIcon:
+		return true, r.changeInfo("icon", p.IconURL)
+	case nip86.AllowKind:
+		return true, r.changeList("kindallowlist", strconv.Itoa(p.Kind), true)
+	case nip86.DisallowKind:
+		kind := strconv.Itoa(p.Kind)
+		if len(lists.kindAllowlist) == 0 {
+			return nil, errors.New("every kind is allowed until some are allowed with allowkind")
+		}
+		if _, ok := lists.kindAllowlist[kind]; !ok {
+			return true, nil
+		}
+		if len(lists.kindAllowlist) == 1 {
+			// an empty allowlist would let every kind in
+			return nil, errors.New("cannot disallow the last allowed kind")
+		}
+		return true, r.changeList("kindallowlist", kind, false)
+	case nip86.ListAllowedKinds:
+		kinds := []int{}
+		for kind := range lists.kindAllowlist {
+			if n, err := strconv.Atoi(kind); err == nil {
+				kinds = append(kinds, n)
+			}
+		}
+		slices.Sort(kinds)
+		return kinds, nil
+	case nip86.BlockIP:
+		return true, r.putBan(newBan(banIP, p.IP.String(), p.Reason))
+	case nip86.UnblockIP:
+		return true, r.removeBan(banIP, p.IP.String())
+	case nip86.ListBlockedIPs:
+		blocked := []nip86.IPReason{}
+		for _, b := range lists.bans.list(banIP, now) {
+			blocked = append(blocked, nip86.IPReason{IP: b.Value, Reason: b.Reason})
+		}
+		return blocked, nil
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", request.Method)
+	}
+}
+
+// manageBans runs the methods the relay adds to NIP-86 for bans of any type:
+//
+//   - ban, with the type, the value, and optionally a reason and the unix time
+//     the ban expires at, puts a ban in place of any other on the same value;
+//   - unban, with the type and the value, lifts it;
+//   - listbans, optionally with a type, lists the bans in effect.
+func (r *Relay) manageBans(ctx context.Context, admin string, request nip86.Request) (any, error) {
+	var params [4]string
+	for i := range params {
+		switch v := param(request, i).(type) {
+		case nil:
+		case string:
+			params[i] = v
+		case float64:
+			params[i] = strconv.FormatInt(int64(v), 10)
+		default:
+			return nil, fmt.Errorf("invalid param %d for '%s'", i+1, request.Method)
+		}
+	}
+	typ, value, reason := params[0], params[1], params[2]
+	if request.Method != "listbans" && (typ == "" || value == "") {
+		return nil, fmt.Errorf("invalid number of params for '%s'", request.Method)
+	}
+	if typ != "" && !slices.Contains(banTypes, typ) {
+		return nil, fmt.Errorf("unknown ban type: %q", typ)
+	}
+
+	switch request.Method {
+	case "ban":
+		b := ban{Type: typ, Value: value, Reason: reason, Creator: admin, CreatedAt: nostr.Now()}
+		if params[3] != "" {
+			expiresAt, err := strconv.ParseInt(params[3], 10, 64)
+			if err != nil || expiresAt <= int64(b.CreatedAt) {
+				return nil, fmt.Errorf("invalid expiry for '%s': %s", request.Method, params[3])
+			}
+			b.ExpiresAt = nostr.Timestamp(expiresAt)
+		}
+		if err := r.putBan(b); err != nil {
+			return nil, err
+		}
+		if typ == banEvent {
+			return true, r.deleteEventByID(ctx, strings.ToLower(value))
+		}
+		return true, nil
+	case "unban":
+		return true, r.removeBan(typ, value)
+	default:
+		return r.currentLists().bans.list(typ, nostr.Now()), nil
+	}
+}
+
+// param returns the i-th param of request, or nil if there are fewer.
+func param(request nip86.Request, i int) any {
+	if i >= len(request.Params) {
+		return nil
+	}
+	return request.Params[i]
+}
+
+func pubkeyReasons(list map[string]struct{}) []nip86.PubKeyReason {
+	pubkeys := []nip86.PubKeyReason{}
+	for _, pubkey := range slices.Sorted(maps.Keys(list)) {
+		pubkeys = append(pubkeys, nip86.PubKeyReason{PubKey: pubkey})
+	}
+	return pubkeys
+}
+
+// deleteEventByID deletes a banned event that has been stored already. It is
+// looked up on the primary, which a lagging replica may not have caught up
+// with.
+func (r *Relay) deleteEventByID(ctx context.Context, id string) error {
+	store := r.Storage(ctx).(*relayStore)
+	events, err := queryAll(ctx, store.Store, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return err
+	}
+	for _, evt := range events {
+		if err := store.DeleteEvent(ctx, evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeInfo stores value for the NIP-11 field in the listStore, where it
+// outlasts restarts and reaches the other instances, and serves it in place of
+// the flags and the environment. It is refused when a configuration file is in
+// use, since the file is where the relay information is set then.
+func (r *Relay) changeInfo(field, value string) error {
+	if path := r.currentConfig().path; path != "" {
+		return fmt.Errorf("the relay information is set in %s; change it there", path)
+	}
+	return r.updateLists(func(lists *relayLists) error {
+		if err := r.listStore.putInfo(field, value); err != nil {
+			return err
+		}
+		lists.info = maps.Clone(lists.info)
+		if lists.info == nil {
+			lists.info = make(map[string]string)
+		}
+		lists.info[field] = value
+		return nil
+	})
+}
+
+// applyInfo sets the NIP-11 fields changed through the management API on info.
+func applyInfo(info *nip11.RelayInformationDocument, fields map[string]string) {
+	for field, value := range fields {
+		switch field {
+		case "name":
+			info.Name = value
+		case "description":
+			info.Description = value
+		case "icon":
+			info.Icon = value
+		}
+	}
+}
+
+// infoField is a NIP-11 field changed through the management API, as kept by
+// a listStore.
+type infoField struct {
+	Field string `json:"field" db:"field"`
+	Value string `json:"value" db:"value"`
+}
+
+// loadInfo returns the fields in the relay_info table.
+func (l *sqlLists) loadInfo() (map[string]string, error) {
+	var fields []infoField
+	if err := l.db.Select(&fields, `SELECT field, value FROM relay_info`); err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, f := range fields {
+		info[f.Field] = f.Value
+	}
+	return info, nil
+}
+
+func (l *sqlLists) putInfo(field, value string) error {
+	tx, err := l.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM relay_info WHERE field = ?`), field); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(tx.Rebind(`INSERT INTO relay_info (field, value) VALUES (?, ?)`), field, value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadInfo returns the fields in the file named info, one JSON object per
+// line.
+func (l *fileLists) loadInfo() (map[string]string, error) {
+	lines, err := l.readFile("info")
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var f infoField
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			return nil, fmt.Errorf("invalid relay information %s: %w", line, err)
+		}
+		info[f.Field] = f.Value
+	}
+	return info, nil
+}
+
+// putInfo rewrites the info file with value in place of the old value of
+// field.
+func (l *fileLists) putInfo(field, value string) error {
+	line, err := json.Marshal(infoField{Field: field, Value: value})
+	if err != nil {
+		return err
+	}
+	return l.rewrite("info", func(old string) bool {
+		var f infoField
+		return json.Unmarshal([]byte(old), &f) == nil && f.Field == field
+	}, string(line))
+}
+
+func (l *memoryLists) loadInfo() (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.info), nil
+}
+
+func (l *memoryLists) putInfo(field, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.info[field] = value
+	return nil
+}
+
+// validateHTTPAuth checks the NIP-98 Authorization header of req, whose body
+// has been read into body, and returns the pubkey that signed it. A request
+// with a body must carry its hash in a payload tag.
+func validateHTTPAuth(req *http.Request, body []byte, now time.Time) (string, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", errors.New("missing NIP-98 authorization")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", errors.New("malformed authorization")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return "", errors.New("malformed authorization event")
+	}
+	if evt.Kind != nostr.KindHTTPAuth {
+		return "", fmt.Errorf("authorization event has kind %d", evt.Kind)
+	}
+	if d := now.Sub(evt.CreatedAt.Time()); d > httpAuthWindow || d < -httpAuthWindow {
+		return "", errors.New("authorization event is too old or too new")
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return "", errors.New("invalid authorization signature")
+	}
+	if method := evt.Tags.Find("method"); method == nil || !strings.EqualFold(method[1], req.Method) {
+		return "", errors.New("authorization is for another method")
+	}
+	if u := evt.Tags.Find("u"); u == nil || !sameURL(u[1], req) {
+		return "", errors.New("authorization is for another URL")
+	}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		if payload := evt.Tags.Find("payload"); payload == nil || !strings.EqualFold(payload[1], hex.EncodeToString(sum[:])) {
+			return evt.PubKey, errors.New("authorization is for another payload")
+		}
+	}
+	return evt.PubKey, nil
+}
+
+// sameURL reports whether u names the host and path req was sent to. The
+// scheme is not compared, so that the websocket URL of the relay will do.
+func sameURL(u string, req *http.Request) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, req.Host) &&
+		strings.TrimSuffix(parsed.Path, "/") == strings.TrimSuffix(req.URL.Path, "/")
+}
+
+// withIPBans refuses the clients whose address is banned, websocket or not.
+func (r *Relay) withIPBans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if b, banned := r.currentLists().bans.matchIP(r.clientIP(req), nostr.Now()); banned {
+			http.Error(w, b.message(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// parseTrustedProxies parses the addresses and CIDR ranges, separated by
+// commas, of the proxies whose forwarding headers are believed.
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		prefix, err := parseIPPrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix)
+	}
+	return proxies, nil
+}
+
+// clientIP returns the address req came from. Clients can send any
+// forwarding headers they like, so X-Forwarded-For is only read when the
+// connection comes from a trusted proxy: the client is the rightmost address
+// in it that is not a trusted proxy as well. X-Real-Ip is read the same way
+// when there is no X-Forwarded-For.
+func (r *Relay) clientIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if r.trustedProxy(ip) {
+		if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip = strings.TrimSpace(hops[i])
+				if !r.trustedProxy(ip) {
+					break
+				}
+			}
+		} else if realIP := req.Header.Get("X-Real-Ip"); realIP != "" {
+			ip = strings.TrimSpace(realIP)
+		}
+	}
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return addr.Unmap().String()
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is one of the trusted proxies.
+func (r *Relay) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range r.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// managementRequest posts a NIP-86 request signed by secret, or unsigned if
+// secret is empty, and returns the status and the response.
+func managementRequest(t *testing.T, handler http.Handler, secret, method string, params ...any) (int, nip86.Response) {
+	t.Helper()
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	req := httptest.NewRequest(http.MethodPost, "http://relay.example.com/", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", managementContentType)
+	if secret != "" {
+		sum := sha256.Sum256(body)
+		auth := nostr.Event{
+			Kind:      nostr.KindHTTPAuth,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				{"u", "https://relay.example.com"},
+				{"method", "POST"},
+				{"payload", hex.EncodeToString(sum[:])},
+			},
+		}
+		auth.Sign(secret)
+		b, _ := json.Marshal(auth)
+		req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(b))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var resp nip86.Response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return w.Code, resp
+}
+
+func TestManagement(t *testing.T) {
+	admin := bytes32Hex(0x01)
+	adminPubkey, _ := nostr.GetPublicKey(admin)
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	r.Storage(context.Background()).Init()
+	r.ready()
+	var err error
+	if r.adminPubkeys, err = parseAdminPubkeys(" " + adminPubkey + ","); err != nil {
+		t.Fatal(err)
+	}
+	handler := r.withIPBans(r.withManagement(http.NotFoundHandler()))
+
+	if code, _ := managementRequest(t, handler, "", "supportedmethods"); code != http.StatusUnauthorized {
+		t.Fatalf("expected an unsigned request to be refused, got %d", code)
+	}
+	if code, _ := managementRequest(t, handler, bytes32Hex(0x02), "supportedmethods"); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request from another pubkey to be refused, got %d", code)
+	}
+	call := func(method string, params ...any) any {
+		t.Helper()
+		code, resp := managementRequest(t, handler, admin, method, params...)
+		if code != http.StatusOK || resp.Error != "" {
+			t.Fatalf("%s: %d %s", method, code, resp.Error)
+		}
+		return resp.Result
+	}
+	if methods := call("supportedmethods"); len(methods.([]any)) != len(managementMethods) {
+		t.Fatalf("unexpected methods %v", methods)
+	}
+
+	spammer := bytes32Hex(0x03)
+	spam := signedEvent(t, spammer, 1, "spam")
+	call("banpubkey", spam.PubKey, "spam")
+	if accepted, msg := r.AcceptEvent(context.Background(), spam); accepted || msg != "blocked: spam" {
+		t.Fatalf("expected banned pubkey to be rejected with the reason, got %v %q", accepted, msg)
+	}
+	if banned := call("listbannedpubkeys").([]any); len(banned) != 1 || banned[0].(map[string]any)["pubkey"] != spam.PubKey || banned[0].(map[string]any)["reason"] != "spam" {
+		t.Fatalf("unexpected banned pubkeys %v", banned)
+	}
+	if stored, _ := r.listStore.loadBans(); len(stored) != 1 || stored[0].Creator != adminPubkey {
+		t.Fatalf("expected the ban to be stored with its creator, got %v", stored)
+	}
+	call("allowpubkey", spam.PubKey)
+	if accepted, _ := r.AcceptEvent(context.Background(), spam); !accepted {
+		t.Fatal("expected allowed pubkey to be accepted")
+	}
+	call("banpubkey", spam.PubKey)
+	if allowed := call("listallowedpubkeys").([]any); len(allowed) != 0 {
+		t.Fatalf("expected a ban to take the pubkey off the allowlist, got %v", allowed)
+	}
+
+	evt := signedEvent(t, bytes32Hex(0x04), 1, "hello")
+	r.Storage(context.Background()).SaveEvent(context.Background(), evt)
+	call("banevent", evt.ID, "illegal")
+	if events, _ := queryAll(context.Background(), r.Storage(context.Background()), nostr.Filter{IDs: []string{evt.ID}}); len(events) != 0 {
+		t.Fatal("expected the banned event to be deleted")
+	}
+	if accepted, msg := r.AcceptEvent(context.Background(), evt); accepted || msg != "blocked: illegal" {
+		t.Fatalf("expected banned event to be rejected, got %v %q", accepted, msg)
+	}
+	if banned := call("listbannedevents").([]any); len(banned) != 1 || banned[0].(map[string]any)["reason"] != "illegal" {
+		t.Fatalf("unexpected banned events %v", banned)
+	}
+	call("allowevent", evt.ID)
+	if accepted, _ := r.AcceptEvent(context.Background(), evt); !accepted {
+		t.Fatal("expected allowed event to be accepted")
+	}
+
+	call("ban", "keyword", "Casino", "gambling spam", float64(nostr.Now()+3600))
+	if accepted, msg := r.AcceptEvent(context.Background(), signedEvent(t, bytes32Hex(0x04), 1, "best CASINO in town")); accepted || msg != "blocked: gambling spam" {
+		t.Fatalf("expected the keyword to be banned, got %v %q", accepted, msg)
+	}
+	if bans := call("listbans", "keyword").([]any); len(bans) != 1 || bans[0].(map[string]any)["value"] != "casino" {
+		t.Fatalf("unexpected bans %v", bans)
+	}
+	call("unban", "keyword", "casino")
+	if _, resp := managementRequest(t, handler, admin, "ban", "regex", "(unclosed"); resp.Error == "" {
+		t.Fatal("expected an invalid regex to be refused")
+	}
+	if _, resp := managementRequest(t, handler, admin, "ban", "kind", "4", "", float64(nostr.Now()-1)); resp.Error == "" {
+		t.Fatal("expected a past expiry to be refused")
+	}
+
+	call("allowkind", 1)
+	call("allowkind", 7)
+	call("disallowkind", 7)
+	if kinds := call("listallowedkinds").([]any); len(kinds) != 1 || kinds[0] != float64(1) {
+		t.Fatalf("unexpected allowed kinds %v", kinds)
+	}
+	if accepted, _ := r.AcceptEvent(context.Background(), signedEvent(t, bytes32Hex(0x04), 7, "+")); accepted {
+		t.Fatal("expected a kind not allowed to be rejected")
+	}
+	if _, resp := managementRequest(t, handler, admin, "disallowkind", 1); resp.Error == "" {
+		t.Fatal("expected the last allowed kind to stay")
+	}
+
+	call("changerelayname", "renamed")
+	r.reload()
+	if name := r.GetNIP11InformationDocument().Name; name != "renamed" {
+		t.Fatalf("expected the relay to stay renamed, got %q", name)
+	}
+	cfg := r.currentConfig()
+	withFile := *cfg
+	withFile.path = "relay.yaml"
+	r.config.Store(&withFile)
+	if _, resp := managementRequest(t, handler, admin, "changerelayname", "lost"); resp.Error == "" {
+		t.Fatal("expected a change the configuration file would undo to be refused")
+	}
+	r.config.Store(cfg)
+
+	call("blockip", "198.51.100.7", "abuse")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "abuse") {
+		t.Fatalf("expected blocked IP to be refused with the reason, got %d %q", w.Code, w.Body)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected a forwarding header from an untrusted client to be ignored, got %d", w.Code)
+	}
+	req.Header.Del("X-Forwarded-For")
+	call("unblockip", "198.51.100.7")
+	call("ban", "ip", "198.51.100.0/24")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected an IP in a banned range to be refused, got %d", w.Code)
+	}
+	call("unban", "ip", "198.51.100.0/24")
+	if ips := call("listblockedips").([]any); len(ips) != 0 {
+		t.Fatalf("unexpected blocked IPs %v", ips)
+	}
+}
+
+func TestValidateHTTPAuthChecksPayload(t *testing.T) {
+	auth := nostr.Event{
+		Kind:      nostr.KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", "wss://relay.example.com/"}, {"method", "POST"}, {"payload", strings.Repeat("0", 64)}},
+	}
+	auth.Sign(bytes32Hex(0x01))
+	b, _ := json.Marshal(auth)
+	req := httptest.NewRequest(http.MethodPost, "http://relay.example.com/", nil)
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(b))
+	if _, err := validateHTTPAuth(req, []byte(`{"method":"banpubkey"}`), auth.CreatedAt.Time()); err == nil {
+		t.Fatal("expected a payload mismatch to be refused")
+	}
+	if pubkey, err := validateHTTPAuth(req, nil, auth.CreatedAt.Time()); err != nil || pubkey != auth.PubKey {
+		t.Fatalf("expected a request without body to pass, got %q %v", pubkey, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var r Relay
+	var err error
+	if r.trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		remote, forwarded, realIP, want string
+	}{
+		{"198.51.100.7:1234", "203.0.113.9", "", "198.51.100.7"},
+		{"10.0.0.2:1234", "", "", "10.0.0.2"},
+		{"10.0.0.2:1234", "203.0.113.9", "", "203.0.113.9"},
+		{"10.0.0.2:1234", "1.2.3.4, 203.0.113.9, 192.0.2.1", "", "203.0.113.9"},
+		{"10.0.0.2:1234", "10.0.0.3", "", "10.0.0.3"},
+		{"10.0.0.2:1234", "", "203.0.113.9", "203.0.113.9"},
+		{"[::ffff:10.0.0.2]:1234", "203.0.113.9", "", "203.0.113.9"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-Ip", tt.realIP)
+		}
+		if got := r.clientIP(req); got != tt.want {
+			t.Errorf("%s %q %q: expected %s, got %s", tt.remote, tt.forwarded, tt.realIP, tt.want, got)
+		}
+	}
+	if _, err := parseTrustedProxies("proxy.local"); err == nil {
+		t.Fatal("expected a host name to be refused")
+	}
+}
+
+func TestRelayInfoStored(t *testing.T) {
+	check := func(t *testing.T, l listStore) {
+		t.Helper()
+		if err := l.init(); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"first", "second"} {
+			if err := l.putInfo("name", name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.putInfo("icon", "https://example.com/icon.png"); err != nil {
+			t.Fatal(err)
+		}
+		info, err := l.loadInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info) != 2 || info["name"] != "second" || info["icon"] != "https://example.com/icon.png" {
+			t.Fatalf("expected the last name and the icon, got %v", info)
+		}
+	}
+
+	t.Run("file", func(t *testing.T) {
+		check(t, &fileLists{dir: t.TempDir()})
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "info.sqlite")}
+		if err := backend.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		check(t, &sqlLists{db: backend.DB})
+	})
+}
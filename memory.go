@@ -0,0 +1,203 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	_ eventstore.Store   = (*memoryStore)(nil)
+	_ eventstore.Counter = (*memoryStore)(nil)
+)
+
+// memoryStore keeps events in memory only, for test relays, CI and ephemeral
+// chat relays. When MaxEvents is set, saving beyond it evicts the least
+// recently used event, where both saving and returning an event from a query
+// count as a use. Queries scan every event, which is fine for the sizes this
+// store is meant for.
+type memoryStore struct {
+	MaxEvents int
+	MaxLimit  int
+	// evicted, if set, is called with every event evicted to stay within
+	// MaxEvents. The store is locked meanwhile, so it must not be used.
+	evicted func(evt *nostr.Event)
+
+	mu     sync.Mutex
+	lru    *list.List // of *nostr.Event, most recently used first
+	events map[string]*list.Element
+}
+
+func (m *memoryStore) Init() error {
+	m.lru = list.New()
+	m.events = make(map[string]*list.Element)
+	if m.MaxLimit == 0 {
+		m.MaxLimit = 500
+	}
+	return nil
+}
+
+func (m *memoryStore) Close() {}
+
+func (m *memoryStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+	if filter.LimitZero {
+		close(ch)
+		return ch, nil
+	}
+	limit := filter.Limit
+	if limit < 1 || limit > m.MaxLimit {
+		limit = m.MaxLimit
+	}
+
+	m.mu.Lock()
+	var matched []*list.Element
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		if m.matches(elem.Value.(*nostr.Event), filter) {
+			matched = append(matched, elem)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *list.Element) int {
+		return compareNewestFirst(a.Value.(*nostr.Event), b.Value.(*nostr.Event))
+	})
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	results := make([]*nostr.Event, len(matched))
+	for i, elem := range matched {
+		m.lru.MoveToFront(elem)
+		results[i] = elem.Value.(*nostr.Event)
+	}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+		for _, evt := range results {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *memoryStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		if m.matches(elem.Value.(*nostr.Event), filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) matches(evt *nostr.Event, filter nostr.Filter) bool {
+	if !filter.Matches(evt) {
+		return false
+	}
+	return filter.Search == "" || strings.Contains(strings.ToLower(evt.Content), strings.ToLower(filter.Search))
+}
+
+// eventsAt returns up to limit events created at ts with ids after afterID, in
+// id order, without counting as a use.
+func (m *memoryStore) eventsAt(ts nostr.Timestamp, afterID string, limit int) []*nostr.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []*nostr.Event
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		if evt := elem.Value.(*nostr.Event); evt.CreatedAt == ts && evt.ID > afterID {
+			events = append(events, evt)
+		}
+	}
+	slices.SortFunc(events, func(a, b *nostr.Event) int { return strings.Compare(a.ID, b.ID) })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+func (m *memoryStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.save(evt)
+}
+
+func (m *memoryStore) save(evt *nostr.Event) error {
+	if _, ok := m.events[evt.ID]; ok {
+		return eventstore.ErrDupEvent
+	}
+	m.events[evt.ID] = m.lru.PushFront(evt)
+	for m.MaxEvents > 0 && m.lru.Len() > m.MaxEvents {
+		oldest := m.lru.Remove(m.lru.Back()).(*nostr.Event)
+		delete(m.events, oldest.ID)
+		if m.evicted != nil {
+			m.evicted(oldest)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.events[evt.ID]; ok {
+		m.lru.Remove(elem)
+		delete(m.events, evt.ID)
+	}
+	return nil
+}
+
+func (m *memoryStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filter := nostr.Filter{Kinds: []int{evt.Kind}, Authors: []string{evt.PubKey}}
+	if nostr.IsAddressableKind(evt.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{evt.Tags.GetD()}}
+	}
+
+	shouldStore := true
+	for elem := m.lru.Front(); elem != nil; {
+		next := elem.Next()
+		previous := elem.Value.(*nostr.Event)
+		if filter.Matches(previous) {
+			if compareNewestFirst(evt, previous) < 0 {
+				m.lru.Remove(elem)
+				delete(m.events, previous.ID)
+			} else {
+				shouldStore = false
+			}
+		}
+		elem = next
+	}
+
+	if shouldStore {
+		if err := m.save(evt); err != nil && err != eventstore.ErrDupEvent {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareNewestFirst orders events by created_at descending, breaking ties by
+// id the way replaceable events are resolved (the lowest id wins).
+func compareNewestFirst(a, b *nostr.Event) int {
+	if a.CreatedAt != b.CreatedAt {
+		if a.CreatedAt > b.CreatedAt {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.ID, b.ID)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	m := &memoryStore{MaxEvents: 2}
+	m.Init()
+
+	a := &nostr.Event{ID: "a", CreatedAt: 1, Kind: 1}
+	b := &nostr.Event{ID: "b", CreatedAt: 2, Kind: 1}
+	c := &nostr.Event{ID: "c", CreatedAt: 3, Kind: 1}
+	m.SaveEvent(ctx, a)
+	m.SaveEvent(ctx, b)
+
+	// reading a makes b the least recently used
+	ch, _ := m.QueryEvents(ctx, nostr.Filter{IDs: []string{"a"}})
+	for range ch {
+	}
+	m.SaveEvent(ctx, c)
+
+	ch, _ = m.QueryEvents(ctx, nostr.Filter{})
+	var got []string
+	for evt := range ch {
+		got = append(got, evt.ID)
+	}
+	if len(got) != 2 || got[0] != "c" || got[1] != "a" {
+		t.Fatalf("expected c and a newest first, got %v", got)
+	}
+}
+
+func TestMemoryStoreReplaceEvent(t *testing.T) {
+	ctx := context.Background()
+	m := &memoryStore{}
+	m.Init()
+
+	old := &nostr.Event{ID: "old", PubKey: "p", CreatedAt: 1, Kind: 0}
+	newer := &nostr.Event{ID: "new", PubKey: "p", CreatedAt: 2, Kind: 0}
+	m.ReplaceEvent(ctx, old)
+	m.ReplaceEvent(ctx, newer)
+	m.ReplaceEvent(ctx, old)
+
+	count, _ := m.CountEvents(ctx, nostr.Filter{Kinds: []int{0}})
+	if count != 1 {
+		t.Fatalf("expected a single replaceable event, got %d", count)
+	}
+	ch, _ := m.QueryEvents(ctx, nostr.Filter{Kinds: []int{0}})
+	if evt := <-ch; evt == nil || evt.ID != "new" {
+		t.Fatalf("expected the newer event to win, got %v", evt)
+	}
+}
+
+func TestMemoryDriver(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(context.Background())
+	if err := store.Init(); err != nil {
+		t.Fatalf("init storage: %v", err)
+	}
+	r.ready()
+
+	if err := store.SaveEvent(context.Background(), signedEvent(t, bytes32Hex(0x11), 1, "hello")); err != nil {
+		t.Fatalf("save event: %v", err)
+	}
+	count, err := r.countEvents(context.Background())
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 event, got %d (%v)", count, err)
+	}
+	if r.lists.Load() == nil {
+		t.Fatal("expected lists to be loaded")
+	}
+}
+
+func TestMemoryDriverEvictionBookkeeping(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{MaxEvents: 1}}
+	store := r.Storage(ctx)
+	store.Init()
+	r.ready()
+
+	secret := bytes32Hex(0x11)
+	expiring := signedEvent(t, secret, 1, "soon gone")
+	expiring.Tags = nostr.Tags{{"expiration", fmt.Sprint(nostr.Now() + 3600)}}
+	expiring.Sign(secret)
+	for _, evt := range []*nostr.Event{expiring, signedEvent(t, secret, 1, "kept")} {
+		store.SaveEvent(ctx, evt)
+		r.storeWithHooks.AfterSave(evt)
+	}
+
+	if used, _ := r.usage.used(ctx, expiring.PubKey, nil); used.events != 1 {
+		t.Fatalf("expected the evicted event to leave the usage, got %+v", used)
+	}
+	if pending, _, _ := r.reaper.index.count(nostr.Now()); pending != 0 {
+		t.Fatalf("expected the evicted event to leave the expiration index, got %d", pending)
+	}
+}
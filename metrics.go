@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics served on /metrics.
+var (
+	eventsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_relay_events_accepted_total",
+		Help: "Events accepted for storage, by kind.",
+	}, []string{"kind"})
+	eventsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_relay_events_rejected_total",
+		Help: "Events rejected by the relay policy, by reason and kind.",
+	}, []string{"reason", "kind"})
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_relay_requests_total",
+		Help: "REQ and COUNT messages, by type and result.",
+	}, []string{"type", "result"})
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nostr_relay_query_duration_seconds",
+		Help:    "Time taken by backend queries and counts, until the last event is read.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"backend", "operation"})
+	customSearchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nostr_relay_custom_search_duration_seconds",
+		Help:    "Time until the custom search endpoint responds.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	})
+	customSearchErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nostr_relay_custom_search_errors_total",
+		Help: "Custom searches that failed and fell back to the backend.",
+	})
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_relay_notifications_total",
+		Help: "Notification deliveries, by service and result.",
+	}, []string{"service", "result"})
+	moderationActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nostr_relay_moderation_actions_total",
+		Help: "Actions taken on reported pubkeys and events, by action and type.",
+	}, []string{"action", "type"})
+)
+
+// registerServerMetrics adds the gauges read from server and subs.
+func registerServerMetrics(server *relayer.Server, subs *subscriptionSet) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nostr_relay_connections",
+		Help: "Open websocket connections.",
+	}, func() float64 {
+		return float64(server.ClientsNum())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nostr_relay_subscriptions",
+		Help: "Subscriptions of the open connections.",
+	}, func() float64 {
+		return float64(subs.count())
+	})
+}
+
+type internalQueryKey struct{}
+
+// internalQuery marks ctx as that of a query the relay runs for itself, such
+// as those of the reaper, which is left out of the query latencies.
+func internalQuery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalQueryKey{}, true)
+}
+
+func isInternalQuery(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalQueryKey{}).(bool)
+	return internal
+}
+
+// observeEvent counts evt as accepted, or as rejected for reason.
+func observeEvent(evt *nostr.Event, reason string) {
+	kind := strconv.Itoa(evt.Kind)
+	if reason == "" {
+		eventsAccepted.WithLabelValues(kind).Inc()
+		return
+	}
+	eventsRejected.WithLabelValues(reason, kind).Inc()
+}
+
+// observeQuery records how long a query took and ends its span once ch has
+// been read to the end, passing its events on through the returned channel.
+func observeQuery(ctx context.Context, ch chan *nostr.Event, backend, operation string, start time.Time, span trace.Span) chan *nostr.Event {
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		defer span.End()
+		defer func() {
+			for range ch {
+			}
+		}()
+		for evt := range ch {
+			select {
+			case out <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !isInternalQuery(ctx) {
+			queryDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+		}
+	}()
+	return out
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetrics(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(context.Background()).(*relayStore)
+	store.Init()
+	ctx := context.Background()
+
+	blocked := bytes32Hex(0x22)
+	pubkey, _ := nostr.GetPublicKey(blocked)
+	r.lists.Store(&relayLists{blocklist: map[string]struct{}{pubkey: {}}})
+
+	accepted := testutil.ToFloat64(eventsAccepted.WithLabelValues("1"))
+	rejected := testutil.ToFloat64(eventsRejected.WithLabelValues("blocklist", "1"))
+	if ok, _ := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x11), 1, "hello")); !ok {
+		t.Fatal("expected the event to be accepted")
+	}
+	if ok, _ := r.AcceptEvent(ctx, signedEvent(t, blocked, 1, "hello")); ok {
+		t.Fatal("expected the event to be rejected")
+	}
+	if got := testutil.ToFloat64(eventsAccepted.WithLabelValues("1")) - accepted; got != 1 {
+		t.Fatalf("expected 1 accepted event, got %v", got)
+	}
+	if got := testutil.ToFloat64(eventsRejected.WithLabelValues("blocklist", "1")) - rejected; got != 1 {
+		t.Fatalf("expected 1 event rejected by the blocklist, got %v", got)
+	}
+
+	reqs := testutil.ToFloat64(requests.WithLabelValues("REQ", "accepted"))
+	r.AcceptReq(ctx, "sub", nostr.Filters{{}}, "")
+	if got := testutil.ToFloat64(requests.WithLabelValues("REQ", "accepted")) - reqs; got != 1 {
+		t.Fatalf("expected 1 REQ, got %v", got)
+	}
+
+	// a COUNT with two filters is answered once
+	countReqs := testutil.ToFloat64(requests.WithLabelValues("COUNT", "accepted"))
+	conn := r.subscriptions.watcher()
+	conn.received("COUNT", "c")
+	conn.sent("COUNT", "c")
+	if got := testutil.ToFloat64(requests.WithLabelValues("COUNT", "accepted")) - countReqs; got != 1 {
+		t.Fatalf("expected 1 COUNT, got %v", got)
+	}
+
+	queries := sampleCount(t, queryDuration.WithLabelValues("memory", "query"))
+	counts := sampleCount(t, queryDuration.WithLabelValues("memory", "count"))
+	ch, err := store.QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	for range ch {
+	}
+	if _, err := store.CountEvents(ctx, nostr.Filter{}); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if got := sampleCount(t, queryDuration.WithLabelValues("memory", "query")) - queries; got != 1 {
+		t.Fatalf("expected 1 query latency, got %d", got)
+	}
+	if got := sampleCount(t, queryDuration.WithLabelValues("memory", "count")) - counts; got != 1 {
+		t.Fatalf("expected 1 count latency, got %d", got)
+	}
+
+	queries = sampleCount(t, queryDuration.WithLabelValues("memory", "query"))
+	if _, err := queryAll(ctx, store, nostr.Filter{}); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if got := sampleCount(t, queryDuration.WithLabelValues("memory", "query")) - queries; got != 0 {
+		t.Fatalf("expected internal queries to be left out, got %d", got)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/mysql"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/eventstore/turso"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// migratePageSize is how many events a single query may return while
+// migrating or exporting. It is raised above the relay's own limit so that
+// busy seconds still fit in one page.
+const migratePageSize = 5000
+
+// migrateCheckpoint is written after every copied time window so that an
+// interrupted migration picks up where it stopped. Key identifies the pair of
+// databases without storing their connection strings, which may hold
+// passwords.
+type migrateCheckpoint struct {
+	Key    string          `json:"key"`
+	Since  nostr.Timestamp `json:"since"`
+	Copied int64           `json:"copied"`
+}
+
+func runMigrate(args []string) error {
+	var src, dst Relay
+	var from, to, checkpointPath string
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&src.driverName, "from-driver", "sqlite3", "source driver name")
+	flags.StringVar(&from, "from", "", "source connection string")
+	flags.StringVar(&dst.driverName, "to-driver", "", "destination driver name")
+	flags.StringVar(&to, "to", "", "destination connection string")
+	flags.StringVar(&checkpointPath, "checkpoint", "nostr-relay-migrate.json", "file to record progress in, for resuming")
+	flags.Parse(args)
+
+	if from == "" || to == "" || dst.driverName == "" {
+		flags.Usage()
+		return errors.New("-from, -to-driver and -to are required")
+	}
+	if err := src.configureStorage(from, 0, migratePageSize); err != nil {
+		return err
+	}
+	if err := dst.configureStorage(to, 0, migratePageSize); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	srcStore, dstStore := src.Storage(ctx), dst.Storage(ctx)
+	if err := srcStore.Init(); err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer srcStore.Close()
+	if err := dstStore.Init(); err != nil {
+		return fmt.Errorf("open destination: %w", err)
+	}
+	defer dstStore.Close()
+
+	sum := sha256.Sum256([]byte(src.driverName + "\x00" + from + "\x00" + dst.driverName + "\x00" + to))
+	cp := migrateCheckpoint{Key: hex.EncodeToString(sum[:])}
+	if err := loadMigrateCheckpoint(checkpointPath, &cp); err != nil {
+		return err
+	}
+	if cp.Since > 0 {
+		slog.Info("resuming migration", "since", cp.Since, "copied", cp.Copied)
+	}
+
+	if err := migrateEvents(ctx, srcStore, dstStore, &cp, func() error {
+		return saveMigrateCheckpoint(checkpointPath, &cp)
+	}); err != nil {
+		return err
+	}
+	if err := migrateLists(&src, &dst); err != nil {
+		return err
+	}
+
+	srcCount, err := src.countEvents(ctx)
+	if err != nil {
+		return fmt.Errorf("count source events: %w", err)
+	}
+	dstCount, err := dst.countEvents(ctx)
+	if err != nil {
+		return fmt.Errorf("count destination events: %w", err)
+	}
+	slog.Info("migration finished", "copied", cp.Copied, "source", srcCount, "destination", dstCount)
+	if dstCount < srcCount {
+		return fmt.Errorf("destination has %d events but source has %d", dstCount, srcCount)
+	}
+	return os.Remove(checkpointPath)
+}
+
+// migrateEvents copies every event from src to dst, oldest first, calling
+// checkpoint after each time window has been written.
+func migrateEvents(ctx context.Context, src, dst eventstore.Store, cp *migrateCheckpoint, checkpoint func() error) error {
+	since := cp.Since
+	return walkEvents(ctx, src, nostr.Filter{Since: &since}, migratePageSize, func(events []*nostr.Event, until nostr.Timestamp) error {
+		for _, evt := range events {
+			if _, err := storeEvent(ctx, dst, evt); err != nil {
+				return fmt.Errorf("save event %s: %w", evt.ID, err)
+			}
+		}
+		cp.Since = until + 1
+		cp.Copied += int64(len(events))
+		if len(events) > 0 {
+			slog.Info("migrated events", "until", until, "copied", cp.Copied)
+		}
+		return checkpoint()
+	})
+}
+
+// walkEvents calls fn with all events matching filter, oldest first. Stores
+// only return the newest events matching a filter, so the store is walked in
+// time windows small enough to come back in a single page: a full page halves
+// the window and retries it, a sparse one lets the window grow again. A single
+// second that fills a page is read by id with eventsAt. fn is given the events
+// of one window and the window's upper bound. pageSize must not exceed the
+// number of events the store returns for a single query.
+func walkEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, pageSize int, fn func(events []*nostr.Event, until nostr.Timestamp) error) error {
+	newest := filter
+	newest.Limit = 1
+	events, err := queryAll(ctx, store, newest)
+	if err != nil {
+		return fmt.Errorf("query events: %w", err)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	last := events[0].CreatedAt
+
+	var since nostr.Timestamp
+	if filter.Since != nil {
+		since = *filter.Since
+	}
+	// the number of seconds in a window, never less than one
+	window := nostr.Timestamp(24 * 60 * 60)
+	for since <= last {
+		until := since + window - 1
+		if filter.Until != nil && until > *filter.Until {
+			until = *filter.Until
+		}
+		page := filter
+		page.Since, page.Until, page.Limit = &since, &until, pageSize
+		events, err := queryAll(ctx, store, page)
+		if err != nil {
+			return fmt.Errorf("query events: %w", err)
+		}
+		if len(events) >= pageSize {
+			if until > since {
+				window = max(window/2, 1)
+				continue
+			}
+			all, ok, err := eventsAt(ctx, store, filter, since, pageSize)
+			if err != nil {
+				return fmt.Errorf("query events: %w", err)
+			}
+			if ok {
+				events = all
+			} else {
+				slog.Warn("more events in a single second than fit in a page; some may be skipped", "created_at", since)
+			}
+		}
+
+		slices.SortFunc(events, func(a, b *nostr.Event) int {
+			return compareNewestFirst(b, a)
+		})
+		if err := fn(events, until); err != nil {
+			return err
+		}
+
+		since = until + 1
+		if len(events)*4 < pageSize {
+			window = max(window*2, 1)
+		}
+	}
+	return nil
+}
+
+// eventsAt returns the events matching filter created at ts, reading them
+// from store pageSize at a time in id order, which a filter cannot express.
+// ok is false for the stores that cannot do so: LMDB, Badger and OpenSearch.
+func eventsAt(ctx context.Context, store eventstore.Store, filter nostr.Filter, ts nostr.Timestamp, pageSize int) (events []*nostr.Event, ok bool, err error) {
+	var page func(afterID string) ([]*nostr.Event, error)
+	switch s := store.(type) {
+	case *relayStore:
+		return eventsAt(ctx, s.Store, filter, ts, pageSize)
+	case *memoryStore:
+		page = func(afterID string) ([]*nostr.Event, error) {
+			return s.eventsAt(ts, afterID, pageSize), nil
+		}
+	case *sqlite3.SQLite3Backend:
+		page = sqlEventsAt(ctx, s.DB, ts, pageSize)
+	case *turso.TursoBackend:
+		page = sqlEventsAt(ctx, s.DB, ts, pageSize)
+	case *postgresql.PostgresBackend:
+		page = sqlEventsAt(ctx, s.DB, ts, pageSize)
+	case *mysql.MySQLBackend:
+		page = sqlEventsAt(ctx, s.DB, ts, pageSize)
+	default:
+		return nil, false, nil
+	}
+
+	var afterID string
+	for {
+		batch, err := page(afterID)
+		if err != nil {
+			return nil, true, err
+		}
+		for _, evt := range batch {
+			if filter.Matches(evt) {
+				events = append(events, evt)
+			}
+		}
+		if len(batch) < pageSize {
+			return events, true, nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+// sqlEventsAt returns a function reading pageSize events created at ts from
+// the event table of db, starting after an id.
+func sqlEventsAt(ctx context.Context, db *sqlx.DB, ts nostr.Timestamp, pageSize int) func(afterID string) ([]*nostr.Event, error) {
+	query := db.Rebind(`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE created_at = ? AND id > ? ORDER BY id LIMIT ?`)
+	return func(afterID string) ([]*nostr.Event, error) {
+		rows, err := db.QueryContext(ctx, query, ts, afterID, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var events []*nostr.Event
+		for rows.Next() {
+			var evt nostr.Event
+			var createdAt int64
+			if err := rows.Scan(&evt.ID, &evt.PubKey, &createdAt, &evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+				return nil, err
+			}
+			evt.CreatedAt = nostr.Timestamp(createdAt)
+			events = append(events, &evt)
+		}
+		return events, rows.Err()
+	}
+}
+
+// storeEvent stores evt the way the relay would have, treating events that
+// are already there as done, and reports whether evt was new.
+func storeEvent(ctx context.Context, store eventstore.Store, evt *nostr.Event) (bool, error) {
+	var err error
+	if nostr.IsRegularKind(evt.Kind) {
+		err = store.SaveEvent(ctx, evt)
+	} else {
+		err = store.ReplaceEvent(ctx, evt)
+	}
+	if errors.Is(err, eventstore.ErrDupEvent) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func queryAll(ctx context.Context, store eventstore.Store, filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := store.QueryEvents(internalQuery(ctx), filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events, ctx.Err()
+}
+
+// migrateLists adds the entries of the source allowlist, blocklist and other
+// lists to the destination lists, skipping those already there, and copies the
+// bans, the actions taken on reports and the relay information changed through
+// the management API over those of the destination.
+func migrateLists(src, dst *Relay) error {
+	srcLists, dstLists := src.newListStore(), dst.newListStore()
+	if srcLists == nil || dstLists == nil {
+		slog.Warn("allowlist and blocklist not copied; driver has no place for them", "from", src.driverName, "to", dst.driverName)
+		return nil
+	}
+	for _, l := range []listStore{srcLists, dstLists} {
+		if err := l.init(); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range listNames {
+		srcEntries, err := srcLists.load(name)
+		if err != nil {
+			return fmt.Errorf("load source %s: %w", name, err)
+		}
+		dstEntries, err := dstLists.load(name)
+		if err != nil {
+			return fmt.Errorf("load destination %s: %w", name, err)
+		}
+		for value := range srcEntries {
+			if _, ok := dstEntries[value]; ok {
+				continue
+			}
+			if err := dstLists.add(name, value); err != nil {
+				return fmt.Errorf("copy %s: %w", name, err)
+			}
+		}
+	}
+
+	bans, err := srcLists.loadBans()
+	if err != nil {
+		return fmt.Errorf("load source bans: %w", err)
+	}
+	for _, b := range bans {
+		if err := dstLists.putBan(b); err != nil {
+			return fmt.Errorf("copy bans: %w", err)
+		}
+	}
+
+	actions, err := srcLists.loadActions()
+	if err != nil {
+		return fmt.Errorf("load source moderation actions: %w", err)
+	}
+	for _, a := range actions {
+		if err := dstLists.putAction(a); err != nil {
+			return fmt.Errorf("copy moderation actions: %w", err)
+		}
+	}
+
+	info, err := srcLists.loadInfo()
+	if err != nil {
+		return fmt.Errorf("load source relay information: %w", err)
+	}
+	for field, value := range info {
+		if err := dstLists.putInfo(field, value); err != nil {
+			return fmt.Errorf("copy relay information: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadMigrateCheckpoint fills cp from path if it was written for the same
+// pair of databases, and leaves it untouched otherwise.
+func loadMigrateCheckpoint(path string, cp *migrateCheckpoint) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved migrateCheckpoint
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("read checkpoint %s: %w", path, err)
+	}
+	if saved.Key == cp.Key {
+		*cp = saved
+	}
+	return nil
+}
+
+func saveMigrateCheckpoint(path string, cp *migrateCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMigrateEventsResumes(t *testing.T) {
+	ctx := context.Background()
+	src, dst := &memoryStore{}, &memoryStore{}
+	src.Init()
+	dst.Init()
+	for i, ts := range []nostr.Timestamp{10, 200000, 200001, 900000} {
+		evt := signedEvent(t, bytes32Hex(byte(i+1)), 1, "hello")
+		evt.CreatedAt = ts
+		src.SaveEvent(ctx, evt)
+	}
+
+	// stop after the first window that copied anything
+	var cp migrateCheckpoint
+	interrupted := errors.New("interrupted")
+	err := migrateEvents(ctx, src, dst, &cp, func() error {
+		if cp.Copied > 0 {
+			return interrupted
+		}
+		return nil
+	})
+	if err != interrupted {
+		t.Fatalf("expected interruption, got %v", err)
+	}
+	if n, _ := dst.CountEvents(ctx, nostr.Filter{}); n != 1 {
+		t.Fatalf("expected only the oldest event before resuming, got %d", n)
+	}
+
+	if err := migrateEvents(ctx, src, dst, &cp, func() error { return nil }); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if n, _ := dst.CountEvents(ctx, nostr.Filter{}); n != 4 {
+		t.Fatalf("expected 4 events after resuming, got %d", n)
+	}
+}
+
+func TestRunMigrate(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from.sqlite")
+	to := filepath.Join(dir, "to")
+
+	src := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: from}}
+	store := src.Storage(context.Background())
+	if err := store.Init(); err != nil {
+		t.Fatalf("init source: %v", err)
+	}
+	lists := src.newListStore()
+	lists.init()
+	lists.add("blocklist", "bad")
+	lists.putBan(ban{Type: banKeyword, Value: "casino", Reason: "spam", CreatedAt: nostr.Now()})
+	lists.putAction(moderationAction{ID: "1", Action: actionQuarantine, Type: banPubkey, Target: bytes32Hex(0x09), Reports: 3, Weight: 2.5, CreatedAt: nostr.Now()})
+	for i := range 3 {
+		store.SaveEvent(context.Background(), signedEvent(t, bytes32Hex(byte(i+1)), 1, "hello"))
+	}
+	store.Close()
+
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+	if err := runMigrate([]string{"-from", from, "-to-driver", "badger", "-to", to, "-checkpoint", checkpoint}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("expected checkpoint to be removed, got %v", err)
+	}
+
+	dst := &Relay{driverName: "badger", badgerStorage: &badger.BadgerBackend{Path: to}}
+	store = dst.Storage(context.Background())
+	if err := store.Init(); err != nil {
+		t.Fatalf("init destination: %v", err)
+	}
+	defer store.Close()
+	dst.ready()
+	if count, err := dst.countEvents(context.Background()); err != nil || count != 3 {
+		t.Fatalf("expected 3 events, got %d (%v)", count, err)
+	}
+	if _, blocked := dst.currentLists().blocklist["bad"]; !blocked {
+		t.Fatal("expected blocklist to be copied")
+	}
+	if bans := dst.currentLists().bans.list(banKeyword, nostr.Now()); len(bans) != 1 || bans[0].Reason != "spam" {
+		t.Fatalf("expected the ban to be copied, got %v", bans)
+	}
+	if actions := dst.currentLists().moderation.list(); len(actions) != 1 || actions[0].Weight != 2.5 {
+		t.Fatalf("expected the moderation action to be copied, got %v", actions)
+	}
+}
+
+func TestWalkEventsBusySecond(t *testing.T) {
+	ctx := context.Background()
+	sqlite := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "walk.sqlite")}
+	if err := sqlite.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	memory := &memoryStore{}
+	memory.Init()
+
+	for name, store := range map[string]eventstore.Store{"sqlite3": sqlite, "memory": memory} {
+		var want []string
+		for i := range 10 {
+			kind := 1
+			if i == 3 {
+				kind = 7
+			}
+			evt := signedEvent(t, bytes32Hex(0x01), kind, fmt.Sprint(i))
+			evt.CreatedAt = 1000
+			if i == 9 {
+				// far enough for a window stuck at a second to crawl
+				evt.CreatedAt = 50_000_000
+			}
+			store.SaveEvent(ctx, evt)
+			if kind == 1 {
+				want = append(want, evt.ID)
+			}
+		}
+
+		var got []string
+		err := walkEvents(ctx, store, nostr.Filter{Kinds: []int{1}}, 3, func(events []*nostr.Event, _ nostr.Timestamp) error {
+			for _, evt := range events {
+				got = append(got, evt.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s: expected every event of the busy second once, got %d of %d", name, len(got), len(want))
+		}
+	}
+}
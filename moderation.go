@@ -0,0 +1,470 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The actions taken on a pubkey or an event reported past the threshold.
+const (
+	// actionQuarantine hides the events of the target from queries and
+	// rejects new ones until an admin reviews it.
+	actionQuarantine = "quarantine"
+	// actionBan bans the target, deleting it if it is an event.
+	actionBan = "ban"
+)
+
+// reportCreator is the creator of the bans made from reports.
+const reportCreator = "reports"
+
+// reportPolicy decides when NIP-56 reports on a pubkey or an event are enough
+// to act on it: when the weights of the distinct reporters add up to the
+// threshold.
+type reportPolicy struct {
+	threshold     float64
+	action        string
+	weights       map[string]float64
+	defaultWeight float64
+}
+
+// parseReportPolicy parses the reporters trusted, separated by commas, each in
+// the form PUBKEY[:WEIGHT] with a weight of 1 by default, and * for everyone
+// else, who weighs nothing unless * says otherwise. For example:
+// npub1xxxxx:3,npub1yyyyy,*:0.2. A threshold of 0 disables the policy; any
+// other needs trusted reporters, since keys cost nothing to make.
+func parseReportPolicy(threshold float64, action, trusted string) (*reportPolicy, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+	if action != actionQuarantine && action != actionBan {
+		return nil, fmt.Errorf("invalid report action %q", action)
+	}
+	p := &reportPolicy{threshold: threshold, action: action, weights: map[string]float64{}}
+	defaultWeight := -1.0
+	for _, field := range strings.Split(trusted, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		pubkey, weightValue, hasWeight := strings.Cut(field, ":")
+		weight := 1.0
+		if hasWeight {
+			var err error
+			if weight, err = strconv.ParseFloat(strings.TrimSpace(weightValue), 64); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in trusted reporter %q", field)
+			}
+		}
+		if pubkey == "*" {
+			defaultWeight = weight
+			continue
+		}
+		admins, err := parseAdminPubkeys(pubkey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted reporter %q: %w", field, err)
+		}
+		for pubkey := range admins {
+			p.weights[pubkey] = weight
+		}
+	}
+	if len(p.weights) == 0 && defaultWeight < 0 {
+		return nil, fmt.Errorf("a report threshold needs trusted reporters")
+	}
+	p.defaultWeight = max(defaultWeight, 0)
+	return p, nil
+}
+
+// weight returns how much a report from pubkey counts.
+func (p *reportPolicy) weight(pubkey string) float64 {
+	if weight, ok := p.weights[pubkey]; ok {
+		return weight
+	}
+	return p.defaultWeight
+}
+
+// reportTarget is a pubkey or an event a report is about.
+type reportTarget struct {
+	typ   string
+	value string
+}
+
+// reportTargets returns what evt, a NIP-56 report, reports: the events of its
+// e tags or, if it has none, the pubkeys of its p tags. A report on an event
+// has to tag its author too, which is not a report on the author.
+func reportTargets(evt *nostr.Event) []reportTarget {
+	var targets []reportTarget
+	onEvents := reportsEvents(evt)
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || !nostr.IsValid32ByteHex(tag[1]) {
+			continue
+		}
+		var target reportTarget
+		switch tag[0] {
+		case "e":
+			target = reportTarget{banEvent, tag[1]}
+		case "p":
+			if onEvents {
+				continue
+			}
+			target = reportTarget{banPubkey, tag[1]}
+		default:
+			continue
+		}
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// reportsEvents reports whether evt, a NIP-56 report, is about events rather
+// than pubkeys.
+func reportsEvents(evt *nostr.Event) bool {
+	return slices.ContainsFunc(evt.Tags, func(tag nostr.Tag) bool {
+		return len(tag) >= 2 && tag[0] == "e" && nostr.IsValid32ByteHex(tag[1])
+	})
+}
+
+// moderationAction records what the relay did on its own about a reported
+// pubkey or event, and whether an admin reversed it.
+type moderationAction struct {
+	ID         string          `json:"id" db:"id"`
+	Action     string          `json:"action" db:"action"`
+	Type       string          `json:"type" db:"type"`
+	Target     string          `json:"target" db:"target"`
+	Reason     string          `json:"reason" db:"reason"`
+	Reports    int             `json:"reports" db:"reports"`
+	Weight     float64         `json:"weight" db:"weight"`
+	CreatedAt  nostr.Timestamp `json:"created_at" db:"created_at"`
+	ReversedAt nostr.Timestamp `json:"reversed_at,omitempty" db:"reversed_at"`
+	ReversedBy string          `json:"reversed_by,omitempty" db:"reversed_by"`
+}
+
+// moderationState holds the actions taken on reports, indexed by target.
+type moderationState struct {
+	actions []moderationAction
+	// acted holds the targets of every action, reversed or not
+	acted map[reportTarget]struct{}
+	// quarantined holds the quarantines in effect
+	quarantined map[reportTarget]moderationAction
+}
+
+func newModerationState(actions []moderationAction) *moderationState {
+	s := &moderationState{
+		actions:     actions,
+		acted:       map[reportTarget]struct{}{},
+		quarantined: map[reportTarget]moderationAction{},
+	}
+	slices.SortFunc(s.actions, func(a, b moderationAction) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	for _, a := range actions {
+		target := reportTarget{a.Type, a.Target}
+		s.acted[target] = struct{}{}
+		if a.Action == actionQuarantine && a.ReversedAt == 0 {
+			s.quarantined[target] = a
+		}
+	}
+	return s
+}
+
+// actedOn reports whether an action was taken on target, reversed or not.
+func (s *moderationState) actedOn(target reportTarget) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.acted[target]
+	return ok
+}
+
+// quarantine returns the quarantine evt is under, of its author or of itself.
+func (s *moderationState) quarantine(evt *nostr.Event) (moderationAction, bool) {
+	if s == nil || len(s.quarantined) == 0 {
+		return moderationAction{}, false
+	}
+	if a, ok := s.quarantined[reportTarget{banPubkey, evt.PubKey}]; ok {
+		return a, true
+	}
+	a, ok := s.quarantined[reportTarget{banEvent, evt.ID}]
+	return a, ok
+}
+
+// quarantinedEvents returns the quarantines of events, newest first.
+func (s *moderationState) quarantinedEvents() []moderationAction {
+	var quarantined []moderationAction
+	if s == nil {
+		return quarantined
+	}
+	for _, a := range s.actions {
+		if _, ok := s.quarantined[reportTarget{a.Type, a.Target}]; ok && a.Type == banEvent && a.Action == actionQuarantine {
+			quarantined = append(quarantined, a)
+		}
+	}
+	return quarantined
+}
+
+// list returns every action, newest first.
+func (s *moderationState) list() []moderationAction {
+	if s == nil {
+		return []moderationAction{}
+	}
+	return slices.Clone(s.actions)
+}
+
+// moderateReport counts the reports on each target of evt, a report just
+// stored in store, and acts on those that reach the threshold of the report
+// policy. Targets already banned, or acted on before, are left alone: an
+// admin who reversed an action has had the last word.
+func (r *Relay) moderateReport(ctx context.Context, store eventstore.Store, evt *nostr.Event) {
+	r.moderationMu.Lock()
+	defer r.moderationMu.Unlock()
+
+	for _, target := range reportTargets(evt) {
+		lists := r.currentLists()
+		if lists.moderation.actedOn(target) {
+			continue
+		}
+		if _, blocked := lists.blocklist[target.value]; blocked || lists.bans.banned(target.typ, target.value, nostr.Now()) {
+			continue
+		}
+
+		reports, weight, reasons, err := r.weighReports(ctx, store, target, evt)
+		if err != nil {
+			slog.Error("failed to count reports", "type", target.typ, "target", target.value, "error", err)
+			continue
+		}
+		if weight < r.reportPolicy.threshold {
+			continue
+		}
+		action := moderationAction{
+			ID:        newActionID(),
+			Action:    r.reportPolicy.action,
+			Type:      target.typ,
+			Target:    target.value,
+			Reason:    "reported: " + strings.Join(reasons, ", "),
+			Reports:   reports,
+			Weight:    weight,
+			CreatedAt: nostr.Now(),
+		}
+		if err := r.takeModerationAction(ctx, action); err != nil {
+			slog.Error("failed to act on reports", "action", action.Action, "type", action.Type, "target", action.Target, "error", err)
+			continue
+		}
+		moderationActions.WithLabelValues(action.Action, action.Type).Inc()
+		slog.Warn("acted on reports", "id", action.ID, "action", action.Action, "type", action.Type, "target", action.Target, "reports", reports, "weight", weight)
+	}
+}
+
+// weighReports returns the number of distinct reporters of target, including
+// that of latest if it reports target, the sum of their weights and the types
+// of report they made.
+func (r *Relay) weighReports(ctx context.Context, store eventstore.Store, target reportTarget, latest *nostr.Event) (int, float64, []string, error) {
+	tag := "e"
+	if target.typ == banPubkey {
+		tag = "p"
+	}
+	reports, err := queryAll(ctx, store, nostr.Filter{Kinds: []int{1984}, Tags: nostr.TagMap{tag: []string{target.value}}})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	reporters := map[string]struct{}{}
+	types := map[string]struct{}{}
+	var weight float64
+	for _, report := range append(reports, latest) {
+		if _, ok := reporters[report.PubKey]; ok || report.PubKey == target.value {
+			continue
+		}
+		if target.typ == banPubkey && reportsEvents(report) {
+			// it only tags the author of the event it reports
+			continue
+		}
+		reporters[report.PubKey] = struct{}{}
+		weight += r.reportPolicy.weight(report.PubKey)
+		for _, t := range report.Tags {
+			if len(t) >= 3 && t[0] == tag && t[1] == target.value && t[2] != "" {
+				types[t[2]] = struct{}{}
+			}
+		}
+	}
+	reasons := slices.Sorted(maps.Keys(types))
+	if len(reasons) == 0 {
+		reasons = []string{"other"}
+	}
+	return len(reporters), weight, reasons, nil
+}
+
+// takeModerationAction records action, and bans its target if it is a ban.
+func (r *Relay) takeModerationAction(ctx context.Context, action moderationAction) error {
+	err := r.updateLists(func(lists *relayLists) error {
+		if action.Action == actionBan {
+			err := r.putBanIn(lists, ban{Type: action.Type, Value: action.Target, Reason: action.Reason, Creator: reportCreator, CreatedAt: action.CreatedAt})
+			if err != nil {
+				return err
+			}
+		}
+		return r.changeModerationIn(lists, func(actions []moderationAction) ([]moderationAction, error) {
+			if err := r.listStore.putAction(action); err != nil {
+				return nil, err
+			}
+			return append(actions, action), nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if action.Action == actionBan && action.Type == banEvent {
+		return r.deleteEventByID(ctx, action.Target)
+	}
+	return nil
+}
+
+// reverseModerationAction lifts the quarantine or the ban of the action with
+// id, recording that admin reversed it.
+func (r *Relay) reverseModerationAction(id, admin string) error {
+	return r.updateLists(func(lists *relayLists) error { return r.reverseModerationActionIn(lists, id, admin) })
+}
+
+// reverseModerationActionIn does what reverseModerationAction does to lists,
+// for updateLists.
+func (r *Relay) reverseModerationActionIn(lists *relayLists, id, admin string) error {
+	var action moderationAction
+	err := r.changeModerationIn(lists, func(actions []moderationAction) ([]moderationAction, error) {
+		i := slices.IndexFunc(actions, func(a moderationAction) bool { return a.ID == id })
+		if i < 0 {
+			return nil, fmt.Errorf("no moderation action %s", id)
+		}
+		if actions[i].ReversedAt != 0 {
+			return nil, fmt.Errorf("moderation action %s is already reversed", id)
+		}
+		action = actions[i]
+		action.ReversedAt = nostr.Now()
+		action.ReversedBy = admin
+		if err := r.listStore.putAction(action); err != nil {
+			return nil, err
+		}
+		actions[i] = action
+		return actions, nil
+	})
+	if err != nil {
+		return err
+	}
+	if action.Action == actionBan {
+		return r.removeBanIn(lists, action.Type, action.Target)
+	}
+	return nil
+}
+
+// liftQuarantineIn reverses the quarantine of target in lists, if it is under
+// one, on behalf of admin.
+func (r *Relay) liftQuarantineIn(lists *relayLists, typ, value, admin string) error {
+	var evt nostr.Event
+	if typ == banPubkey {
+		evt.PubKey = value
+	} else {
+		evt.ID = value
+	}
+	if a, ok := lists.moderation.quarantine(&evt); ok {
+		return r.reverseModerationActionIn(lists, a.ID, admin)
+	}
+	return nil
+}
+
+// changeModerationIn replaces the actions in lists with what change makes of
+// them, after it has stored the change.
+func (r *Relay) changeModerationIn(lists *relayLists, change func([]moderationAction) ([]moderationAction, error)) error {
+	actions, err := change(lists.moderation.list())
+	if err != nil {
+		return err
+	}
+	lists.moderation = newModerationState(actions)
+	return nil
+}
+
+func newActionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loadActions returns the actions in the moderation_actions table.
+func (l *sqlLists) loadActions() ([]moderationAction, error) {
+	var actions []moderationAction
+	err := l.db.Select(&actions, `SELECT id, action, type, target, reason, reports, weight, created_at, reversed_at, reversed_by FROM moderation_actions`)
+	return actions, err
+}
+
+func (l *sqlLists) putAction(a moderationAction) error {
+	tx, err := l.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM moderation_actions WHERE id = ?`), a.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(`INSERT INTO moderation_actions (id, action, type, target, reason, reports, weight, created_at, reversed_at, reversed_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		a.ID, a.Action, a.Type, a.Target, a.Reason, a.Reports, a.Weight, a.CreatedAt, a.ReversedAt, a.ReversedBy)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadActions returns the actions in the file named moderation, one JSON
+// object per line.
+func (l *fileLists) loadActions() ([]moderationAction, error) {
+	lines, err := l.readFile("moderation")
+	if err != nil {
+		return nil, err
+	}
+	var actions []moderationAction
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var a moderationAction
+		if err := json.Unmarshal([]byte(line), &a); err != nil {
+			return nil, fmt.Errorf("invalid moderation action %s: %w", line, err)
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// putAction rewrites the moderation file with a in place of the action of the
+// same id.
+func (l *fileLists) putAction(a moderationAction) error {
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return l.rewrite("moderation", func(old string) bool {
+		var action moderationAction
+		return json.Unmarshal([]byte(old), &action) == nil && action.ID == a.ID
+	}, string(line))
+}
+
+func (l *memoryLists) loadActions() ([]moderationAction, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.actions), nil
+}
+
+func (l *memoryLists) putAction(a moderationAction) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.actions = slices.DeleteFunc(l.actions, func(old moderationAction) bool { return old.ID == a.ID })
+	l.actions = append(l.actions, a)
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseReportPolicy(t *testing.T) {
+	trusted, _ := nostr.GetPublicKey(bytes32Hex(0x01))
+	for _, tt := range []struct {
+		trusted string
+		want    map[string]float64
+	}{
+		{"*", map[string]float64{trusted: 1, "other": 1}},
+		{trusted + ":3", map[string]float64{trusted: 3, "other": 0}},
+		{trusted + ", *:0.5", map[string]float64{trusted: 1, "other": 0.5}},
+	} {
+		p, err := parseReportPolicy(2, actionQuarantine, tt.trusted)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.trusted, err)
+		}
+		for pubkey, want := range tt.want {
+			if got := p.weight(pubkey); got != want {
+				t.Errorf("%q: expected %s to weigh %v, got %v", tt.trusted, pubkey, want, got)
+			}
+		}
+	}
+	if p, err := parseReportPolicy(0, "", "ignored"); p != nil || err != nil {
+		t.Fatalf("expected a threshold of 0 to disable the policy, got %v %v", p, err)
+	}
+	for _, bad := range []string{"", "nobody", trusted + ":-1", trusted + ":x"} {
+		if _, err := parseReportPolicy(2, actionQuarantine, bad); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+	if _, err := parseReportPolicy(2, "delete", ""); err == nil {
+		t.Error("expected an unknown action to be refused")
+	}
+}
+
+// report returns a report by secret of evt, tagging its author as NIP-56
+// requires.
+func report(t *testing.T, secret string, evt *nostr.Event, typ string) *nostr.Event {
+	t.Helper()
+	return signedReport(t, secret, nostr.Tags{{"e", evt.ID, typ}, {"p", evt.PubKey}})
+}
+
+// reportPubkey returns a report by secret of pubkey itself.
+func reportPubkey(t *testing.T, secret, pubkey, typ string) *nostr.Event {
+	t.Helper()
+	return signedReport(t, secret, nostr.Tags{{"p", pubkey, typ}})
+}
+
+func signedReport(t *testing.T, secret string, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+	rep := nostr.Event{Kind: 1984, CreatedAt: nostr.Now(), Tags: tags}
+	if err := rep.Sign(secret); err != nil {
+		t.Fatal(err)
+	}
+	return &rep
+}
+
+func TestReportTargets(t *testing.T) {
+	evt := signedEvent(t, bytes32Hex(0x04), 1, "spam")
+	if targets := reportTargets(report(t, bytes32Hex(0x01), evt, "spam")); len(targets) != 1 || targets[0] != (reportTarget{banEvent, evt.ID}) {
+		t.Fatalf("expected only the event to be reported, got %v", targets)
+	}
+	if targets := reportTargets(reportPubkey(t, bytes32Hex(0x01), evt.PubKey, "spam")); len(targets) != 1 || targets[0] != (reportTarget{banPubkey, evt.PubKey}) {
+		t.Fatalf("expected the pubkey to be reported, got %v", targets)
+	}
+}
+
+func TestModerateReports(t *testing.T) {
+	ctx := context.Background()
+	trusted1, trusted2, untrusted := bytes32Hex(0x01), bytes32Hex(0x02), bytes32Hex(0x03)
+	pubkey1, _ := nostr.GetPublicKey(trusted1)
+	pubkey2, _ := nostr.GetPublicKey(trusted2)
+	admin := bytes32Hex(0x09)
+	adminPubkey, _ := nostr.GetPublicKey(admin)
+
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx)
+	store.Init()
+	r.ready()
+	r.adminPubkeys = map[string]struct{}{adminPubkey: {}}
+	var err error
+	if r.reportPolicy, err = parseReportPolicy(2, actionQuarantine, pubkey1+","+pubkey2); err != nil {
+		t.Fatal(err)
+	}
+	handler := r.withManagement(http.NotFoundHandler())
+	call := func(method string, params ...any) any {
+		t.Helper()
+		code, resp := managementRequest(t, handler, admin, method, params...)
+		if code != http.StatusOK || resp.Error != "" {
+			t.Fatalf("%s: %d %s", method, code, resp.Error)
+		}
+		return resp.Result
+	}
+	submit := func(rep *nostr.Event) {
+		t.Helper()
+		if err := store.SaveEvent(ctx, rep); err != nil {
+			t.Fatal(err)
+		}
+		r.moderateReport(ctx, store, rep)
+	}
+
+	spam := signedEvent(t, bytes32Hex(0x04), 1, "spam")
+	store.SaveEvent(ctx, spam)
+	submit(report(t, untrusted, spam, "spam"))
+	submit(report(t, trusted1, spam, "spam"))
+	submit(report(t, trusted1, spam, "illegal"))
+	if r.skipEvent(spam) {
+		t.Fatal("expected reports short of the threshold to be ignored")
+	}
+	submit(report(t, trusted2, spam, "illegal"))
+	if !r.skipEvent(spam) {
+		t.Fatal("expected the reported event to be quarantined")
+	}
+	if accepted, msg := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x04), 1, "more")); !accepted {
+		t.Fatalf("expected the author of the event not to be quarantined with it, got %q", msg)
+	}
+	pending := call("listeventsneedingmoderation").([]any)
+	if len(pending) != 1 || pending[0].(map[string]any)["id"] != spam.ID || pending[0].(map[string]any)["reason"] != "reported: illegal, spam" {
+		t.Fatalf("unexpected events needing moderation %v", pending)
+	}
+
+	submit(reportPubkey(t, trusted1, spam.PubKey, "spam"))
+	submit(reportPubkey(t, trusted2, spam.PubKey, "spam"))
+	if accepted, msg := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x04), 1, "more")); accepted || msg != "blocked: under review after reports" {
+		t.Fatalf("expected the reported author to be quarantined, got %v %q", accepted, msg)
+	}
+	actions := call("listmoderationactions").([]any)
+	if len(actions) != 2 {
+		t.Fatalf("expected the event and its author to be acted on, got %v", actions)
+	}
+	for _, a := range actions {
+		if a := a.(map[string]any); a["type"] == banPubkey {
+			call("reversemoderationaction", a["id"])
+			if _, resp := managementRequest(t, handler, admin, "reversemoderationaction", a["id"]); resp.Error == "" {
+				t.Fatal("expected an action to be reversed only once")
+			}
+		}
+	}
+	if accepted, _ := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x04), 1, "sorry")); !accepted {
+		t.Fatal("expected the author to be released")
+	}
+	call("allowevent", spam.ID)
+	if r.skipEvent(spam) {
+		t.Fatal("expected the allowed event to be served again")
+	}
+	if stored, _ := r.listStore.loadActions(); len(stored) != 2 || stored[0].ReversedBy != adminPubkey || stored[1].ReversedBy != adminPubkey {
+		t.Fatalf("expected both reversals to be recorded, got %+v", stored)
+	}
+
+	// a reversed action is not taken again
+	submit(report(t, bytes32Hex(0x05), spam, "spam"))
+	if r.skipEvent(spam) {
+		t.Fatal("expected the admin's decision to stand")
+	}
+}
+
+func TestModerateReportsBan(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx)
+	store.Init()
+	r.ready()
+	r.reportPolicy, _ = parseReportPolicy(1, actionBan, "*")
+
+	spam := signedEvent(t, bytes32Hex(0x04), 1, "spam")
+	store.SaveEvent(ctx, spam)
+	rep := report(t, bytes32Hex(0x01), spam, "spam")
+	store.SaveEvent(ctx, rep)
+	r.moderateReport(ctx, store, rep)
+
+	if events, _ := queryAll(ctx, store, nostr.Filter{IDs: []string{spam.ID}}); len(events) != 0 {
+		t.Fatal("expected the banned event to be deleted")
+	}
+	bans := r.currentLists().bans.list("", nostr.Now())
+	if len(bans) != 1 || bans[0].Type != banEvent || bans[0].Creator != reportCreator || bans[0].Reason != "reported: spam" {
+		t.Fatalf("expected only the event to be banned, got %v", bans)
+	}
+	actions := r.currentLists().moderation.list()
+	if len(actions) != 1 {
+		t.Fatalf("expected the event to be banned, got %v", actions)
+	}
+	if err := r.reverseModerationAction(actions[0].ID, "token"); err != nil {
+		t.Fatal(err)
+	}
+	if bans := r.currentLists().bans.list("", nostr.Now()); len(bans) != 0 {
+		t.Fatalf("expected the ban to be lifted, got %v", bans)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// quotaRule limits how many events of the given kinds a pubkey may store, and
+// how many bytes they may take up. A zero limit means no limit. A rule with an
+// author replaces the rule for the same kinds for that author only, which is
+// how limits are raised for individual pubkeys.
+type quotaRule struct {
+	kinds     kindRanges
+	maxEvents int64
+	maxBytes  int64
+	author    string
+}
+
+// parseQuotas parses rules separated by semicolons, each in the form
+// KINDS:EVENTS:BYTES[:AUTHOR]. KINDS is as for retention rules, and BYTES may
+// end in K, M or G. For example: *:10000:100M;1:5000:0
+func parseQuotas(spec string) ([]quotaRule, error) {
+	var rules []quotaRule
+	for _, field := range strings.Split(spec, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid quota rule %q", field)
+		}
+
+		var rule quotaRule
+		var err error
+		if rule.kinds, err = parseKindRanges(parts[0]); err != nil {
+			return nil, fmt.Errorf("%w in quota rule %q", err, field)
+		}
+		if rule.maxEvents, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err != nil || rule.maxEvents < 0 {
+			return nil, fmt.Errorf("invalid event count in quota rule %q", field)
+		}
+		if rule.maxBytes, err = parseByteSize(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid size in quota rule %q", field)
+		}
+		if len(parts) == 4 {
+			rule.author = strings.TrimSpace(parts[3])
+			if !nostr.IsValidPublicKey(rule.author) {
+				return nil, fmt.Errorf("invalid author in quota rule %q", field)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			s, unit = n, size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// quotaRulesFor returns the rules that apply to evt: those for its author
+// that match its kind, and the general ones that match and are not replaced
+// by a rule for its author.
+func quotaRulesFor(rules []quotaRule, evt *nostr.Event) []*quotaRule {
+	var applied []*quotaRule
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.kinds.contains(evt.Kind) {
+			continue
+		}
+		if rule.author != "" {
+			if rule.author == evt.PubKey {
+				applied = append(applied, rule)
+			}
+			continue
+		}
+		replaced := slices.ContainsFunc(rules, func(other quotaRule) bool {
+			return other.author == evt.PubKey && slices.Equal(other.kinds, rule.kinds)
+		})
+		if !replaced {
+			applied = append(applied, rule)
+		}
+	}
+	return applied
+}
+
+type quotaUsage struct {
+	events int64
+	bytes  int64
+}
+
+// usageTracker keeps the number and size of the stored events of every pubkey
+// by kind, which quotas are checked against. SQL backends keep it in the
+// quota_usage table, so that instances sharing a database share the usage too;
+// the other backends keep it in memory, where the statistics of /info are
+// taken from as well. It is filled by walking the store when it is created,
+// at every start for the memory, and kept up to date as events are saved and
+// deleted through relayStore. Events saved while the store is walked are
+// remembered in savedDuringScan so the walk does not count them again.
+type usageTracker struct {
+	// db holds the quota_usage table, or is nil to keep the usage in memory
+	db *sqlx.DB
+
+	mu              sync.Mutex
+	usage           map[string]map[int]quotaUsage
+	savedDuringScan map[string]struct{}
+	scanned         atomic.Bool
+}
+
+// eventSize is the size an event takes up in quotas: that of its JSON.
+func eventSize(evt *nostr.Event) int64 {
+	return int64(len(evt.String()))
+}
+
+// init creates the quota_usage table in db, where the usage is kept from then
+// on, and reports whether it was created just now, without the events stored
+// before.
+func (q *usageTracker) init(db *sqlx.DB) (bool, error) {
+	q.db = db
+	if _, err := db.Exec(`SELECT 1 FROM quota_usage WHERE 1 = 0`); err == nil {
+		return false, nil
+	}
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS quota_usage (
+      pubkey varchar(64) NOT NULL,
+      kind integer NOT NULL,
+      events bigint NOT NULL,
+      bytes bigint NOT NULL,
+      PRIMARY KEY (pubkey, kind)
+    );
+    `)
+	return err == nil, err
+}
+
+func (q *usageTracker) add(evt *nostr.Event, sign int64) {
+	q.addUsage(evt.PubKey, evt.Kind, quotaUsage{events: sign, bytes: sign * eventSize(evt)})
+}
+
+// addUsage adds delta to the usage of pubkey for kind.
+func (q *usageTracker) addUsage(pubkey string, kind int, delta quotaUsage) {
+	if q.db != nil {
+		query := `INSERT INTO quota_usage (pubkey, kind, events, bytes) VALUES (?, ?, ?, ?)
+      ON CONFLICT (pubkey, kind) DO UPDATE SET events = quota_usage.events + excluded.events, bytes = quota_usage.bytes + excluded.bytes`
+		if q.db.DriverName() == "mysql" {
+			query = `INSERT INTO quota_usage (pubkey, kind, events, bytes) VALUES (?, ?, ?, ?)
+      ON DUPLICATE KEY UPDATE events = events + VALUES(events), bytes = bytes + VALUES(bytes)`
+		}
+		if _, err := q.db.Exec(q.db.Rebind(query), pubkey, kind, delta.events, delta.bytes); err != nil {
+			slog.Error("failed to update quota usage", "pubkey", pubkey, "kind", kind, "error", err)
+		}
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		q.usage = make(map[string]map[int]quotaUsage)
+	}
+	kinds := q.usage[pubkey]
+	if kinds == nil {
+		kinds = make(map[int]quotaUsage)
+		q.usage[pubkey] = kinds
+	}
+	u := kinds[kind]
+	u.events += delta.events
+	u.bytes += delta.bytes
+	if u.events <= 0 {
+		delete(kinds, kind)
+		if len(kinds) == 0 {
+			delete(q.usage, pubkey)
+		}
+		return
+	}
+	kinds[kind] = u
+}
+
+func (q *usageTracker) saved(evt *nostr.Event) {
+	if !q.scanned.Load() {
+		q.mu.Lock()
+		if q.savedDuringScan == nil {
+			q.savedDuringScan = make(map[string]struct{})
+		}
+		q.savedDuringScan[evt.ID] = struct{}{}
+		q.mu.Unlock()
+	}
+	q.add(evt, 1)
+}
+
+func (q *usageTracker) deleted(evt *nostr.Event) { q.add(evt, -1) }
+
+// scannedEvents adds up the events found by walking the store, leaving out those
+// counted as they were saved.
+func (q *usageTracker) scannedEvents(events []*nostr.Event) {
+	type key struct {
+		pubkey string
+		kind   int
+	}
+	found := map[key]quotaUsage{}
+	q.mu.Lock()
+	for _, evt := range events {
+		if _, counted := q.savedDuringScan[evt.ID]; counted {
+			continue
+		}
+		u := found[key{evt.PubKey, evt.Kind}]
+		u.events++
+		u.bytes += eventSize(evt)
+		found[key{evt.PubKey, evt.Kind}] = u
+	}
+	q.mu.Unlock()
+	for k, u := range found {
+		q.addUsage(k.pubkey, k.kind, u)
+	}
+}
+
+// used returns the usage of pubkey across the kinds in ranges.
+func (q *usageTracker) used(ctx context.Context, pubkey string, ranges kindRanges) (quotaUsage, error) {
+	var total quotaUsage
+	if q.db != nil {
+		query := `SELECT coalesce(sum(events), 0), coalesce(sum(bytes), 0) FROM quota_usage WHERE pubkey = ?`
+		args := []any{pubkey}
+		if len(ranges) > 0 {
+			var kinds []string
+			for _, k := range ranges {
+				kinds = append(kinds, `kind BETWEEN ? AND ?`)
+				args = append(args, k[0], k[1])
+			}
+			query += ` AND (` + strings.Join(kinds, ` OR `) + `)`
+		}
+		err := q.db.QueryRowContext(ctx, q.db.Rebind(query), args...).Scan(&total.events, &total.bytes)
+		return total, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for kind, u := range q.usage[pubkey] {
+		if ranges.contains(kind) {
+			total.events += u.events
+			total.bytes += u.bytes
+		}
+	}
+	return total, nil
+}
+
+// exceedsQuota reports whether storing evt would take its author over one of
+// the quota rules. Replaceable events are always let through, as they take the
+// place of the version already stored, and addressable events that take the
+// place of one count only for the bytes they add.
+func (r *Relay) exceedsQuota(ctx context.Context, evt *nostr.Event) (bool, error) {
+	quotas := r.quotaRules()
+	if len(quotas) == 0 || nostr.IsReplaceableKind(evt.Kind) || nostr.IsEphemeralKind(evt.Kind) {
+		return false, nil
+	}
+	added := quotaUsage{events: 1, bytes: eventSize(evt)}
+	if nostr.IsAddressableKind(evt.Kind) {
+		previous, err := queryAll(ctx, r.Storage(ctx), nostr.Filter{
+			Kinds:   []int{evt.Kind},
+			Authors: []string{evt.PubKey},
+			Tags:    nostr.TagMap{"d": []string{evt.Tags.GetD()}},
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, p := range previous {
+			added.events--
+			added.bytes -= eventSize(p)
+		}
+	}
+	for _, rule := range quotaRulesFor(quotas, evt) {
+		used, err := r.usage.used(ctx, evt.PubKey, rule.kinds)
+		if err != nil {
+			return false, err
+		}
+		if rule.maxEvents > 0 && added.events > 0 && used.events+added.events > rule.maxEvents {
+			return true, nil
+		}
+		if rule.maxBytes > 0 && added.bytes > 0 && used.bytes+added.bytes > rule.maxBytes {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// quotaRules returns the quota rules in effect.
+func (r *Relay) quotaRules() []quotaRule {
+	if rules := r.quotas.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+// setQuotas puts the quota rules of spec in effect. The configuration file
+// may change them while the relay runs, which is how limits are raised for
+// individual pubkeys without a restart.
+func (r *Relay) setQuotas(spec string) error {
+	rules, err := parseQuotas(spec)
+	if err != nil {
+		return err
+	}
+	r.quotas.Store(&rules)
+	return nil
+}
+
+// tracksUsage reports whether the usage of every pubkey is kept in r.usage:
+// always for SQL backends, which keep it in a table the instances share, and
+// for the others too, but for OpenSearch, which aggregates the statistics by
+// itself, only if there are quotas.
+func (r *Relay) tracksUsage() bool {
+	return r.DB() != nil || len(r.quotaRules()) > 0 || r.driverName != "opensearch"
+}
+
+// scanUsage adds up the usage of the events already in the store, unless it
+// is known already. Until it is done, pubkeys may store more than their quotas
+// allow.
+func (r *Relay) scanUsage(ctx context.Context) {
+	if r.usage.scanned.Load() {
+		return
+	}
+	store := r.Storage(ctx).(*relayStore)
+	err := walkEvents(ctx, store.Store, nostr.Filter{}, relayLimitationDocument.MaxLimit, func(events []*nostr.Event, _ nostr.Timestamp) error {
+		r.usage.scannedEvents(events)
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to scan the usage of the stored events", "error", err)
+		return
+	}
+	r.usage.scanned.Store(true)
+	r.usage.mu.Lock()
+	r.usage.savedDuringScan = nil
+	r.usage.mu.Unlock()
+}
+
+// totals returns the number of events by kind and the number of authors.
+func (q *usageTracker) totals() (kinds map[int]int64, authors int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kinds = map[int]int64{}
+	for _, byKind := range q.usage {
+		for kind, u := range byKind {
+			kinds[kind] += u.events
+		}
+	}
+	return kinds, int64(len(q.usage))
+}
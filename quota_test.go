@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseQuotas(t *testing.T) {
+	author := bytes32Hex(0xaa)
+	rules, err := parseQuotas("*:100:1M; 1,7:10:0 ;*:1000:1g:" + author)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(rules) != 3 || rules[0].maxBytes != 1<<20 || rules[1].maxEvents != 10 || rules[2].maxBytes != 1<<30 || rules[2].author != author {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	applied := quotaRulesFor(rules, &nostr.Event{PubKey: author, Kind: 1})
+	if len(applied) != 2 || applied[0] != &rules[1] || applied[1] != &rules[2] {
+		t.Fatalf("expected the author rule to replace the general one, got %v", applied)
+	}
+
+	for _, spec := range []string{"*:1", "*:x:0", "*:1:1T", "*:-1:0", "*:1:0:nobody"} {
+		if _, err := parseQuotas(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx)
+	store.Init()
+	r.ready()
+
+	// saved before the scan, so only the scan can count it
+	first := signedEvent(t, bytes32Hex(0x11), 1, "one")
+	store.SaveEvent(ctx, first)
+
+	vip, _ := nostr.GetPublicKey(bytes32Hex(0x22))
+	var err error
+	err = r.setQuotas("1:2:0;1:3:0:" + vip)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	// saved while the scan runs, so the scan must not count it again
+	second := signedEvent(t, bytes32Hex(0x11), 1, "two")
+	store.SaveEvent(ctx, second)
+	r.scanUsage(ctx)
+
+	third := signedEvent(t, bytes32Hex(0x11), 1, "three")
+	if accepted, msg := r.AcceptEvent(ctx, third); accepted || msg != "blocked: quota exceeded" {
+		t.Fatalf("expected the third note to exceed the quota, got %v %q", accepted, msg)
+	}
+	if accepted, _ := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x11), 7, "+")); !accepted {
+		t.Fatal("expected kinds outside the quota to be accepted")
+	}
+
+	store.DeleteEvent(ctx, first)
+	if accepted, _ := r.AcceptEvent(ctx, third); !accepted {
+		t.Fatal("expected deleting a note to free up the quota")
+	}
+
+	for i := range 3 {
+		evt := signedEvent(t, bytes32Hex(0x22), 1, fmt.Sprint("vip ", i))
+		if accepted, _ := r.AcceptEvent(ctx, evt); !accepted {
+			t.Fatalf("expected the raised quota to accept note %d", i+1)
+		}
+		store.SaveEvent(ctx, evt)
+	}
+	if accepted, _ := r.AcceptEvent(ctx, signedEvent(t, bytes32Hex(0x22), 1, "vip")); accepted {
+		t.Fatal("expected the raised quota to be enforced too")
+	}
+
+	profile := signedEvent(t, bytes32Hex(0x33), 0, "{}")
+	store.ReplaceEvent(ctx, profile)
+	newer := signedEvent(t, bytes32Hex(0x33), 0, `{"name":"x"}`)
+	newer.CreatedAt++
+	newer.Sign(bytes32Hex(0x33))
+	store.ReplaceEvent(ctx, newer)
+	if used, _ := r.usage.used(ctx, newer.PubKey, nil); used.events != 1 || used.bytes != eventSize(newer) {
+		t.Fatalf("expected replacing to count only the newest version, got %+v", used)
+	}
+}
+
+func TestQuotaSharedThroughDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shared.sqlite")
+	quotas, err := parseQuotas("1,30000-39999:2:0")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	instances := make([]*Relay, 2)
+	for i := range instances {
+		r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: path}}
+		r.quotas.Store(&quotas)
+		if err := r.Storage(ctx).Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Storage(ctx).Close()
+		r.ready()
+		instances[i] = r
+	}
+
+	secret := bytes32Hex(0x11)
+	article := signedEvent(t, secret, 30023, "draft")
+	article.Tags = nostr.Tags{{"d", "post"}}
+	article.Sign(secret)
+	note := signedEvent(t, secret, 1, "one")
+	for _, evt := range []*nostr.Event{note, article} {
+		if accepted, msg := instances[0].AcceptEvent(ctx, evt); !accepted {
+			t.Fatalf("expected %d to be accepted, got %q", evt.Kind, msg)
+		}
+		instances[0].Storage(ctx).SaveEvent(ctx, evt)
+	}
+	if used, _ := instances[1].usage.used(ctx, article.PubKey, quotas[0].kinds); used.events != 2 || used.bytes != eventSize(note)+eventSize(article) {
+		t.Fatalf("expected the other instance to see the usage, got %+v", used)
+	}
+	if accepted, _ := instances[1].AcceptEvent(ctx, signedEvent(t, secret, 1, "two")); accepted {
+		t.Fatal("expected the other instance to enforce the shared quota")
+	}
+
+	edited := signedEvent(t, secret, 30023, "final")
+	edited.Tags = nostr.Tags{{"d", "post"}}
+	edited.CreatedAt++
+	edited.Sign(secret)
+	if accepted, msg := instances[1].AcceptEvent(ctx, edited); !accepted {
+		t.Fatalf("expected an edit of an addressable event to replace it within the quota, got %q", msg)
+	}
+	another := signedEvent(t, secret, 30023, "other")
+	another.Tags = nostr.Tags{{"d", "other"}}
+	another.Sign(secret)
+	if accepted, _ := instances[1].AcceptEvent(ctx, another); accepted {
+		t.Fatal("expected a new addressable event to count against the quota")
+	}
+
+	// a database from before the usage was kept is added up once
+	if _, err := instances[0].DB().Exec(`DROP TABLE quota_usage`); err != nil {
+		t.Fatal(err)
+	}
+	r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: path}}
+	r.quotas.Store(&quotas)
+	if err := r.Storage(ctx).Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Storage(ctx).Close()
+	r.ready()
+	r.scanUsage(ctx)
+	if used, _ := r.usage.used(ctx, article.PubKey, quotas[0].kinds); used.events != 2 || used.bytes != eventSize(note)+eventSize(article) {
+		t.Fatalf("expected the stored events to be added up, got %+v", used)
+	}
+}
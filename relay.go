@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
 	"net/http"
-	"net/url"
-	"os"
+	"net/netip"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
 	"github.com/fiatjaf/eventstore/mysql"
 	"github.com/fiatjaf/eventstore/opensearch"
 	"github.com/fiatjaf/eventstore/postgresql"
@@ -21,10 +27,14 @@ import (
 	"github.com/fiatjaf/eventstore/turso"
 	"github.com/fiatjaf/relayer/v2"
 	"github.com/jmoiron/sqlx"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/nbd-wtf/go-nostr/nip70"
+	"github.com/opensearch-project/opensearch-go/v4/opensearchapi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Relay struct {
@@ -34,17 +44,71 @@ type Relay struct {
 	postgresStorage   *postgresql.PostgresBackend
 	mysqlStorage      *mysql.MySQLBackend
 	opensearchStorage *opensearch.OpensearchStorage
+	lmdbStorage       *lmdb.LMDBBackend
+	badgerStorage     *badger.BadgerBackend
+	memoryStorage     *memoryStore
 	storeWithHooks    *relayStore
 	customSearchURL   string
+	searchGuard       searchGuard
+	searchTokenizer   string
 	initStoreOnce     sync.Once
 
-	serviceURL string
-	lists      atomic.Pointer[relayLists]
+	serviceURL    string
+	adminPubkeys  map[string]struct{}
+	adminToken    string
+	reportPolicy  *reportPolicy
+	notifier      *notifyQueue
+	moderationMu  sync.Mutex
+	listStore     listStore
+	lists         atomic.Pointer[relayLists]
+	listsMu       sync.Mutex
+	reaper        expirationReaper
+	retention     []retentionRule
+	quotas        atomic.Pointer[[]quotaRule]
+	usage         usageTracker
+	bus           eventBus
+	busSeen       recentIDs
+	busEvents     chan nostr.Event
+	busEventsOnce sync.Once
+	replica       *readReplica
+	config        atomic.Pointer[relayConfig]
+	started       time.Time
+	stats         atomic.Pointer[eventStats]
+	opensearch    *opensearchapi.Client
+
+	// trustedProxies are believed about the client address they forward
+	trustedProxies []netip.Prefix
+
+	subscriptions subscriptionSet
+	reqSpans      reqSpans
+	tasks         taskGroup
 }
 
+// relayLists are the lists of listColumns, the bans and the actions taken on
+// reports as loaded from the listStore. They are replaced as a whole when they
+// change, never modified in place.
 type relayLists struct {
-	allowlist map[string]struct{}
-	blocklist map[string]struct{}
+	allowlist     map[string]struct{}
+	blocklist     map[string]struct{}
+	kindAllowlist map[string]struct{}
+	bans          *banSet
+	moderation    *moderationState
+	// info holds the NIP-11 fields changed through the management API
+	info map[string]string
+}
+
+// list returns the field holding the entries of the named list.
+func (l *relayLists) list(name string) *map[string]struct{} {
+	switch name {
+	case "allowlist":
+		return &l.allowlist
+	case "blocklist":
+		return &l.blocklist
+	case "kindallowlist":
+		return &l.kindAllowlist
+	default:
+		panic("unknown list: " + name)
+	}
 }
 
 func (r *Relay) Name() string {
@@ -61,7 +125,7 @@ func (r *Relay) DB() *sqlx.DB {
 		return r.postgresStorage.DB
 	case "mysql":
 		return r.mysqlStorage.DB
-	case "opensearch":
+	case "opensearch", "lmdb", "badger", "memory":
 		return nil
 	default:
 		panic("unsupported backend driver")
@@ -86,22 +150,145 @@ func (r *Relay) Storage(ctx context.Context) eventstore.Store {
 			baseStore = r.mysqlStorage
 		case "opensearch":
 			baseStore = r.opensearchStorage
+		case "lmdb":
+			baseStore = r.lmdbStorage
+		case "badger":
+			baseStore = r.badgerStorage
+		case "memory":
+			baseStore = r.memoryStorage
 		default:
 			panic("unsupported backend driver")
 		}
 
-		r.storeWithHooks = &relayStore{Store: baseStore}
+		r.storeWithHooks = &relayStore{Store: baseStore, relay: r}
+		if r.driverName == "memory" {
+			r.memoryStorage.evicted = r.storeWithHooks.evicted
+		}
 	})
 	return r.storeWithHooks
 }
 
-// relayStore wraps eventstore.Store and implements AdvancedSaver with pushover notification.
+// relayStore wraps eventstore.Store and implements AdvancedSaver, queueing
+// notifications and report moderation after saves. Ephemeral events are not
+// saved; AcceptEvent queues their notifications.
 type relayStore struct {
 	eventstore.Store
+	relay  *Relay
+	search fullTextSearcher
+	nip05  nip05Cache
 }
 
 func (s *relayStore) BeforeSave(ctx context.Context, evt *nostr.Event) {}
 
+// tracksUsage reports whether saves and deletes have to be counted in the usage
+// of their authors.
+func (s *relayStore) tracksUsage() bool {
+	return s.relay != nil && s.relay.tracksUsage()
+}
+
+// begin counts a write in so that the storage is not closed under it. It
+// reports false once the relay is shutting down.
+func (s *relayStore) begin() bool {
+	return s.relay == nil || s.relay.tasks.add()
+}
+
+func (s *relayStore) end() {
+	if s.relay != nil {
+		s.relay.tasks.done()
+	}
+}
+
+// spawn runs f in the background, where shutdown waits for it.
+func (s *relayStore) spawn(f func()) {
+	if s.relay == nil {
+		go f()
+		return
+	}
+	s.relay.tasks.spawn(f)
+}
+
+func (s *relayStore) SaveEvent(ctx context.Context, evt *nostr.Event) (err error) {
+	if !s.begin() {
+		return errShuttingDown
+	}
+	defer s.end()
+	ctx, span := tracer().Start(ctx, "relayStore.SaveEvent", trace.WithAttributes(eventAttributes(evt)...))
+	defer func() { endSpan(span, err) }()
+
+	if err := s.Store.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+	if s.tracksUsage() {
+		s.relay.usage.saved(evt)
+	}
+	return nil
+}
+
+// ReplaceEvent looks up the versions evt replaces first so that the usage of
+// their author can be updated.
+func (s *relayStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) (err error) {
+	if !s.begin() {
+		return errShuttingDown
+	}
+	defer s.end()
+	ctx, span := tracer().Start(ctx, "relayStore.ReplaceEvent", trace.WithAttributes(eventAttributes(evt)...))
+	defer func() { endSpan(span, err) }()
+
+	if !s.tracksUsage() {
+		return s.Store.ReplaceEvent(ctx, evt)
+	}
+
+	filter := nostr.Filter{Kinds: []int{evt.Kind}, Authors: []string{evt.PubKey}}
+	if nostr.IsAddressableKind(evt.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{evt.Tags.GetD()}}
+	}
+	previous, err := queryAll(ctx, s.Store, filter)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.ReplaceEvent(ctx, evt); err != nil {
+		return err
+	}
+	for _, p := range previous {
+		if compareNewestFirst(p, evt) <= 0 {
+			// evt is not newer, so it was not stored
+			return nil
+		}
+	}
+	for _, p := range previous {
+		s.relay.usage.deleted(p)
+	}
+	s.relay.usage.saved(evt)
+	return nil
+}
+
+// evicted does the bookkeeping of DeleteEvent for an event the memory store
+// evicted by itself, and unindexes its expiration.
+func (s *relayStore) evicted(evt *nostr.Event) {
+	if s.tracksUsage() {
+		s.relay.usage.deleted(evt)
+	}
+	if s.relay.reaper.index != nil {
+		if err := s.relay.reaper.index.remove([]string{evt.ID}); err != nil {
+			slog.Error("failed to unindex evicted event", "id", evt.ID, "error", err)
+		}
+	}
+}
+
+func (s *relayStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	if !s.begin() {
+		return errShuttingDown
+	}
+	defer s.end()
+	if err := s.Store.DeleteEvent(ctx, evt); err != nil {
+		return err
+	}
+	if s.tracksUsage() {
+		s.relay.usage.deleted(evt)
+	}
+	return nil
+}
+
 // sanitizeFilter reconciles empty tag sets, which the underlying backends reject
 // as errors, with go-nostr's Filter.Matches semantics:
 //
@@ -137,102 +324,385 @@ func sanitizeFilter(filter nostr.Filter) (nostr.Filter, bool) {
 
 // QueryEvents applies sanitizeFilter so an unsatisfiable tag filter yields an empty
 // result set instead of letting the backend fail the query with "empty tag set".
+//
+// NIP-50 filters carrying a search term are handled by querySearch.
 func (s *relayStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	start := time.Now()
+	if s.relay != nil {
+		if req, ok := s.relay.reqSpans.take(ctx, filter); ok {
+			ctx = trace.ContextWithSpanContext(ctx, req)
+		}
+	}
+	ctx, span := tracer().Start(ctx, "relayStore.QueryEvents")
 	filter, unsatisfiable := sanitizeFilter(filter)
+	span.SetAttributes(filterAttributes(filter)...)
 	if unsatisfiable {
+		span.SetAttributes(attribute.Bool("nostr.filter.unsatisfiable", true))
+		span.End()
 		ch := make(chan *nostr.Event)
 		close(ch)
 		return ch, nil
 	}
-	return s.Store.QueryEvents(ctx, filter)
+	if filter.Search != "" {
+		q := parseSearchQuery(filter.Search)
+		var ch chan *nostr.Event
+		var err error
+		if q.Language != "" || q.Domain != "" {
+			ch, err = s.refineSearch(ctx, filter, q)
+		} else {
+			ch, err = s.querySearch(ctx, filter, q)
+		}
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		return observeQuery(ctx, ch, s.backend(), "search", start, span), nil
+	}
+	ch, err := s.queryReader(ctx, filter)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return observeQuery(ctx, ch, s.backend(), "query", start, span), nil
+}
+
+// backend names the driver behind s in metrics and traces.
+func (s *relayStore) backend() string {
+	if s.relay == nil {
+		return "unknown"
+	}
+	return s.relay.driverName
+}
+
+// queryReader sends a query to the read replica when there is one keeping up,
+// and to the primary if the replica fails it.
+func (s *relayStore) queryReader(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	reader := s.reader()
+	ch, err := s.queryBackend(ctx, reader, filter)
+	if err != nil && reader != s.Store {
+		slog.Warn("read replica query failed; falling back to primary", "error", err)
+		return s.queryBackend(ctx, s.Store, filter)
+	}
+	return ch, err
+}
+
+// queryBackend starts a query on store, the primary or the replica, tracing
+// the call. The span ends once the backend has run the query, before its
+// events are read.
+func (s *relayStore) queryBackend(ctx context.Context, store eventstore.Store, filter nostr.Filter) (chan *nostr.Event, error) {
+	ctx, span := tracer().Start(ctx, s.backend()+".QueryEvents", trace.WithAttributes(
+		attribute.String("db.system", s.backend()),
+		attribute.Bool("db.replica", store != s.Store),
+	))
+	ch, err := store.QueryEvents(ctx, filter)
+	endSpan(span, err)
+	return ch, err
+}
+
+// querySearch sends a NIP-50 query to the custom search endpoint when one is
+// configured, and otherwise to the full-text index of the backend if it has
+// one. If either fails, the query falls back to the next one and finally to
+// the backend so clients still get whatever the backend can answer. The
+// backend only understands plain text, so it is given the search string
+// without its extensions.
+func (s *relayStore) querySearch(ctx context.Context, filter nostr.Filter, q searchQuery) (chan *nostr.Event, error) {
+	if s.relay != nil && s.relay.customSearchURL != "" {
+		start := time.Now()
+		ch, err := s.relay.performCustomSearch(ctx, q, filter)
+		customSearchDuration.Observe(time.Since(start).Seconds())
+		if err == nil {
+			return ch, nil
+		}
+		customSearchErrors.Inc()
+		slog.Warn("custom search failed; falling back to backend", "error", err)
+	}
+	if s.search != nil {
+		searchCtx, span := tracer().Start(ctx, "fullTextSearch")
+		ch, err := s.search.searchEvents(searchCtx, filter, q)
+		endSpan(span, err)
+		if err == nil {
+			return ch, nil
+		}
+		if !errors.Is(err, errSearchUnsupported) {
+			slog.Warn("full-text search failed; falling back to backend", "error", err)
+		}
+	}
+	filter.Search = q.Text
+	return s.queryReader(ctx, filter)
+}
+
+// maxRefinedSearchPages is the most pages of results a search with language:
+// or domain: looks through for as many events as it asks for.
+const maxRefinedSearchPages = 5
+
+// refineSearch answers a search with the language: and domain: extensions of
+// q, which no search understands. It asks for as many events as the backends
+// return at a time and drops those that do not satisfy the extensions. When
+// that leaves fewer than the filter asks for and the results come newest
+// first, it asks for the page before, up to maxRefinedSearchPages.
+func (s *relayStore) refineSearch(ctx context.Context, filter nostr.Filter, q searchQuery) (chan *nostr.Event, error) {
+	limit := filter.Limit
+	if limit < 1 || limit > relayLimitationDocument.MaxLimit {
+		limit = relayLimitationDocument.MaxLimit
+	}
+	page := filter
+	page.Limit = relayLimitationDocument.MaxLimit
+	ch, err := s.querySearch(ctx, page, q)
+	if err != nil {
+		return nil, err
+	}
+
+	refined := make(chan *nostr.Event)
+	go func() {
+		defer close(refined)
+		defer func() {
+			for range ch {
+			}
+		}()
+		sent := 0
+		for pages := 1; ; pages++ {
+			n := 0
+			var oldest nostr.Timestamp
+			for evt := range ch {
+				if n == 0 || evt.CreatedAt < oldest {
+					oldest = evt.CreatedAt
+				}
+				n++
+				if sent == limit || !s.refines(evt, q) {
+					continue
+				}
+				select {
+				case refined <- evt:
+					sent++
+				case <-ctx.Done():
+					return
+				}
+			}
+			if sent == limit || n < page.Limit || q.Sort != searchSortRecent || pages == maxRefinedSearchPages {
+				return
+			}
+			until := oldest - 1
+			if page.Since != nil && until < *page.Since {
+				return
+			}
+			page.Until = &until
+			next, err := s.querySearch(ctx, page, q)
+			if err != nil {
+				slog.Warn("failed to query the next page of a search", "error", err)
+				return
+			}
+			ch = next
+		}
+	}()
+	return refined, nil
+}
+
+// refines reports whether evt satisfies the language: and domain: extensions
+// of q. Authors whose NIP-05 address has not been verified yet do not.
+func (s *relayStore) refines(evt *nostr.Event, q searchQuery) bool {
+	if !q.matchesLanguage(evt) {
+		return false
+	}
+	if q.Domain == "" {
+		return true
+	}
+	domain, _ := s.nip05.domainOf(s.Store, evt.PubKey, s.spawn)
+	return domain == q.Domain
 }
 
 // CountEvents implements NIP-45 COUNT and applies the same empty-tag-set handling
 // as QueryEvents. Wrapping the backend in relayStore hides the underlying
 // eventstore.Counter, so we re-expose it here and delegate to the backend.
+// Expired events that the reaper has not deleted yet are not counted.
 func (s *relayStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if !isInternalQuery(ctx) {
+		start := time.Now()
+		defer func() {
+			queryDuration.WithLabelValues(s.backend(), "count").Observe(time.Since(start).Seconds())
+		}()
+	}
 	filter, unsatisfiable := sanitizeFilter(filter)
 	if unsatisfiable {
 		return 0, nil
 	}
-	if counter, ok := s.Store.(eventstore.Counter); ok {
-		return counter.CountEvents(ctx, filter)
+	count, err := s.countStored(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := s.countExpired(ctx, filter)
+	if err != nil {
+		return 0, err
 	}
-	return 0, fmt.Errorf("counting is not supported by this backend")
+	return count - expired, nil
 }
 
-func (s *relayStore) AfterSave(evt *nostr.Event) {
-	// NIP-56: Reporting (kind 1984)
-	if evt.Kind != 1984 {
-		return
+func (s *relayStore) countStored(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if _, ok := s.Store.(*lmdb.LMDBBackend); ok {
+		// LMDBBackend.CountEvents never advances its cursor when the filter
+		// needs no per-event check, so it would spin forever.
+		return countByQuery(ctx, s.Store, filter, relayLimitationDocument.MaxLimit)
 	}
+	reader := s.reader()
+	count, err := s.countBackend(ctx, reader, filter)
+	if err != nil && reader != s.Store {
+		slog.Warn("read replica count failed; falling back to primary", "error", err)
+		return s.countBackend(ctx, s.Store, filter)
+	}
+	return count, err
+}
 
-	pushoverToken := os.Getenv("PUSHOVER_TOKEN")
-	pushoverUser := os.Getenv("PUSHOVER_USER")
-	if pushoverToken == "" || pushoverUser == "" {
-		return
+// countBackend counts on store, the primary or the replica, tracing the call.
+func (s *relayStore) countBackend(ctx context.Context, store eventstore.Store, filter nostr.Filter) (count int64, err error) {
+	counter, ok := store.(eventstore.Counter)
+	if !ok {
+		return 0, fmt.Errorf("counting is not supported by this backend")
 	}
+	ctx, span := tracer().Start(ctx, s.backend()+".CountEvents", trace.WithAttributes(
+		attribute.String("db.system", s.backend()),
+		attribute.Bool("db.replica", store != s.Store),
+	))
+	defer func() { endSpan(span, err) }()
+	return counter.CountEvents(ctx, filter)
+}
 
-	var reportedPubkey, reportedEvent, reportType string
-	for _, tag := range evt.Tags {
-		if len(tag) >= 2 {
-			switch tag[0] {
-			case "p":
-				reportedPubkey = tag[1]
-				if len(tag) >= 3 {
-					reportType = tag[2]
-				}
-			case "e":
-				reportedEvent = tag[1]
-				if len(tag) >= 3 {
-					reportType = tag[2]
-				}
+// countByQuery counts the events matching filter by paging through the results
+// of QueryEvents, newest first, pageSize events at a time. Events sharing the
+// created_at of a page boundary are remembered so they are not counted twice;
+// only more than pageSize events with the same created_at are undercounted.
+func countByQuery(ctx context.Context, store eventstore.Store, filter nostr.Filter, pageSize int) (int64, error) {
+	var count int64
+	seen := make(map[string]struct{})
+	filter.Limit = pageSize
+	for {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+
+		n, added := 0, 0
+		var oldest nostr.Timestamp
+		boundary := make(map[string]struct{})
+		for evt := range ch {
+			n++
+			if n == 1 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+				clear(boundary)
+			}
+			if evt.CreatedAt == oldest {
+				boundary[evt.ID] = struct{}{}
+			}
+			if _, ok := seen[evt.ID]; ok {
+				continue
 			}
+			count++
+			added++
 		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if n < pageSize {
+			return count, nil
+		}
+
+		until := oldest
+		if added == 0 {
+			// the whole page shares one created_at and has been counted
+			// already; step past it, missing any events beyond the page
+			if oldest == 0 {
+				return count, nil
+			}
+			until--
+			clear(boundary)
+		}
+		filter.Until = &until
+		seen = boundary
 	}
+}
 
-	message := fmt.Sprintf("Reporter: %s\nType: %s\nPubkey: %s\nEvent: %s\n%s",
-		evt.PubKey, reportType, reportedPubkey, reportedEvent, evt.Content)
+func (s *relayStore) AfterSave(evt *nostr.Event) {
+	if s.relay == nil {
+		return
+	}
+	s.relay.reaper.track(evt)
+	s.relay.publishToBus(evt)
+	s.relay.notifier.enqueue(evt)
 
-	go func() {
-		form := url.Values{}
-		form.Set("token", pushoverToken)
-		form.Set("user", pushoverUser)
-		form.Set("title", "Nostr Report (kind 1984)")
-		form.Set("message", message)
+	// NIP-56: Reporting (kind 1984)
+	if evt.Kind == 1984 && s.relay.reportPolicy != nil {
+		// counted on the primary, where evt has just been stored
+		s.spawn(func() { s.relay.moderateReport(context.Background(), s.Store, evt) })
+	}
+}
 
-		resp, err := http.PostForm("https://api.pushover.net/1/messages.json", form)
-		if err != nil {
-			slog.Error("failed to send pushover notification", "error", err)
-			return
-		}
-		resp.Body.Close()
-		slog.Info("pushover notification sent", "status", resp.StatusCode, "reporter", evt.PubKey)
-	}()
+// customSearchRequest is the JSON body posted to the custom search endpoint.
+type customSearchRequest struct {
+	Query  searchQuery  `json:"query"`
+	Filter nostr.Filter `json:"filter"`
 }
 
-func (r *Relay) performCustomSearch(ctx context.Context, search string, filter nostr.Filter) (chan *nostr.Event, error) {
-	req, err := http.NewRequest("POST", r.customSearchURL, strings.NewReader(search))
+// performCustomSearch posts the parsed search query together with the full
+// filter to the custom search endpoint and streams back the events it returns.
+// The endpoint is not trusted to apply the filter, so the rest of it (ids,
+// kinds, authors, tags, since/until and limit) is applied here to the results.
+// Every result is also checked for a valid ID and signature, see searchGuard.
+func (r *Relay) performCustomSearch(ctx context.Context, q searchQuery, filter nostr.Filter) (_ chan *nostr.Event, err error) {
+	ctx, span := tracer().Start(ctx, "performCustomSearch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", "POST"),
+		attribute.String("url.full", r.customSearchURL),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if !r.searchGuard.allow() {
+		return nil, fmt.Errorf("custom search breaker is open")
+	}
+	body, err := json.Marshal(customSearchRequest{Query: q, Filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", r.customSearchURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("custom search returned status %d", resp.StatusCode)
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > relayLimitationDocument.MaxLimit {
+		limit = relayLimitationDocument.MaxLimit
+	}
 
 	ch := make(chan *nostr.Event)
 	go func() {
 		defer close(ch)
 		defer resp.Body.Close()
 		dec := json.NewDecoder(resp.Body)
-		for dec.More() {
+		n := 0
+		for n < limit && dec.More() {
 			var evt nostr.Event
 			if err := dec.Decode(&evt); err != nil {
 				return
 			}
-			ch <- &evt
+			if !r.searchGuard.check(&evt, filter) {
+				if !r.searchGuard.allow() {
+					return
+				}
+				continue
+			}
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+			n++
 		}
 	}()
 	return ch, nil
@@ -243,96 +713,141 @@ func (r *Relay) Init() error {
 }
 
 func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
-	if evt.CreatedAt > nostr.Now()+30*60 {
-		return false, ""
+	// reject counts evt as rejected for reason before turning it away
+	reject := func(reason, message string) (bool, string) {
+		observeEvent(evt, reason)
+		return false, message
+	}
+
+	cfg := r.currentConfig()
+	if upper := cfg.limits.CreatedAtUpperLimit; upper > 0 && int64(evt.CreatedAt) > int64(nostr.Now())+upper {
+		return reject("future", "invalid: created_at is too far in the future")
 	}
 
 	if nip70.IsProtected(*evt) {
 		pubkey, ok := relayer.GetAuthStatus(ctx)
 		if !ok {
-			return false, "auth-required: need to authenticate"
+			return reject("auth-required", "auth-required: need to authenticate")
 		}
 		if evt.PubKey != pubkey {
-			return false, "auth-required: need to authenticate"
+			return reject("auth-required", "auth-required: need to authenticate")
 		}
 	}
 
 	// NIP-26: Delegated Event Signing validation
 	if !validateDelegation(evt) {
-		return false, "invalid: malformed delegation"
+		return reject("delegation", "invalid: malformed delegation")
 	}
 
 	// NIP-65: Relay List Metadata validation
 	if evt.Kind == 10002 {
 		if !validateRelayListMetadata(evt) {
-			return false, "invalid: malformed relay list metadata"
+			return reject("relay-list", "invalid: malformed relay list metadata")
 		}
 	}
 
 	lists := r.currentLists()
 	if _, blocked := lists.blocklist[evt.PubKey]; blocked {
-		return false, ""
+		return reject("blocklist", "blocked: pubkey is banned")
+	}
+	if b, banned := lists.bans.matchEvent(evt, nostr.Now()); banned {
+		return reject("ban-"+b.Type, b.message())
+	}
+	if _, quarantined := lists.moderation.quarantine(evt); quarantined {
+		return reject("quarantine", "blocked: under review after reports")
 	}
 	if len(lists.allowlist) > 0 {
 		if _, allowed := lists.allowlist[evt.PubKey]; !allowed {
-			return false, ""
+			return reject("allowlist", "blocked: pubkey is not allowed")
+		}
+	}
+	if len(lists.kindAllowlist) > 0 {
+		if _, allowed := lists.kindAllowlist[strconv.Itoa(evt.Kind)]; !allowed {
+			return reject("kind-allowlist", "blocked: kind is not allowed")
 		}
 	}
-	if len(evt.Content) > relayLimitationDocument.MaxContentLength {
-		return false, ""
+	if limit := cfg.limits.MaxContentLength; limit > 0 && len(evt.Content) > limit {
+		return reject("content-length", fmt.Sprintf("invalid: content is longer than %d bytes", limit))
+	}
+	if exceeds, err := r.exceedsQuota(ctx, evt); err != nil {
+		slog.Error("failed to check quota", "error", err)
+		return reject("quota", "error: failed to check quota")
+	} else if exceeds {
+		return reject("quota", "blocked: quota exceeded")
 	}
 
 	slog.Debug("AcceptEvent", "event", []any{"EVENT", evt})
+	observeEvent(evt, "")
+	if nostr.IsEphemeralKind(evt.Kind) {
+		// relayer broadcasts ephemeral events right away without saving
+		// them, so AfterSave never sees them
+		r.publishToBus(evt)
+		r.notifier.enqueue(evt)
+	}
 	return true, ""
 }
 
 func (r *Relay) AcceptReq(ctx context.Context, id string, filters nostr.Filters, auth string) bool {
-	if len(filters) > 200 {
-		slog.Debug("AcceptReq", "limit", fmt.Sprintf("filters is limited as %d (but %d)", 200, len(filters)))
+	_, span := tracer().Start(ctx, "AcceptReq", trace.WithAttributes(
+		attribute.String("nostr.subscription", id),
+		attribute.Int("nostr.filters", len(filters)),
+		attribute.Bool("nostr.authed", auth != ""),
+	))
+	defer span.End()
+
+	if limit := r.currentConfig().limits.MaxFilters; len(filters) > limit {
+		slog.Debug("AcceptReq", "limit", fmt.Sprintf("filters is limited as %d (but %d)", limit, len(filters)))
+		requests.WithLabelValues("REQ", "rejected").Inc()
+		span.SetAttributes(attribute.Bool("nostr.accepted", false))
+		return false
+	}
+	if !r.subscriptions.add(ctx, id) {
+		slog.Debug("AcceptReq", "shutting-down", id)
+		// the relayer follows up with a CLOSED of its own, which clients
+		// ignore as the subscription is closed by then
+		if ws, ok := ctx.Value(relayer.AUTH_CONTEXT_KEY).(*relayer.WebSocket); ok {
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: shutdownReason})
+		}
+		requests.WithLabelValues("REQ", "rejected").Inc()
+		span.SetAttributes(attribute.Bool("nostr.accepted", false))
 		return false
 	}
+	requests.WithLabelValues("REQ", "accepted").Inc()
+	span.SetAttributes(attribute.Bool("nostr.accepted", true))
+	r.reqSpans.add(ctx, filters, span.SpanContext())
 	slog.Debug("AcceptReq", "req", []any{"REQ", id, filters})
 	return true
 }
 
-var relayLimitationDocument = &nip11.RelayLimitationDocument{
-	MaxMessageLength: 524288,
-	MaxSubscriptions: 20,    //
-	MaxLimit:         500,   //
-	MaxSubidLength:   100,   //
-	MaxEventTags:     100,   //
-	MaxContentLength: 16384, //
-	MinPowDifficulty: 0,     // No PoW requirement
-	AuthRequired:     false,
-	PaymentRequired:  false,
+// defaultLimits are the limits unless the configuration sets others.
+var defaultLimits = nip11.RelayLimitationDocument{
+	MaxMessageLength:    524288,
+	MaxSubscriptions:    20,      //
+	MaxLimit:            500,     //
+	MaxSubidLength:      100,     //
+	MaxEventTags:        100,     //
+	MaxContentLength:    16384,   //
+	MinPowDifficulty:    0,       // No PoW requirement
+	CreatedAtUpperLimit: 30 * 60, // seconds into the future
+	AuthRequired:        false,
+	PaymentRequired:     false,
 }
 
+// relayLimitationDocument holds the limits the relay was started with, which
+// the backends are configured with. Limits checked per event or request are
+// read from r.currentConfig() so that they can be reloaded.
+var relayLimitationDocument = func() *nip11.RelayLimitationDocument {
+	limits := defaultLimits
+	return &limits
+}()
+
 func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
-	info := nip11.RelayInformationDocument{
-		Name:           "nostr-relay",
-		Description:    "relay powered by the relayer framework",
-		PubKey:         "2c7cc62a697ea3a7826521f3fd34f0cb273693cbe5e9310f35449f43622a5cdc",
-		Contact:        "mattn.jp@gmail.com",
-		SupportedNIPs:  supportedNIPs,
-		Software:       "https://github.com/mattn/nostr-relay",
-		Icon:           "https://nostr.compile-error.net/logo.png",
-		Version:        version,
-		Limitation:     relayLimitationDocument,
-		RelayCountries: []string{"JP"},
-		LanguageTags:   []string{},
-		Tags:           []string{},
-		PostingPolicy:  "",
-		PaymentsURL:    "",
-		Fees: &nip11.RelayFeesDocument{
-			Admission: []struct {
-				Amount int    "json:\"amount\""
-				Unit   string "json:\"unit\""
-			}{},
-		},
-	}
-	if err := envconfig.Process("NOSTR_RELAY", &info); err != nil {
-		log.Fatalf("failed to read from env: %v", err)
+	cfg := r.currentConfig()
+	info := cfg.info
+	if cfg.path == "" {
+		applyInfo(&info, r.currentLists().info)
 	}
+	info.Retention = retentionDocument(r.retention)
 	return info
 }
 
@@ -358,85 +873,181 @@ func (r *Relay) Errorf(format string, v ...any) {
 }
 
 type Info struct {
-	Version       string `json:"version"`
-	NumEvents     int64  `json:"num_events"`
-	NumSessions   int64  `json:"num_sessions"`
-	SupportedNIPs []any  `json:"supported_nips"`
+	Version          string      `json:"version"`
+	NumEvents        int64       `json:"num_events"`
+	NumSessions      int64       `json:"num_sessions"`
+	NumSubscriptions int         `json:"num_subscriptions"`
+	Uptime           int64       `json:"uptime"`
+	SupportedNIPs    []any       `json:"supported_nips"`
+	Events           *eventStats `json:"events,omitempty"`
+	Reaper           reaperStats `json:"reaper"`
 }
 
 func (r *Relay) ready() {
-	db := r.DB()
-	if db == nil {
-		return
+	r.Storage(context.Background())
+	if r.listStore = r.newListStore(); r.listStore != nil {
+		if err := r.listStore.init(); err != nil {
+			log.Fatalf("failed to create server: %v", err)
+		}
 	}
-
-	_, err := db.Exec(`
-    CREATE TABLE IF NOT EXISTS blocklist (
-      pubkey text NOT NULL
-    );
-    `)
+	r.reaper.index = r.newExpirationIndex()
+	created, err := r.reaper.index.init()
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS allowlist (
-      pubkey text NOT NULL
-    );
-    `)
-	if err != nil {
-		log.Fatalf("failed to create server: %v", err)
+	r.reaper.created = created
+	if db := r.DB(); db != nil {
+		created, err := r.usage.init(db)
+		if err != nil {
+			log.Fatalf("failed to create server: %v", err)
+		}
+		r.usage.scanned.Store(!created)
 	}
 	r.reload()
 }
 
-func (r *Relay) reload() {
-	db := r.DB()
-	if db == nil {
-		return
+// openSearch sets up the full-text index of the SQL backends. Import leaves it
+// alone, as the index follows the events by itself once it is there.
+func (r *Relay) openSearch() {
+	switch r.driverName {
+	case "sqlite3":
+		if search := newSQLite3Search(r.DB()); search != nil {
+			search.reader = r.readDB
+			r.storeWithHooks.search = search
+		}
+	case "postgresql":
+		search, err := newPostgresSearch(r.DB(), r.searchTokenizer, false)
+		if err != nil {
+			log.Fatalf("failed to create server: %v", err)
+		}
+		search.reader = r.readDB
+		r.storeWithHooks.search = search
 	}
+}
 
-	rows, err := db.Query(`
-    SELECT pubkey FROM blocklist
-    `)
-	if err != nil {
-		log.Printf("failed to create server: %v", err)
+// newListStore returns where the allowlist and blocklist of the driver live,
+// or nil if the driver has no place for them.
+func (r *Relay) newListStore() listStore {
+	switch r.driverName {
+	case "lmdb":
+		return &fileLists{dir: r.lmdbStorage.Path}
+	case "badger":
+		return &fileLists{dir: r.badgerStorage.Path}
+	case "memory":
+		return &memoryLists{}
+	}
+	if db := r.DB(); db != nil {
+		return &sqlLists{db: db}
+	}
+	return nil
+}
+
+func (r *Relay) reload() {
+	if r.listStore == nil {
 		return
 	}
-	defer rows.Close()
 
-	blocklist := make(map[string]struct{})
-	for rows.Next() {
-		var pubkey string
-		err := rows.Scan(&pubkey)
+	r.listsMu.Lock()
+	defer r.listsMu.Unlock()
+	lists := &relayLists{}
+	for _, name := range listNames {
+		entries, err := r.listStore.load(name)
 		if err != nil {
+			log.Printf("failed to create server: %v", err)
 			return
 		}
-		blocklist[pubkey] = struct{}{}
+		*lists.list(name) = entries
 	}
-
-	rows, err = db.Query(`
-    SELECT pubkey FROM allowlist
-    `)
+	bans, err := r.loadBans()
+	if err != nil {
+		log.Printf("failed to load bans: %v", err)
+		return
+	}
+	lists.bans = newBanSet(bans, nostr.Now())
+	actions, err := r.listStore.loadActions()
 	if err != nil {
-		log.Printf("failed to create server: %v", err)
+		log.Printf("failed to load moderation actions: %v", err)
 		return
 	}
-	defer rows.Close()
+	lists.moderation = newModerationState(actions)
+	lists.info, err = r.listStore.loadInfo()
+	if err != nil {
+		log.Printf("failed to load relay information: %v", err)
+		return
+	}
+	r.lists.Store(lists)
+}
 
-	allowlist := make(map[string]struct{})
-	for rows.Next() {
-		var pubkey string
-		err := rows.Scan(&pubkey)
-		if err != nil {
-			return
+// updateLists calls change with a copy of the lists in effect. change stores
+// the change in the listStore and applies it to the copy, which then replaces
+// the lists in effect. The other instances are told to reload theirs from the
+// listStore they share.
+func (r *Relay) updateLists(change func(lists *relayLists) error) error {
+	if r.listStore == nil {
+		return fmt.Errorf("%s driver has no place for lists", r.driverName)
+	}
+
+	r.listsMu.Lock()
+	defer r.listsMu.Unlock()
+	lists := *r.currentLists()
+	if err := change(&lists); err != nil {
+		return err
+	}
+	r.lists.Store(&lists)
+	r.publishListsChanged()
+	return nil
+}
+
+// changeList adds value to list, or removes it, in the listStore and then in
+// the lists in effect.
+func (r *Relay) changeList(list, value string, add bool) error {
+	return r.updateLists(func(lists *relayLists) error { return r.changeListIn(lists, list, value, add) })
+}
+
+// changeListIn adds value to list, or removes it, in the listStore and then
+// in lists, for updateLists.
+func (r *Relay) changeListIn(lists *relayLists, list, value string, add bool) error {
+	entries := maps.Clone(*lists.list(list))
+	if entries == nil {
+		entries = make(map[string]struct{})
+	}
+	if _, ok := entries[value]; ok == add {
+		return nil
+	}
+	if add {
+		if err := r.listStore.add(list, value); err != nil {
+			return err
+		}
+		entries[value] = struct{}{}
+	} else {
+		if err := r.listStore.remove(list, value); err != nil {
+			return err
 		}
-		allowlist[pubkey] = struct{}{}
+		delete(entries, value)
 	}
+	*lists.list(list) = entries
+	return nil
+}
 
-	r.lists.Store(&relayLists{
-		allowlist: allowlist,
-		blocklist: blocklist,
-	})
+// countEvents returns the number of stored events, leaving out expired ones.
+func (r *Relay) countEvents(ctx context.Context) (int64, error) {
+	if db := r.readDB(); db != nil {
+		var count int64
+		if err := db.QueryRowContext(ctx, "select count(*) from event").Scan(&count); err != nil {
+			return 0, err
+		}
+		expired, err := r.Storage(ctx).(*relayStore).countExpired(ctx, nostr.Filter{})
+		return count - expired, err
+	}
+	// counted here rather than through CountEvents, which is what COUNT
+	// requests are measured by
+	store := r.Storage(ctx).(*relayStore)
+	count, err := store.countStored(ctx, nostr.Filter{})
+	if err != nil {
+		return 0, err
+	}
+	expired, err := store.countExpired(ctx, nostr.Filter{})
+	return count - expired, err
 }
 
 func (r *Relay) currentLists() *relayLists {
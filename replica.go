@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/mysql"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/eventstore/turso"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// poolConfig holds the connection pool settings of a SQL database.
+type poolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+}
+
+// registerFlags adds flags for the pool settings, named after prefix.
+func (p *poolConfig) registerFlags(prefix, what string) {
+	flag.IntVar(&p.maxOpenConns, prefix+"-max-open-conns", 80, "maximum number of open connections to the "+what)
+	flag.IntVar(&p.maxIdleConns, prefix+"-max-idle-conns", 10, "maximum number of idle connections to the "+what)
+	flag.DurationVar(&p.connMaxLifetime, prefix+"-conn-max-lifetime", time.Minute, "maximum time a connection to the "+what+" is reused")
+	flag.DurationVar(&p.connMaxIdleTime, prefix+"-conn-max-idle-time", 30*time.Second, "maximum time a connection to the "+what+" stays idle")
+}
+
+func (p *poolConfig) apply(db *sqlx.DB) {
+	db.SetConnMaxLifetime(p.connMaxLifetime)
+	db.SetMaxOpenConns(p.maxOpenConns)
+	db.SetMaxIdleConns(p.maxIdleConns)
+	db.SetConnMaxIdleTime(p.connMaxIdleTime)
+}
+
+// readReplica is a read-only copy of the database that queries and counts are
+// sent to while it keeps up with the primary.
+type readReplica struct {
+	store  eventstore.Store
+	db     *sqlx.DB
+	maxLag time.Duration
+
+	// lag returns how far the replica is behind the primary
+	lag func(ctx context.Context) (time.Duration, error)
+	// behind is set while the replica lags too much or cannot be reached
+	behind atomic.Bool
+}
+
+// openReplica connects to the read replica at url. It is given the same
+// settings as the primary backend, which must have been initialized. The
+// replica is not initialized itself, as it cannot create tables.
+func (r *Relay) openReplica(url string, maxLag time.Duration) (*readReplica, error) {
+	replica := &readReplica{maxLag: maxLag}
+	driver := map[string]string{"sqlite3": "sqlite3", "turso": "libsql", "postgresql": "postgres", "mysql": "mysql"}[r.driverName]
+	if driver == "" {
+		return nil, fmt.Errorf("read replicas are not supported by the %s driver", r.driverName)
+	}
+	db, err := sqlx.Connect(driver, url)
+	if err != nil {
+		return nil, err
+	}
+	db.Mapper = reflectx.NewMapperFunc("json", sqlx.NameMapper)
+	replica.db = db
+
+	switch r.driverName {
+	case "sqlite3":
+		p := r.sqlite3Storage
+		replica.store = &sqlite3.SQLite3Backend{DB: db, DatabaseURL: url, QueryLimit: p.QueryLimit, QueryIDsLimit: p.QueryIDsLimit,
+			QueryAuthorsLimit: p.QueryAuthorsLimit, QueryKindsLimit: p.QueryKindsLimit, QueryTagsLimit: p.QueryTagsLimit}
+	case "turso":
+		p := r.tursoStorage
+		replica.store = &turso.TursoBackend{DB: db, DatabaseURL: url, QueryLimit: p.QueryLimit, QueryIDsLimit: p.QueryIDsLimit,
+			QueryAuthorsLimit: p.QueryAuthorsLimit, QueryKindsLimit: p.QueryKindsLimit, QueryTagsLimit: p.QueryTagsLimit}
+	case "postgresql":
+		p := r.postgresStorage
+		replica.store = &postgresql.PostgresBackend{DB: db, DatabaseURL: url, QueryLimit: p.QueryLimit, QueryIDsLimit: p.QueryIDsLimit,
+			QueryAuthorsLimit: p.QueryAuthorsLimit, QueryKindsLimit: p.QueryKindsLimit, QueryTagsLimit: p.QueryTagsLimit,
+			KeepRecentEvents: p.KeepRecentEvents, FullTextSearchConfig: p.FullTextSearchConfig,
+			FullTextSearchMaxLength: p.FullTextSearchMaxLength, FullTextSearchColumn: p.FullTextSearchColumn}
+		replica.lag = postgresReplicaLag(db)
+	case "mysql":
+		p := r.mysqlStorage
+		replica.store = &mysql.MySQLBackend{DB: db, DatabaseURL: url, QueryLimit: p.QueryLimit, QueryIDsLimit: p.QueryIDsLimit,
+			QueryAuthorsLimit: p.QueryAuthorsLimit, QueryKindsLimit: p.QueryKindsLimit, QueryTagsLimit: p.QueryTagsLimit}
+		replica.lag = mysqlReplicaLag(db)
+	}
+	if replica.lag == nil {
+		replica.lag = func(ctx context.Context) (time.Duration, error) {
+			return 0, db.PingContext(ctx)
+		}
+	}
+	return replica, nil
+}
+
+// postgresReplicaLag measures the lag of a streaming replica by the age of the
+// last replayed transaction, unless everything received has been replayed.
+func postgresReplicaLag(db *sqlx.DB) func(context.Context) (time.Duration, error) {
+	return func(ctx context.Context) (time.Duration, error) {
+		var seconds float64
+		err := db.QueryRowContext(ctx, `
+SELECT CASE
+  WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+  ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`).Scan(&seconds)
+		return time.Duration(seconds * float64(time.Second)), err
+	}
+}
+
+// mysqlReplicaLag reads Seconds_Behind_Source, or Seconds_Behind_Master on
+// servers older than 8.0.22, from the replica status.
+func mysqlReplicaLag(db *sqlx.DB) func(context.Context) (time.Duration, error) {
+	return func(ctx context.Context) (time.Duration, error) {
+		status := map[string]any{}
+		err := db.QueryRowxContext(ctx, `SHOW REPLICA STATUS`).MapScan(status)
+		if err == sql.ErrNoRows {
+			// not a replica
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, column := range []string{"Seconds_Behind_Source", "Seconds_Behind_Master"} {
+			value, ok := status[column]
+			if !ok {
+				continue
+			}
+			b, ok := value.([]byte)
+			if !ok {
+				return 0, fmt.Errorf("replication is not running")
+			}
+			seconds, err := strconv.Atoi(string(b))
+			return time.Duration(seconds) * time.Second, err
+		}
+		return 0, fmt.Errorf("replica status has no lag")
+	}
+}
+
+// monitor checks the lag of the replica every interval until ctx is done.
+func (replica *readReplica) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		replica.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (replica *readReplica) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lag, err := replica.lag(ctx)
+	behind := err != nil || lag > replica.maxLag
+	if behind != replica.behind.Load() {
+		if behind {
+			slog.Warn("read replica is behind; reading from the primary", "lag", lag, "error", err)
+		} else {
+			slog.Info("read replica caught up", "lag", lag)
+		}
+	}
+	replica.behind.Store(behind)
+}
+
+// readDB returns the database that reads done in SQL should go to: the read
+// replica while it keeps up, and otherwise the primary.
+func (r *Relay) readDB() *sqlx.DB {
+	if r.replica != nil && !r.replica.behind.Load() {
+		return r.replica.db
+	}
+	return r.DB()
+}
+
+// searchRows runs a full-text search query on the database reader returns, or
+// on primary if reader is nil or the query fails there.
+func searchRows(ctx context.Context, primary *sqlx.DB, reader func() *sqlx.DB, query string, params []any) (*sql.Rows, error) {
+	db := primary
+	if reader != nil {
+		db = reader()
+	}
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil && db != primary {
+		slog.Warn("read replica search failed; falling back to primary", "error", err)
+		return primary.QueryContext(ctx, query, params...)
+	}
+	return rows, err
+}
+
+// reader returns where queries and counts should go.
+func (s *relayStore) reader() eventstore.Store {
+	if s.relay != nil && s.relay.replica != nil && !s.relay.replica.behind.Load() {
+		return s.relay.replica.store
+	}
+	return s.Store
+}
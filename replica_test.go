@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReadReplica(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// a separate database stands in for the replica, so that it is clear
+	// which one a query was answered from
+	replicaPath := filepath.Join(dir, "replica.sqlite")
+	seed := &sqlite3.SQLite3Backend{DatabaseURL: replicaPath}
+	if err := seed.Init(); err != nil {
+		t.Fatalf("init replica: %v", err)
+	}
+	seed.SaveEvent(ctx, signedEvent(t, bytes32Hex(0x11), 1, "replica"))
+	seed.Close()
+
+	r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(dir, "primary.sqlite")}}
+	store := r.Storage(ctx).(*relayStore)
+	if err := store.Init(); err != nil {
+		t.Fatalf("init primary: %v", err)
+	}
+	defer store.Close()
+	r.ready()
+	for i := range 2 {
+		store.SaveEvent(ctx, signedEvent(t, bytes32Hex(byte(i+1)), 1, "primary"))
+	}
+
+	replica, err := r.openReplica(replicaPath, time.Second)
+	if err != nil {
+		t.Fatalf("open replica: %v", err)
+	}
+	defer replica.db.Close()
+	r.replica = replica
+
+	count := func() int64 {
+		t.Helper()
+		n, err := store.CountEvents(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatalf("count: %v", err)
+		}
+		return n
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expected the count from the replica, got %d", n)
+	}
+	if events, _ := queryAll(ctx, store, nostr.Filter{}); len(events) != 1 || events[0].Content != "replica" {
+		t.Fatalf("expected the events of the replica, got %v", events)
+	}
+
+	replica.lag = func(context.Context) (time.Duration, error) { return time.Minute, nil }
+	replica.check(ctx)
+	if n := count(); n != 2 {
+		t.Fatalf("expected the count from the primary while the replica lags, got %d", n)
+	}
+
+	replica.lag = func(context.Context) (time.Duration, error) { return 0, nil }
+	replica.check(ctx)
+	if n := count(); n != 1 {
+		t.Fatalf("expected reads to go back to the replica, got %d", n)
+	}
+
+	replica.lag = func(context.Context) (time.Duration, error) { return 0, errors.New("unreachable") }
+	replica.check(ctx)
+	if events, _ := queryAll(ctx, store, nostr.Filter{}); len(events) != 2 {
+		t.Fatalf("expected the events of the primary while the replica is unreachable, got %d", len(events))
+	}
+}
+
+func TestOpenReplicaUnsupported(t *testing.T) {
+	r := &Relay{driverName: "badger"}
+	if _, err := r.openReplica("replica", time.Second); err == nil {
+		t.Fatal("expected read replicas to be rejected for badger")
+	}
+}
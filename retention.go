@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// kindRanges is a set of kinds given as inclusive ranges. An empty set stands
+// for every kind.
+type kindRanges [][2]int
+
+// parseKindRanges parses * or a comma separated list of kinds and ranges like
+// 30000-39999.
+func parseKindRanges(s string) (kindRanges, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return nil, nil
+	}
+	var ranges kindRanges
+	for _, k := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(k), "-")
+		if !isRange {
+			hi = lo
+		}
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min < 0 || min > max {
+			return nil, fmt.Errorf("invalid kind %q", k)
+		}
+		ranges = append(ranges, [2]int{min, max})
+	}
+	return ranges, nil
+}
+
+func (ranges kindRanges) contains(kind int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, k := range ranges {
+		if k[0] <= kind && kind <= k[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetentionFilterKinds is the largest number of kinds a retention rule
+// passes to the backend; rules covering more kinds, like whole ranges, look
+// at every old event and pick theirs out instead.
+const maxRetentionFilterKinds = 100
+
+// retentionRule deletes the events of the given kinds, optionally only those
+// of author, once they are older than maxAge. No kinds means every kind.
+type retentionRule struct {
+	kinds  kindRanges
+	author string
+	maxAge time.Duration
+}
+
+// parseRetention parses rules separated by semicolons, each in the form
+// KINDS:AGE[:AUTHOR]. KINDS is * or a comma separated list of kinds and ranges
+// like 30000-39999, AGE a Go duration that may also be given in days, like
+// 30d, and AUTHOR a hex pubkey. For example: 1:365d;7:30d;1059:7d
+func parseRetention(spec string) ([]retentionRule, error) {
+	var rules []retentionRule
+	for _, field := range strings.Split(spec, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid retention rule %q", field)
+		}
+
+		var rule retentionRule
+		var err error
+		if rule.kinds, err = parseKindRanges(parts[0]); err != nil {
+			return nil, fmt.Errorf("%w in retention rule %q", err, field)
+		}
+
+		age := strings.TrimSpace(parts[1])
+		if days, ok := strings.CutSuffix(age, "d"); ok {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, fmt.Errorf("invalid age in retention rule %q", field)
+			}
+			rule.maxAge = time.Duration(n) * 24 * time.Hour
+		} else {
+			d, err := time.ParseDuration(age)
+			if err != nil {
+				return nil, fmt.Errorf("invalid age in retention rule %q", field)
+			}
+			rule.maxAge = d
+		}
+		if rule.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid age in retention rule %q", field)
+		}
+
+		if len(parts) == 3 {
+			rule.author = strings.TrimSpace(parts[2])
+			if !nostr.IsValidPublicKey(rule.author) {
+				return nil, fmt.Errorf("invalid author in retention rule %q", field)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *retentionRule) matches(evt *nostr.Event) bool {
+	if rule.author != "" && evt.PubKey != rule.author {
+		return false
+	}
+	return rule.kinds.contains(evt.Kind)
+}
+
+// filter returns a filter for the events the rule may delete at now.
+func (rule *retentionRule) filter(now time.Time) nostr.Filter {
+	until := nostr.Timestamp(now.Add(-rule.maxAge).Unix())
+	filter := nostr.Filter{Until: &until}
+	if rule.author != "" {
+		filter.Authors = []string{rule.author}
+	}
+
+	var kinds []int
+	for _, k := range rule.kinds {
+		for kind := k[0]; kind <= k[1] && len(kinds) <= maxRetentionFilterKinds; kind++ {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) <= maxRetentionFilterKinds {
+		filter.Kinds = kinds
+	}
+	return filter
+}
+
+// retentionRuleFor returns the rule that decides how long evt is kept: the
+// first rule for its author that matches it, and otherwise the first general
+// rule that does.
+func retentionRuleFor(rules []retentionRule, evt *nostr.Event) *retentionRule {
+	var general *retentionRule
+	for i := range rules {
+		if !rules[i].matches(evt) {
+			continue
+		}
+		if rules[i].author != "" {
+			return &rules[i]
+		}
+		if general == nil {
+			general = &rules[i]
+		}
+	}
+	return general
+}
+
+// retentionDocument describes the rules for the retention field of NIP-11.
+// Rules for a single author are left out, as NIP-11 cannot express them.
+func retentionDocument(rules []retentionRule) []*nip11.RelayRetentionDocument {
+	var docs []*nip11.RelayRetentionDocument
+	for _, rule := range rules {
+		if rule.author != "" {
+			continue
+		}
+		doc := &nip11.RelayRetentionDocument{Time: int64(rule.maxAge / time.Second)}
+		for _, k := range rule.kinds {
+			doc.Kinds = append(doc.Kinds, []int{k[0], k[1]})
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// enforceRetention deletes the events outside their retention every interval
+// until ctx is done.
+func (r *Relay) enforceRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deleted, err := r.applyRetention(ctx, time.Now())
+		if err != nil {
+			slog.Error("failed to apply retention policy", "error", err)
+		}
+		if deleted > 0 {
+			slog.Info("deleted events past their retention", "count", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyRetention deletes the events that are older than the rule deciding
+// their retention allows at now, and returns how many it deleted.
+func (r *Relay) applyRetention(ctx context.Context, now time.Time) (int64, error) {
+	store := r.Storage(ctx)
+	var deleted int64
+	for i := range r.retention {
+		filter := r.retention[i].filter(now)
+		err := walkEvents(ctx, store, filter, relayLimitationDocument.MaxLimit, func(events []*nostr.Event, _ nostr.Timestamp) error {
+			for _, evt := range events {
+				rule := retentionRuleFor(r.retention, evt)
+				if rule == nil || now.Sub(evt.CreatedAt.Time()) <= rule.maxAge {
+					continue
+				}
+				if err := store.DeleteEvent(ctx, evt); err != nil {
+					return fmt.Errorf("delete event %s: %w", evt.ID, err)
+				}
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseRetention(t *testing.T) {
+	author := bytes32Hex(0xaa)
+	rules, err := parseRetention("1:365d; 6,7:30d ;30000-39999:12h:" + author + ";*:5y")
+	if err == nil {
+		t.Fatalf("expected an error for an unknown unit, got %v", rules)
+	}
+
+	rules, err = parseRetention("1:365d; 6,7:30d ;30000-39999:12h:" + author + ";*:1000d")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []retentionRule{
+		{kinds: kindRanges{{1, 1}}, maxAge: 365 * 24 * time.Hour},
+		{kinds: kindRanges{{6, 6}, {7, 7}}, maxAge: 30 * 24 * time.Hour},
+		{kinds: kindRanges{{30000, 39999}}, author: author, maxAge: 12 * time.Hour},
+		{maxAge: 1000 * 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	docs := retentionDocument(rules)
+	if len(docs) != 3 || docs[1].Time != 30*24*60*60 || !reflect.DeepEqual(docs[1].Kinds, [][]int{{6, 6}, {7, 7}}) || docs[2].Kinds != nil {
+		t.Fatalf("unexpected NIP-11 retention: %+v %+v %+v", docs[0], docs[1], docs[2])
+	}
+
+	for _, spec := range []string{"1", "x:1d", "5-2:1d", "1:0s", "1:1d:nobody"} {
+		if _, err := parseRetention(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	ctx := context.Background()
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx)
+	store.Init()
+
+	vip, _ := nostr.GetPublicKey(bytes32Hex(0x22))
+	var err error
+	r.retention, err = parseRetention("1:30d:" + vip + ";1,7:1d")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	now := time.Now()
+	event := func(secret string, kind int, age time.Duration) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: nostr.Timestamp(now.Add(-age).Unix()), Kind: kind, Content: "x"}
+		evt.Sign(secret)
+		store.SaveEvent(ctx, evt)
+		return evt
+	}
+	oldNote := event(bytes32Hex(0x11), 1, 48*time.Hour)
+	event(bytes32Hex(0x11), 7, 48*time.Hour)
+	newNote := event(bytes32Hex(0x11), 1, time.Hour)
+	vipNote := event(bytes32Hex(0x22), 1, 48*time.Hour)
+	profile := event(bytes32Hex(0x11), 0, 48*time.Hour)
+
+	deleted, err := r.applyRetention(ctx, now)
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected 2 events deleted, got %d (%v)", deleted, err)
+	}
+	events, _ := queryAll(ctx, store, nostr.Filter{})
+	var left []string
+	for _, evt := range events {
+		left = append(left, evt.ID)
+	}
+	for _, kept := range []*nostr.Event{newNote, vipNote, profile} {
+		if !slices.Contains(left, kept.ID) {
+			t.Errorf("expected event of kind %d by %s to be kept", kept.Kind, kept.PubKey)
+		}
+	}
+	if slices.Contains(left, oldNote.ID) {
+		t.Error("expected the old note to be deleted")
+	}
+}
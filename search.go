@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+// searchQuery is a NIP-50 search string split into the free text and the
+// key:value extensions the relay understands. Unknown extensions are left in
+// the text, so words such as URLs that happen to contain a colon still match.
+type searchQuery struct {
+	Text     string `json:"text"`
+	Language string `json:"language,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Sort     string `json:"sort,omitempty"`
+	// IncludeSpam is set by include:spam, which asks for spam not to be
+	// filtered out
+	IncludeSpam bool `json:"include_spam"`
+}
+
+const (
+	searchSortRelevance = "relevance"
+	searchSortRecent    = "recent"
+)
+
+func parseSearchQuery(search string) searchQuery {
+	var q searchQuery
+	var words []string
+	for _, word := range strings.Fields(search) {
+		key, value, ok := strings.Cut(word, ":")
+		if ok && value != "" {
+			value = strings.ToLower(value)
+			switch strings.ToLower(key) {
+			case "language":
+				q.Language = value
+				continue
+			case "domain":
+				q.Domain = value
+				continue
+			case "sort":
+				if value == searchSortRelevance || value == searchSortRecent {
+					q.Sort = value
+				}
+				continue
+			case "include":
+				if value == "spam" {
+					q.IncludeSpam = true
+					continue
+				}
+			}
+		}
+		words = append(words, word)
+	}
+	q.Text = strings.Join(words, " ")
+	return q
+}
+
+// matchesLanguage reports whether the event is written in q.Language. A NIP-32
+// ISO-639-1 label on the event is authoritative; otherwise the language is
+// guessed from the script, which is reliable only for Japanese, Korean and
+// Chinese, so any other language matches every event not written in those.
+func (q searchQuery) matchesLanguage(evt *nostr.Event) bool {
+	if q.Language == "" {
+		return true
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 3 && tag[0] == "l" && tag[2] == "ISO-639-1" {
+			return strings.EqualFold(tag[1], q.Language)
+		}
+	}
+
+	var kana, han, hangul bool
+	for _, c := range evt.Content {
+		switch {
+		case unicode.In(c, unicode.Hiragana, unicode.Katakana):
+			kana = true
+		case unicode.Is(unicode.Han, c):
+			han = true
+		case unicode.Is(unicode.Hangul, c):
+			hangul = true
+		}
+	}
+	switch q.Language {
+	case "ja":
+		return kana
+	case "ko":
+		return hangul
+	case "zh":
+		return han && !kana
+	default:
+		return !kana && !han && !hangul
+	}
+}
+
+// fullTextSearcher answers NIP-50 queries from the relay's own database
+// instead of the backend's plain substring match. The filter carries the
+// original search string; q is what the searcher should match and how it
+// should order the results.
+type fullTextSearcher interface {
+	searchEvents(ctx context.Context, filter nostr.Filter, q searchQuery) (chan *nostr.Event, error)
+}
+
+// errSearchUnsupported is returned by a fullTextSearcher for search strings it
+// cannot answer; the query then goes to the backend as usual.
+var errSearchUnsupported = errors.New("search is not supported by the full-text index")
+
+const (
+	// searchBreakerWindow is the number of verified events after which the
+	// failure rate of the custom search endpoint is evaluated.
+	searchBreakerWindow = 50
+	// searchBreakerThreshold is the failure rate that trips the breaker.
+	searchBreakerThreshold = 0.2
+	// searchBreakerCooldown is how long the custom search endpoint is skipped
+	// once the breaker has tripped.
+	searchBreakerCooldown = 5 * time.Minute
+)
+
+// searchGuard verifies events returned by the custom search endpoint and keeps
+// a circuit breaker over them. Events with a bad ID or signature are dropped;
+// when too many of them show up, the endpoint is considered compromised or
+// broken and is skipped until the cooldown expires.
+type searchGuard struct {
+	mu           sync.Mutex
+	checked      int
+	failed       int
+	trippedUntil time.Time
+
+	// totals since startup
+	accepted    atomic.Int64
+	badID       atomic.Int64
+	badSig      atomic.Int64
+	filtered    atomic.Int64
+	breakerTrip atomic.Int64
+}
+
+// allow reports whether the custom search endpoint may be used right now.
+func (g *searchGuard) allow() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Now().After(g.trippedUntil)
+}
+
+// check verifies the event against its ID, its signature and the filter of the
+// original request. It returns false when the event must be dropped.
+func (g *searchGuard) check(evt *nostr.Event, filter nostr.Filter) bool {
+	if !evt.CheckID() {
+		g.badID.Add(1)
+		g.record(false)
+		return false
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		g.badSig.Add(1)
+		g.record(false)
+		return false
+	}
+	g.record(true)
+
+	// The search endpoint is not required to apply every field of the filter,
+	// so results outside of it do not count against the breaker.
+	if !filter.Matches(evt) {
+		g.filtered.Add(1)
+		return false
+	}
+	g.accepted.Add(1)
+	return true
+}
+
+func (g *searchGuard) record(ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.checked++
+	if !ok {
+		g.failed++
+	}
+	if g.checked < searchBreakerWindow {
+		return
+	}
+	if rate := float64(g.failed) / float64(g.checked); rate >= searchBreakerThreshold {
+		g.trippedUntil = time.Now().Add(searchBreakerCooldown)
+		g.breakerTrip.Add(1)
+		slog.Warn("custom search breaker tripped", "failed", g.failed, "checked", g.checked, "cooldown", searchBreakerCooldown)
+	}
+	g.checked, g.failed = 0, 0
+}
+
+const (
+	nip05CacheTTL = time.Hour
+	// nip05CacheSize is the most pubkeys whose domain is remembered.
+	nip05CacheSize = 10000
+	// nip05Lookups is the most NIP-05 addresses looked up at a time; the
+	// pubkeys that come up while that many are under way are looked up when
+	// they come up again.
+	nip05Lookups = 4
+)
+
+// nip05Cache remembers which NIP-05 domain, if any, has been verified for a
+// pubkey so domain: searches do not hit the well-known endpoints every time.
+// Addresses are looked up in the background rather than while a query waits,
+// so that a search cannot make the relay send out requests by the hundred.
+type nip05Cache struct {
+	mu      sync.Mutex
+	entries map[string]nip05CacheEntry
+	pending map[string]struct{}
+}
+
+type nip05CacheEntry struct {
+	domain  string
+	expires time.Time
+}
+
+// domainOf returns the verified NIP-05 domain of pubkey, and whether it is
+// known. If it is not, the profile of pubkey is looked up in store and checked
+// against the domain's nostr.json by a task that spawn runs.
+func (c *nip05Cache) domainOf(store eventstore.Store, pubkey string, spawn func(func())) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[pubkey]; ok && time.Now().Before(entry.expires) {
+		return entry.domain, true
+	}
+	if _, ok := c.pending[pubkey]; ok || len(c.pending) >= nip05Lookups {
+		return "", false
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]struct{})
+	}
+	c.pending[pubkey] = struct{}{}
+	spawn(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		domain, err := verifyNIP05Domain(ctx, store, pubkey)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.pending, pubkey)
+		if err != nil {
+			// tried again when the pubkey comes up next
+			slog.Debug("failed to verify NIP-05 address", "pubkey", pubkey, "error", err)
+			return
+		}
+		c.put(pubkey, domain)
+	})
+	return "", false
+}
+
+// put remembers domain for pubkey, making room first if the cache is full.
+func (c *nip05Cache) put(pubkey, domain string) {
+	if c.entries == nil {
+		c.entries = make(map[string]nip05CacheEntry)
+	}
+	if len(c.entries) >= nip05CacheSize {
+		now := time.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < nip05CacheSize {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[pubkey] = nip05CacheEntry{domain: domain, expires: time.Now().Add(nip05CacheTTL)}
+}
+
+// nip05Client fetches nostr.json from public addresses only, so that profiles
+// cannot have the relay send requests into its own network, and does not
+// follow redirects.
+var nip05Client = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := addr.Addr().Unmap(); !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+// verifyNIP05Domain returns the domain of the NIP-05 address in the profile
+// of pubkey if the domain's nostr.json confirms it, and otherwise "". It
+// fails only if ctx is done or store fails, when the answer is not known.
+func verifyNIP05Domain(ctx context.Context, store eventstore.Store, pubkey string) (string, error) {
+	ch, err := store.QueryEvents(internalQuery(ctx), nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: []string{pubkey}, Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	var profile *nostr.Event
+	for evt := range ch {
+		if profile == nil {
+			profile = evt
+		}
+	}
+	if profile == nil {
+		return "", ctx.Err()
+	}
+
+	var metadata struct {
+		NIP05 string `json:"nip05"`
+	}
+	if err := json.Unmarshal([]byte(profile.Content), &metadata); err != nil || metadata.NIP05 == "" {
+		return "", nil
+	}
+	name, domain, err := nip05.ParseIdentifier(metadata.NIP05)
+	if err != nil {
+		return "", nil
+	}
+
+	u := "https://" + domain + "/.well-known/nostr.json?name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", nil
+	}
+	resp, err := nip05Client.Do(req)
+	if err != nil {
+		return "", ctx.Err()
+	}
+	defer resp.Body.Close()
+	var wellKnown nip05.WellKnownResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&wellKnown) != nil {
+		return "", ctx.Err()
+	}
+	if wellKnown.Names[name] != pubkey {
+		return "", nil
+	}
+	return strings.ToLower(domain), nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// postgresSearch answers NIP-50 queries from a generated tsvector column on
+// the event table, indexed with GIN.
+//
+// PostgreSQL has no tokenizer for languages written without spaces, so the
+// default "bigram" tokenizer indexes runs of CJK characters as their single
+// characters and overlapping two-character tokens (東京タワー → 東 京 タ ワ ー
+// 東京 京タ タワ ワー) and leaves the rest of the text to the "simple"
+// configuration. A search term is split into bigrams, or kept whole when it is
+// a single character, so a query matches every text that contains all of its
+// tokens. Any other tokenizer value is used as a text search configuration
+// name (e.g. "english") for stemming Western text.
+type postgresSearch struct {
+	db *sqlx.DB
+	// reader returns the database to search, the read replica if it keeps up
+	reader func() *sqlx.DB
+	config string
+	bigram bool
+}
+
+// postgresSearchTextDDL defines the functions used by the bigram tokenizer to
+// rewrite content and search terms before they are turned into a tsvector or
+// a tsquery. nostr_search_text splits runs into bigrams only, which is what
+// columns were built with before single characters were indexed.
+const postgresSearchTextDDL = `
+CREATE OR REPLACE FUNCTION nostr_search_text(input text) RETURNS text
+LANGUAGE plpgsql IMMUTABLE STRICT PARALLEL SAFE AS $$
+DECLARE
+  cjk constant text := '[\u3040-\u30ff\u3400-\u4dbf\u4e00-\u9fff\uf900-\ufaff\uac00-\ud7af\uff66-\uff9f]+';
+  result text := regexp_replace(input, cjk, ' ', 'g');
+  run text;
+BEGIN
+  FOR run IN SELECT m[1] FROM regexp_matches(input, '(' || cjk || ')', 'g') AS m LOOP
+    IF length(run) = 1 THEN
+      result := result || ' ' || run;
+    ELSE
+      FOR i IN 1..length(run) - 1 LOOP
+        result := result || ' ' || substr(run, i, 2);
+      END LOOP;
+    END IF;
+  END LOOP;
+  RETURN result;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION nostr_search_index(input text) RETURNS text
+LANGUAGE plpgsql IMMUTABLE STRICT PARALLEL SAFE AS $$
+DECLARE
+  cjk constant text := '[\u3040-\u30ff\u3400-\u4dbf\u4e00-\u9fff\uf900-\ufaff\uac00-\ud7af\uff66-\uff9f]+';
+  result text := regexp_replace(input, cjk, ' ', 'g');
+  run text;
+BEGIN
+  FOR run IN SELECT m[1] FROM regexp_matches(input, '(' || cjk || ')', 'g') AS m LOOP
+    FOR i IN 1..length(run) LOOP
+      result := result || ' ' || substr(run, i, 1);
+    END LOOP;
+    FOR i IN 1..length(run) - 1 LOOP
+      result := result || ' ' || substr(run, i, 2);
+    END LOOP;
+  END LOOP;
+  RETURN result;
+END
+$$;
+`
+
+var postgresConfigName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// The comments the search_vector column is built with, which tell what its
+// tokenizer is. postgresBigramsOnly is that of columns built before single
+// CJK characters were indexed, which still answer every other query.
+const (
+	postgresBigrams     = "tokenizer=bigram+unigram"
+	postgresBigramsOnly = "tokenizer=bigram"
+)
+
+// postgresSearchMode returns the comment of a search_vector column built for
+// tokenizer and the expression it is generated with.
+func postgresSearchMode(tokenizer string) (mode, expr string, err error) {
+	if tokenizer == "" || tokenizer == "bigram" {
+		return postgresBigrams, "to_tsvector('simple'::regconfig, nostr_search_index(content))", nil
+	}
+	if !postgresConfigName.MatchString(tokenizer) {
+		return "", "", fmt.Errorf("invalid search tokenizer %q", tokenizer)
+	}
+	return "tokenizer=" + tokenizer, fmt.Sprintf("to_tsvector('%s'::regconfig, content)", tokenizer), nil
+}
+
+// parsePostgresSearchMode returns how to query a column with the comment mode.
+func parsePostgresSearchMode(mode string) (config string, bigram bool, ok bool) {
+	switch mode {
+	case postgresBigrams, postgresBigramsOnly:
+		return "simple", true, true
+	}
+	config, ok = strings.CutPrefix(mode, "tokenizer=")
+	return config, false, ok && postgresConfigName.MatchString(config)
+}
+
+// newPostgresSearch adds the search_vector column and its GIN index to the
+// event table if there are none. A column built with another tokenizer is
+// kept, and searched the way it was built, unless rebuild is set: generating
+// it again rewrites the whole table, so it is left to the rebuild-search
+// subcommand rather than done on startup.
+func newPostgresSearch(db *sqlx.DB, tokenizer string, rebuild bool) (*postgresSearch, error) {
+	mode, expr, err := postgresSearchMode(tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(postgresSearchTextDDL); err != nil {
+		return nil, fmt.Errorf("failed to create search function: %w", err)
+	}
+
+	var current string
+	err = db.Get(&current, `
+    SELECT coalesce(col_description('event'::regclass, attnum), '')
+    FROM pg_attribute
+    WHERE attrelid = 'event'::regclass AND attname = 'search_vector' AND NOT attisdropped
+    `)
+	missing := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !missing {
+		return nil, fmt.Errorf("failed to look up search column: %w", err)
+	}
+	if current != mode && !missing && !rebuild {
+		if _, _, ok := parsePostgresSearchMode(current); !ok {
+			return nil, fmt.Errorf("search column has an unknown tokenizer %q; run rebuild-search", current)
+		}
+		slog.Warn("search column was built with another tokenizer; run rebuild-search to change it",
+			"column", current, "want", mode)
+		mode = current
+	}
+	if current != mode {
+		slog.Info("building full-text search column", "tokenizer", tokenizer)
+		tx, err := db.Beginx()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		for _, stmt := range []string{
+			`ALTER TABLE event DROP COLUMN IF EXISTS search_vector`,
+			`ALTER TABLE event ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (` + expr + `) STORED`,
+			fmt.Sprintf(`COMMENT ON COLUMN event.search_vector IS '%s'`, mode),
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return nil, fmt.Errorf("failed to create search column: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS searchidx ON event USING gin (search_vector)`); err != nil {
+		return nil, fmt.Errorf("failed to create search index: %w", err)
+	}
+	config, bigram, _ := parsePostgresSearchMode(mode)
+	return &postgresSearch{db: db, config: config, bigram: bigram}, nil
+}
+
+// runRebuildSearch generates the search_vector column of a PostgreSQL database
+// again with the given tokenizer, which rewrites the event table. The relay
+// keeps searching the column the old way until then.
+func runRebuildSearch(args []string) error {
+	var r Relay
+	var databaseURL, tokenizer string
+
+	flags := flag.NewFlagSet("rebuild-search", flag.ExitOnError)
+	openRelayFlags(flags, &r, &databaseURL)
+	flags.StringVar(&tokenizer, "search-tokenizer", envDef("SEARCH_TOKENIZER", "bigram"), "PostgreSQL NIP-50 tokenizer (bigram or a text search configuration)")
+	flags.Parse(args)
+
+	if r.driverName != "postgresql" {
+		return fmt.Errorf("the search column is only built on postgresql, not %s", r.driverName)
+	}
+	if err := r.configureStorage(databaseURL, 0, relayLimitationDocument.MaxLimit); err != nil {
+		return err
+	}
+	store := r.Storage(context.Background())
+	if err := store.Init(); err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer store.Close()
+	if _, err := newPostgresSearch(r.DB(), tokenizer, true); err != nil {
+		return err
+	}
+	slog.Info("search column rebuilt", "tokenizer", tokenizer)
+	return nil
+}
+
+// tsquery returns the SQL expression that turns the search term parameter
+// into a tsquery using the same tokenizer as the search_vector column.
+func (s *postgresSearch) tsquery() string {
+	if s.bigram {
+		return `plainto_tsquery('simple'::regconfig, nostr_search_text(?))`
+	}
+	return fmt.Sprintf(`plainto_tsquery('%s'::regconfig, ?)`, s.config)
+}
+
+func (s *postgresSearch) searchSQL(filter nostr.Filter, q searchQuery) (string, []any) {
+	conditions := []string{`search_vector @@ q`}
+	params := []any{q.Text}
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, `id IN (`+makePlaceHolders(len(filter.IDs))+`)`)
+		for _, v := range filter.IDs {
+			params = append(params, v)
+		}
+	}
+	if len(filter.Authors) > 0 {
+		conditions = append(conditions, `pubkey IN (`+makePlaceHolders(len(filter.Authors))+`)`)
+		for _, v := range filter.Authors {
+			params = append(params, v)
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		conditions = append(conditions, `kind IN (`+makePlaceHolders(len(filter.Kinds))+`)`)
+		for _, v := range filter.Kinds {
+			params = append(params, v)
+		}
+	}
+	for tagKey, values := range filter.Tags {
+		conditions = append(conditions, `tagvalues && ARRAY[`+makePlaceHolders(len(values))+`]`)
+		for _, value := range values {
+			params = append(params, strings.TrimPrefix(tagKey, "#")+":"+value)
+		}
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, `created_at >= ?`)
+		params = append(params, *filter.Since)
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, `created_at <= ?`)
+		params = append(params, *filter.Until)
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > relayLimitationDocument.MaxLimit {
+		limit = relayLimitationDocument.MaxLimit
+	}
+	params = append(params, limit)
+
+	order := `ts_rank(search_vector, q) DESC, created_at DESC`
+	if q.Sort == searchSortRecent {
+		order = `created_at DESC, id`
+	}
+
+	query := sqlx.Rebind(sqlx.DOLLAR, `SELECT id, pubkey, created_at, kind, tags, content, sig
+      FROM event, `+s.tsquery()+` q
+      WHERE `+strings.Join(conditions, " AND ")+`
+      ORDER BY `+order+`
+      LIMIT ?`)
+	return query, params
+}
+
+// searchEvents returns the events matching q ordered by rank or by recency
+// for sort:recent, restricted by the other fields of the filter.
+func (s *postgresSearch) searchEvents(ctx context.Context, filter nostr.Filter, q searchQuery) (chan *nostr.Event, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return nil, errSearchUnsupported
+	}
+
+	query, params := s.searchSQL(filter, q)
+	rows, err := searchRows(ctx, s.db, s.reader, query, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search events: %w", err)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var evt nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp,
+				&evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+				return
+			}
+			evt.CreatedAt = nostr.Timestamp(timestamp)
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPostgresSearchSQLUsesTokenizer(t *testing.T) {
+	since := nostr.Timestamp(100)
+	filter := nostr.Filter{
+		Search:  "東京タワー",
+		Kinds:   []int{1},
+		Authors: []string{"p1"},
+		Tags:    nostr.TagMap{"t": []string{"nostr"}},
+		Since:   &since,
+		Limit:   10,
+	}
+
+	bigram := &postgresSearch{config: "simple", bigram: true}
+	query, params := bigram.searchSQL(filter, parseSearchQuery(filter.Search))
+	if !strings.Contains(query, "plainto_tsquery('simple'::regconfig, nostr_search_text($1))") {
+		t.Fatalf("expected bigram tsquery, got %s", query)
+	}
+	if !strings.Contains(query, "LIMIT $6") {
+		t.Fatalf("expected limit as the last parameter, got %s", query)
+	}
+	want := []any{"東京タワー", "p1", 1, "t:nostr", since, 10}
+	if len(params) != len(want) {
+		t.Fatalf("unexpected params: %v", params)
+	}
+	for i := range want {
+		if params[i] != want[i] {
+			t.Fatalf("param %d: got %v, want %v", i, params[i], want[i])
+		}
+	}
+
+	english := &postgresSearch{config: "english"}
+	query, _ = english.searchSQL(nostr.Filter{Search: "relays"}, parseSearchQuery("relays"))
+	if !strings.Contains(query, "plainto_tsquery('english'::regconfig, $1)") {
+		t.Fatalf("expected english tsquery, got %s", query)
+	}
+}
+
+func TestPostgresSearchMode(t *testing.T) {
+	mode, expr, err := postgresSearchMode("bigram")
+	if err != nil || mode != postgresBigrams || !strings.Contains(expr, "nostr_search_index(content)") {
+		t.Fatalf("expected single characters to be indexed, got %q %q %v", mode, expr, err)
+	}
+	if _, _, err := postgresSearchMode("english; DROP TABLE event"); err == nil {
+		t.Fatal("expected an invalid configuration name to be refused")
+	}
+	for mode, want := range map[string]string{
+		postgresBigrams:      "simple",
+		postgresBigramsOnly:  "simple",
+		"tokenizer=english":  "english",
+		"tokenizer=bad name": "",
+		"something else":     "",
+	} {
+		config, _, ok := parsePostgresSearchMode(mode)
+		if ok != (want != "") || ok && config != want {
+			t.Errorf("%q: got %q %v, want %q", mode, config, ok, want)
+		}
+	}
+}
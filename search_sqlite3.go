@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sqlite3Search answers NIP-50 queries from an FTS5 index over event content.
+//
+// The index lives in two tables next to the backend's event table:
+// event_search maps event ids to a stable docid (an INTEGER PRIMARY KEY, so
+// VACUUM does not renumber it) and event_fts holds the trigram-tokenized
+// content under that docid. Both are kept in sync with the event table by
+// triggers, so every save and delete that goes through relayStore (including
+// the deletes ReplaceEvent does inside the backend) updates the index.
+//
+// The trigram tokenizer matches substrings, like the LIKE query the backend
+// falls back to, and works for CJK text that has no word boundaries.
+type sqlite3Search struct {
+	db *sqlx.DB
+	// reader returns the database to search, the read replica if it keeps up
+	reader func() *sqlx.DB
+}
+
+var sqlite3SearchDDLs = []string{
+	`CREATE TABLE IF NOT EXISTS event_search (
+       docid integer PRIMARY KEY,
+       id text NOT NULL UNIQUE);`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS event_fts USING fts5(content, tokenize='trigram');`,
+	`CREATE TRIGGER IF NOT EXISTS event_fts_insert AFTER INSERT ON event BEGIN
+       INSERT INTO event_search (id) VALUES (new.id);
+       INSERT INTO event_fts (rowid, content)
+         VALUES ((SELECT docid FROM event_search WHERE id = new.id), new.content);
+     END;`,
+	`CREATE TRIGGER IF NOT EXISTS event_fts_delete AFTER DELETE ON event BEGIN
+       DELETE FROM event_fts WHERE rowid = (SELECT docid FROM event_search WHERE id = old.id);
+       DELETE FROM event_search WHERE id = old.id;
+     END;`,
+}
+
+// newSQLite3Search creates the FTS5 index if needed and fills it from the
+// existing events whenever its triggers are missing. It returns nil when the
+// SQLite library was built without FTS5 (go-sqlite3 needs the sqlite_fts5 build
+// tag), after dropping the triggers a build with FTS5 may have left, since
+// they would make every save fail with "no such module: fts5". The index goes
+// stale without them and is filled again by the next build with FTS5.
+func newSQLite3Search(db *sqlx.DB) *sqlite3Search {
+	var fts5 bool
+	if err := db.Get(&fts5, `SELECT sqlite_compileoption_used('ENABLE_FTS5')`); err != nil || !fts5 {
+		for _, trigger := range []string{"event_fts_insert", "event_fts_delete"} {
+			if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+				log.Fatalf("failed to drop full-text search trigger: %v", err)
+			}
+		}
+		slog.Warn("full-text search disabled; sqlite3 was built without FTS5")
+		return nil
+	}
+
+	var indexed int
+	if err := db.Get(&indexed, `SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'event_fts_insert'`); err != nil {
+		slog.Warn("full-text search disabled", "error", err)
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		slog.Warn("full-text search disabled", "error", err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	for _, ddl := range sqlite3SearchDDLs {
+		if _, err := tx.Exec(ddl); err != nil {
+			slog.Warn("full-text search disabled", "error", err)
+			return nil
+		}
+	}
+	if indexed == 0 {
+		slog.Info("building full-text search index")
+		for _, table := range []string{"event_fts", "event_search"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				slog.Warn("full-text search disabled", "error", err)
+				return nil
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO event_search (id) SELECT id FROM event`); err != nil {
+			slog.Warn("full-text search disabled", "error", err)
+			return nil
+		}
+		if _, err := tx.Exec(`INSERT INTO event_fts (rowid, content)
+          SELECT s.docid, e.content FROM event_search s JOIN event e ON e.id = s.id`); err != nil {
+			slog.Warn("full-text search disabled", "error", err)
+			return nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Warn("full-text search disabled", "error", err)
+		return nil
+	}
+	return &sqlite3Search{db: db}
+}
+
+// sqlite3MatchExpr turns a NIP-50 search string into an FTS5 MATCH expression
+// where every word must appear. Each word is quoted so FTS5 operators in user
+// input are taken literally. Words shorter than three characters cannot be
+// answered by the trigram index, in which case errSearchUnsupported is returned.
+func sqlite3MatchExpr(search string) (string, error) {
+	words := strings.Fields(search)
+	if len(words) == 0 {
+		return "", errSearchUnsupported
+	}
+	for i, word := range words {
+		if utf8.RuneCountInString(word) < 3 {
+			return "", errSearchUnsupported
+		}
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " "), nil
+}
+
+// searchEvents returns the events matching q ordered by relevance (bm25) or
+// by recency for sort:recent, restricted by the other fields of the filter.
+func (s *sqlite3Search) searchEvents(ctx context.Context, filter nostr.Filter, q searchQuery) (chan *nostr.Event, error) {
+	match, err := sqlite3MatchExpr(q.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []string{`event_fts MATCH ?`}
+	params := []any{match}
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, `e.id IN (`+makePlaceHolders(len(filter.IDs))+`)`)
+		for _, v := range filter.IDs {
+			params = append(params, v)
+		}
+	}
+	if len(filter.Authors) > 0 {
+		conditions = append(conditions, `e.pubkey IN (`+makePlaceHolders(len(filter.Authors))+`)`)
+		for _, v := range filter.Authors {
+			params = append(params, v)
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		conditions = append(conditions, `e.kind IN (`+makePlaceHolders(len(filter.Kinds))+`)`)
+		for _, v := range filter.Kinds {
+			params = append(params, v)
+		}
+	}
+	for name, values := range filter.Tags {
+		// matched exactly here rather than narrowed down with LIKE the way
+		// the backend does, so that the LIMIT counts only matching events
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM json_each(e.tags) t
+        WHERE json_extract(t.value, '$[0]') = ? AND json_extract(t.value, '$[1]') IN (`+makePlaceHolders(len(values))+`))`)
+		params = append(params, name)
+		for _, v := range values {
+			params = append(params, v)
+		}
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, `e.created_at >= ?`)
+		params = append(params, *filter.Since)
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, `e.created_at <= ?`)
+		params = append(params, *filter.Until)
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > relayLimitationDocument.MaxLimit {
+		limit = relayLimitationDocument.MaxLimit
+	}
+	params = append(params, limit)
+
+	order := `event_fts.rank, e.created_at DESC`
+	if q.Sort == searchSortRecent {
+		order = `e.created_at DESC, e.id`
+	}
+
+	query := `SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig
+      FROM event_fts
+      JOIN event_search s ON s.docid = event_fts.rowid
+      JOIN event e ON e.id = s.id
+      WHERE ` + strings.Join(conditions, " AND ") + `
+      ORDER BY ` + order + `
+      LIMIT ?`
+
+	rows, err := searchRows(ctx, s.db, s.reader, query, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search events: %w", err)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var evt nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp,
+				&evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+				return
+			}
+			evt.CreatedAt = nostr.Timestamp(timestamp)
+			if !filter.Matches(&evt) {
+				continue
+			}
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func makePlaceHolders(n int) string {
+	return strings.TrimRight(strings.Repeat("?,", n), ",")
+}
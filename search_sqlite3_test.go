@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSQLite3SearchFollowsSavesAndDeletes(t *testing.T) {
+	backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "search.sqlite")}
+	if err := backend.Init(); err != nil {
+		t.Fatalf("init backend: %v", err)
+	}
+	defer backend.Close()
+
+	ctx := context.Background()
+	before := signedEvent(t, bytes32Hex(0x11), 1, "こんにちは世界、nostr relay")
+	if err := backend.SaveEvent(ctx, before); err != nil {
+		t.Fatalf("save event: %v", err)
+	}
+
+	search := newSQLite3Search(backend.DB)
+	if search == nil {
+		t.Skip("sqlite3 was built without FTS5; run with -tags sqlite_fts5")
+	}
+	store := &relayStore{Store: backend, search: search}
+
+	after := signedEvent(t, bytes32Hex(0x22), 7, "relay relay relay")
+	if err := store.SaveEvent(ctx, after); err != nil {
+		t.Fatalf("save event: %v", err)
+	}
+
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay"}); len(got) != 2 || got[0] != after.ID {
+		t.Fatalf("expected both events ranked by relevance, got %v", got)
+	}
+	if got := searchIDs(t, store, nostr.Filter{Search: "こんにちは"}); len(got) != 1 || got[0] != before.ID {
+		t.Fatalf("expected the backfilled japanese event, got %v", got)
+	}
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay", Kinds: []int{1}}); len(got) != 1 || got[0] != before.ID {
+		t.Fatalf("expected kinds to restrict the search, got %v", got)
+	}
+
+	tagged := signedEvent(t, bytes32Hex(0x33), 1, "tagged relay")
+	tagged.Tags = nostr.Tags{{"t", "nostr"}}
+	tagged.CreatedAt -= 10
+	tagged.Sign(bytes32Hex(0x33))
+	// newer, with the value under another tag
+	lookalike := signedEvent(t, bytes32Hex(0x33), 1, "lookalike relay")
+	lookalike.Tags = nostr.Tags{{"x", "nostr"}}
+	lookalike.Sign(bytes32Hex(0x33))
+	for _, evt := range []*nostr.Event{tagged, lookalike} {
+		if err := store.SaveEvent(ctx, evt); err != nil {
+			t.Fatalf("save event: %v", err)
+		}
+	}
+	filter := nostr.Filter{Search: "relay sort:recent", Tags: nostr.TagMap{"t": {"nostr"}}, Limit: 1}
+	if got := searchIDs(t, store, filter); len(got) != 1 || got[0] != tagged.ID {
+		t.Fatalf("expected tags to be matched within the limit, got %v", got)
+	}
+	for _, evt := range []*nostr.Event{tagged, lookalike} {
+		store.DeleteEvent(ctx, evt)
+	}
+
+	if err := store.DeleteEvent(ctx, after); err != nil {
+		t.Fatalf("delete event: %v", err)
+	}
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay"}); len(got) != 1 || got[0] != before.ID {
+		t.Fatalf("expected deleted event to leave the index, got %v", got)
+	}
+}
+
+func searchIDs(t *testing.T, store *relayStore, filter nostr.Filter) []string {
+	t.Helper()
+
+	ch, err := store.QueryEvents(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	var ids []string
+	for evt := range ch {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+func TestSQLite3SearchReadsReplica(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	replicaPath := filepath.Join(dir, "replica.sqlite")
+	seed := &sqlite3.SQLite3Backend{DatabaseURL: replicaPath}
+	if err := seed.Init(); err != nil {
+		t.Fatalf("init replica: %v", err)
+	}
+	seed.SaveEvent(ctx, signedEvent(t, bytes32Hex(0x11), 1, "relay on the replica"))
+	if newSQLite3Search(seed.DB) == nil {
+		t.Skip("sqlite3 was built without FTS5; run with -tags sqlite_fts5")
+	}
+	seed.Close()
+
+	r := &Relay{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(dir, "primary.sqlite")}}
+	store := r.Storage(ctx).(*relayStore)
+	if err := store.Init(); err != nil {
+		t.Fatalf("init primary: %v", err)
+	}
+	defer store.Close()
+	r.ready()
+	r.openSearch()
+	primary := signedEvent(t, bytes32Hex(0x22), 1, "relay on the primary")
+	store.SaveEvent(ctx, primary)
+
+	replica, err := r.openReplica(replicaPath, time.Second)
+	if err != nil {
+		t.Fatalf("open replica: %v", err)
+	}
+	defer replica.db.Close()
+	r.replica = replica
+
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay"}); len(got) != 1 || got[0] == primary.ID {
+		t.Fatalf("expected the search to go to the replica, got %v", got)
+	}
+	replica.lag = func(context.Context) (time.Duration, error) { return time.Minute, nil }
+	replica.check(ctx)
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay"}); len(got) != 1 || got[0] != primary.ID {
+		t.Fatalf("expected the search to go to the primary while the replica lags, got %v", got)
+	}
+}
+
+func TestSQLite3SearchWithAndWithoutFTS5(t *testing.T) {
+	backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "search.sqlite")}
+	if err := backend.Init(); err != nil {
+		t.Fatalf("init backend: %v", err)
+	}
+	defer backend.Close()
+	ctx := context.Background()
+
+	if newSQLite3Search(backend.DB) == nil {
+		// the trigger a build with FTS5 leaves behind
+		if _, err := backend.DB.Exec(sqlite3SearchDDLs[2]); err != nil {
+			t.Fatalf("create trigger: %v", err)
+		}
+		if newSQLite3Search(backend.DB) != nil {
+			t.Fatal("expected no search without FTS5")
+		}
+		if err := backend.SaveEvent(ctx, signedEvent(t, bytes32Hex(0x11), 1, "relay")); err != nil {
+			t.Fatalf("expected saves to work once the triggers are dropped, got %v", err)
+		}
+		return
+	}
+
+	// a build without FTS5 drops the triggers, and the index misses the
+	// events saved in the meantime
+	for _, trigger := range []string{"event_fts_insert", "event_fts_delete"} {
+		if _, err := backend.DB.Exec(`DROP TRIGGER ` + trigger); err != nil {
+			t.Fatalf("drop trigger: %v", err)
+		}
+	}
+	missed := signedEvent(t, bytes32Hex(0x11), 1, "relay saved without FTS5")
+	if err := backend.SaveEvent(ctx, missed); err != nil {
+		t.Fatalf("save event: %v", err)
+	}
+
+	search := newSQLite3Search(backend.DB)
+	if search == nil {
+		t.Fatal("expected the search to be set up again")
+	}
+	store := &relayStore{Store: backend, search: search}
+	if got := searchIDs(t, store, nostr.Filter{Search: "relay"}); len(got) != 1 || got[0] != missed.ID {
+		t.Fatalf("expected the index to be filled again, got %v", got)
+	}
+}
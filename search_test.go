@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	q := parseSearchQuery("nostr relay language:JA domain:Example.com sort:recent include:spam https://example.com foo:bar")
+	want := searchQuery{
+		Text:        "nostr relay https://example.com foo:bar",
+		Language:    "ja",
+		Domain:      "example.com",
+		Sort:        searchSortRecent,
+		IncludeSpam: true,
+	}
+	if q != want {
+		t.Fatalf("got %+v, want %+v", q, want)
+	}
+}
+
+func TestSearchQueryMatchesLanguage(t *testing.T) {
+	ja := &nostr.Event{Content: "こんにちは、世界"}
+	zh := &nostr.Event{Content: "你好世界"}
+	en := &nostr.Event{Content: "hello world"}
+	labeled := &nostr.Event{Content: "hola mundo", Tags: nostr.Tags{{"l", "es", "ISO-639-1"}}}
+
+	for _, tc := range []struct {
+		lang string
+		evt  *nostr.Event
+		want bool
+	}{
+		{"ja", ja, true},
+		{"ja", zh, false},
+		{"zh", zh, true},
+		{"zh", ja, false},
+		{"en", en, true},
+		{"en", ja, false},
+		{"es", labeled, true},
+		{"en", labeled, false},
+	} {
+		if got := (searchQuery{Language: tc.lang}).matchesLanguage(tc.evt); got != tc.want {
+			t.Errorf("language:%s on %q: got %v, want %v", tc.lang, tc.evt.Content, got, tc.want)
+		}
+	}
+}
+
+func TestPerformCustomSearchSendsQueryAndFilter(t *testing.T) {
+	var got customSearchRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("unexpected content type: %s", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	filter := nostr.Filter{Search: "nostr language:ja include:spam", Kinds: []int{1}, Limit: 5}
+	r := &Relay{customSearchURL: srv.URL}
+	ch, err := r.performCustomSearch(context.Background(), parseSearchQuery(filter.Search), filter)
+	if err != nil {
+		t.Fatalf("perform custom search: %v", err)
+	}
+	for range ch {
+	}
+
+	if got.Query.Text != "nostr" || got.Query.Language != "ja" || !got.Query.IncludeSpam {
+		t.Fatalf("unexpected query: %+v", got.Query)
+	}
+	if got.Filter.Search != filter.Search || got.Filter.Limit != 5 || len(got.Filter.Kinds) != 1 {
+		t.Fatalf("unexpected filter: %+v", got.Filter)
+	}
+}
+
+func TestRefineSearchPages(t *testing.T) {
+	ctx := context.Background()
+	defer func(limit int) { relayLimitationDocument.MaxLimit = limit }(relayLimitationDocument.MaxLimit)
+	relayLimitationDocument.MaxLimit = 4
+
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(ctx).(*relayStore)
+	store.Init()
+	r.ready()
+	now := nostr.Now()
+	for i := range 12 {
+		content := "hello world"
+		if i%4 == 0 {
+			content = "hello こんにちは"
+		}
+		evt := signedEvent(t, bytes32Hex(0x11), 1, content)
+		evt.CreatedAt = now - nostr.Timestamp(i)
+		evt.Sign(bytes32Hex(0x11))
+		store.SaveEvent(ctx, evt)
+	}
+
+	for _, tc := range []struct {
+		search string
+		want   int
+	}{
+		// newest first, so the pages before are looked through
+		{"hello language:ja sort:recent", 3},
+		// by relevance, so only the first page is
+		{"hello language:ja", 1},
+	} {
+		ch, err := store.QueryEvents(ctx, nostr.Filter{Search: tc.search, Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		if n != tc.want {
+			t.Errorf("%q: expected %d events, got %d", tc.search, tc.want, n)
+		}
+	}
+}
+
+func TestNIP05CacheLooksUpInBackground(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	store.Init()
+	secret := bytes32Hex(0x11)
+	profile := signedEvent(t, secret, nostr.KindProfileMetadata, `{"nip05":"alice@127.0.0.1.example"}`)
+	store.SaveEvent(ctx, profile)
+
+	var c nip05Cache
+	var tasks []func()
+	spawn := func(f func()) { tasks = append(tasks, f) }
+	if _, known := c.domainOf(store, profile.PubKey, spawn); known || len(tasks) != 1 {
+		t.Fatalf("expected a lookup to be started rather than waited for, got %v %d", known, len(tasks))
+	}
+	if _, known := c.domainOf(store, profile.PubKey, spawn); known || len(tasks) != 1 {
+		t.Fatal("expected a pubkey being looked up not to be looked up again")
+	}
+	for i := range nip05Lookups {
+		c.domainOf(store, bytes32Hex(byte(0x20+i)), spawn)
+	}
+	if len(tasks) != nip05Lookups {
+		t.Fatalf("expected at most %d lookups at a time, got %d", nip05Lookups, len(tasks))
+	}
+	tasks[0]()
+	if domain, known := c.domainOf(store, profile.PubKey, spawn); !known || domain != "" {
+		t.Fatalf("expected the unverifiable address to be remembered as such, got %q %v", domain, known)
+	}
+
+	c.mu.Lock()
+	for i := range nip05CacheSize + 10 {
+		c.put(fmt.Sprint(i), "example.com")
+	}
+	size := len(c.entries)
+	c.mu.Unlock()
+	if size > nip05CacheSize {
+		t.Fatalf("expected the cache to stay within %d entries, got %d", nip05CacheSize, size)
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	for address, public := range map[string]bool{
+		"127.0.0.1:443":      false,
+		"10.1.2.3:443":       false,
+		"169.254.169.254:80": false,
+		"[::1]:443":          false,
+		"[fd00::1]:443":      false,
+		"93.184.216.34:443":  true,
+	} {
+		if err := dialPublicOnly("tcp", address, nil); (err == nil) != public {
+			t.Errorf("%s: got %v", address, err)
+		}
+	}
+}
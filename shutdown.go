@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// shutdownReason is sent in CLOSED to the subscriptions open when the relay
+// shuts down.
+const shutdownReason = "shutting-down: relay is shutting down"
+
+// closedWriteTimeout is how long shutdown waits for a client to take the
+// CLOSED messages of its subscriptions before it moves on without it.
+const closedWriteTimeout = 2 * time.Second
+
+// shutdownExitDelay is how long after the shutdown timeout the relay exits
+// if shutdown has not returned by then, so that it gets the chance to give
+// up waiting by itself.
+const shutdownExitDelay = 5 * time.Second
+
+// errShuttingDown refuses the writes that come in after the storage is about
+// to be closed.
+var errShuttingDown = errors.New("relay is shutting down")
+
+// shutdown stops the relay within ctx: it stops accepting connections, sends
+// CLOSED to the open subscriptions, disconnects the clients, and then, through
+// OnShutdown, waits for pending work and closes the storage.
+func (r *Relay) shutdown(ctx context.Context, httpServer *http.Server, server *relayer.Server) {
+	// websocket connections are hijacked, so this leaves them open
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("failed to stop accepting connections", "error", err)
+	}
+	closed := r.subscriptions.close(ctx, shutdownReason)
+	slog.Info("subscriptions closed", "count", closed)
+	server.Shutdown(ctx)
+}
+
+// OnShutdown stops the background goroutines, waits for the saves and
+// notifications in progress and closes the storage.
+func (r *Relay) OnShutdown(ctx context.Context) {
+	if err := r.tasks.close(ctx); err != nil {
+		slog.Warn("gave up waiting for pending work", "error", err)
+	}
+	if r.replica != nil {
+		r.replica.db.Close()
+	}
+	if r.storeWithHooks != nil {
+		r.storeWithHooks.Close()
+	}
+	slog.Info("storage closed")
+}
+
+// taskGroup tracks the work that has to be done before the storage is closed:
+// writes, notifications and the background goroutines. Once closed, it takes
+// no more.
+type taskGroup struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// context returns the context of the background goroutines, which is
+// canceled when the group closes.
+func (g *taskGroup) context() context.Context {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ctx == nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+		if g.closed {
+			g.cancel()
+		}
+	}
+	return g.ctx
+}
+
+// add counts a task in, or reports false if the group is closed.
+func (g *taskGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *taskGroup) done() {
+	g.wg.Done()
+}
+
+// spawn runs f in a goroutine. Once the group is closed, f still runs but is
+// not waited for.
+func (g *taskGroup) spawn(f func()) {
+	if !g.add() {
+		go f()
+		return
+	}
+	go func() {
+		defer g.done()
+		f()
+	}()
+}
+
+// close cancels the context of the background goroutines and waits for every
+// task until ctx is done.
+func (g *taskGroup) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subscriptionSet remembers the subscriptions of every connection so that
+// they can be closed with a reason. The relayer does not tell when a client
+// sends CLOSE, so a subscription is forgotten only with its connection, and
+// closing one the client closed already does no harm. How many are open is
+// counted from the messages of the connections, see watch.
+type subscriptionSet struct {
+	mu     sync.Mutex
+	subs   map[*relayer.WebSocket]map[string]struct{}
+	closed bool
+	open   atomic.Int64
+}
+
+// add remembers subscription id of the connection ctx comes from. It reports
+// false once the set is closed.
+func (s *subscriptionSet) add(ctx context.Context, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	ws, ok := ctx.Value(relayer.AUTH_CONTEXT_KEY).(*relayer.WebSocket)
+	if !ok {
+		return true
+	}
+	if s.subs == nil {
+		s.subs = map[*relayer.WebSocket]map[string]struct{}{}
+	}
+	ids, ok := s.subs[ws]
+	if !ok {
+		ids = map[string]struct{}{}
+		s.subs[ws] = ids
+		// the context of a message ends with its connection
+		context.AfterFunc(ctx, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.subs, ws)
+		})
+	}
+	ids[id] = struct{}{}
+	return true
+}
+
+// count returns how many subscriptions the open connections have.
+func (s *subscriptionSet) count() int {
+	return int(s.open.Load())
+}
+
+// watch counts the subscriptions of the websocket connections next serves: a
+// REQ opens one, and a CLOSE from the client or a CLOSED from the relay ends
+// it, as does the end of its connection.
+func (s *subscriptionSet) watch(next http.Handler) http.Handler {
+	return watchConnections(next, s.watcher)
+}
+
+// watcher returns the connWatcher of a new connection.
+func (s *subscriptionSet) watcher() connWatcher {
+	return &connSubscriptions{set: s, ids: map[string]struct{}{}}
+}
+
+// connSubscriptions follows the subscriptions open on one connection.
+type connSubscriptions struct {
+	set *subscriptionSet
+	mu  sync.Mutex
+	// ids is nil once the connection is closed
+	ids map[string]struct{}
+}
+
+func (c *connSubscriptions) received(typ, id string) {
+	switch typ {
+	case "REQ":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.ids[id]; !ok && c.ids != nil {
+			c.ids[id] = struct{}{}
+			c.set.open.Add(1)
+		}
+	case "CLOSE":
+		c.end(id)
+	}
+}
+
+func (c *connSubscriptions) sent(typ, id string) {
+	switch typ {
+	case "CLOSED":
+		c.end(id)
+	case "COUNT":
+		// the relayer asks the storage once per filter, so COUNT requests
+		// are counted by their answers instead
+		requests.WithLabelValues("COUNT", "accepted").Inc()
+	}
+}
+
+func (c *connSubscriptions) end(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ids[id]; ok {
+		delete(c.ids, id)
+		c.set.open.Add(-1)
+	}
+}
+
+func (c *connSubscriptions) closed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set.open.Add(-int64(len(c.ids)))
+	c.ids = nil
+}
+
+// close sends CLOSED with reason to every subscription, waiting for each
+// client up to closedWriteTimeout and for all of them until ctx is done, and
+// returns how many there were. New subscriptions are refused from then on.
+// Writes still under way are cut off when the connections are closed.
+func (s *subscriptionSet) close(ctx context.Context, reason string) int {
+	s.mu.Lock()
+	s.closed = true
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	count := 0
+	for ws, ids := range subs {
+		count += len(ids)
+		wg.Go(func() {
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				for id := range ids {
+					if err := ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason}); err != nil {
+						return
+					}
+				}
+			}()
+			timer := time.NewTimer(closedWriteTimeout)
+			defer timer.Stop()
+			select {
+			case <-sent:
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return count
+}
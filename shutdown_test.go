@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestShutdown(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	server, err := relayer.NewServer(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ready()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: r.subscriptions.watch(server)}
+	go httpServer.Serve(ln)
+	url := "ws://" + ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{Kinds: []int{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	var msg []any
+	if err := conn.ReadJSON(&msg); err != nil || msg[0] != "EOSE" {
+		t.Fatalf("expected EOSE, got %v %v", msg, err)
+	}
+	if n := r.subscriptions.count(); n != 1 {
+		t.Fatalf("expected 1 subscription, got %d", n)
+	}
+	// CLOSE has no answer, so wait for it to be counted
+	if err := conn.WriteJSON([]any{"CLOSE", "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); r.subscriptions.count() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected CLOSE to end the subscription, got %d", r.subscriptions.count())
+		}
+	}
+	if err := conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{Kinds: []int{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg[0] != "EOSE" {
+		t.Fatalf("expected EOSE, got %v %v", msg, err)
+	}
+
+	released := make(chan struct{})
+	finished := false
+	r.tasks.spawn(func() {
+		<-released
+		finished = true
+	})
+	time.AfterFunc(100*time.Millisecond, func() { close(released) })
+
+	r.shutdown(ctx, httpServer, server)
+	if !finished {
+		t.Fatal("expected shutdown to wait for pending work")
+	}
+	if err := conn.ReadJSON(&msg); err != nil || len(msg) != 3 || msg[0] != "CLOSED" || msg[2] != shutdownReason {
+		t.Fatalf("expected the subscription to be closed, got %v %v", msg, err)
+	}
+	if c, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil); err == nil {
+		c.Close()
+		t.Fatal("expected new connections to be refused")
+	}
+	if r.tasks.context().Err() == nil {
+		t.Fatal("expected the background context to be canceled")
+	}
+
+	evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now()}
+	evt.Sign(nostr.GeneratePrivateKey())
+	if err := r.Storage(ctx).SaveEvent(ctx, evt); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("expected saves to be refused, got %v", err)
+	}
+}
+
+func TestReqRefusedWhileShuttingDown(t *testing.T) {
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	server, err := relayer.NewServer(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ready()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: server}
+	go httpServer.Serve(ln)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws://"+ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	r.subscriptions.close(ctx, shutdownReason)
+	if err := conn.WriteJSON([]any{"REQ", "late", nostr.Filter{Kinds: []int{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	var msg []any
+	if err := conn.ReadJSON(&msg); err != nil || len(msg) != 3 || msg[0] != "CLOSED" || msg[2] != shutdownReason {
+		t.Fatalf("expected the REQ to be refused as the relay shuts down, got %v %v", msg, err)
+	}
+}
+
+func TestTaskGroupCloseGivesUp(t *testing.T) {
+	var g taskGroup
+	released := make(chan struct{})
+	defer close(released)
+	g.spawn(func() { <-released })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := g.close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected close to give up, got %v", err)
+	}
+	if g.add() {
+		t.Fatal("expected a closed group to refuse tasks")
+	}
+}
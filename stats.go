@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/opensearch-project/opensearch-go/v4/opensearchapi"
+)
+
+// eventStats are the event counts reported in the events field of /info.
+// Counting a large table is slow, so they are collected in the background
+// rather than on every request. Total leaves out expired events the reaper
+// has not deleted yet; the other counts include them.
+type eventStats struct {
+	Total     int64         `json:"total"`
+	Kinds     map[int]int64 `json:"kinds"`
+	Authors   int64         `json:"authors"`
+	Last24h   int64         `json:"last_24h"`
+	UpdatedAt int64         `json:"updated_at"`
+}
+
+// errUsageNotScanned is returned for the statistics of the backends whose
+// usage failed to be added up at startup.
+var errUsageNotScanned = errors.New("the stored events have not been counted")
+
+// refreshStats collects the event statistics now and then every interval
+// until ctx is done.
+func (r *Relay) refreshStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		stats, err := r.collectStats(ctx, start)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("failed to collect statistics", "error", err)
+		} else {
+			r.stats.Store(stats)
+			slog.Debug("statistics collected", "events", stats.Total, "took", time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectStats counts the stored events with whatever the backend offers:
+// SQL aggregates, OpenSearch aggregations, or else the usage kept in r.usage.
+func (r *Relay) collectStats(ctx context.Context, now time.Time) (*eventStats, error) {
+	since := nostr.Timestamp(now.Add(-24 * time.Hour).Unix())
+	var stats *eventStats
+	var err error
+	switch {
+	case r.DB() != nil:
+		stats, err = r.collectSQLStats(ctx, since)
+	case r.driverName == "opensearch":
+		stats, err = r.collectOpensearchStats(ctx, since)
+	default:
+		stats, err = r.collectTrackedStats(ctx, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+	expired, err := r.Storage(ctx).(*relayStore).countExpired(ctx, nostr.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	stats.Total -= expired
+	stats.UpdatedAt = now.Unix()
+	return stats, nil
+}
+
+func (r *Relay) collectSQLStats(ctx context.Context, since nostr.Timestamp) (*eventStats, error) {
+	db := r.readDB()
+	stats := &eventStats{Kinds: map[int]int64{}}
+	rows, err := db.QueryContext(ctx, "SELECT kind, count(*) FROM event GROUP BY kind")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind int
+		var count int64
+		if err := rows.Scan(&kind, &count); err != nil {
+			return nil, err
+		}
+		stats.Kinds[kind] = count
+		stats.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT count(DISTINCT pubkey) FROM event").Scan(&stats.Authors); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRowContext(ctx, db.Rebind("SELECT count(*) FROM event WHERE created_at >= ?"), since).Scan(&stats.Last24h); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// opensearchStatsQuery aggregates the whole index. Like the backend, it
+// compares created_at with plain numbers.
+const opensearchStatsQuery = `{
+	"size": 0,
+	"track_total_hits": true,
+	"aggs": {
+		"kinds": {"terms": {"field": "event.kind", "size": 10000}},
+		"authors": {"cardinality": {"field": "event.pubkey"}},
+		"recent": {"filter": {"range": {"event.created_at": {"gte": %d}}}}
+	}
+}`
+
+func (r *Relay) collectOpensearchStats(ctx context.Context, since nostr.Timestamp) (*eventStats, error) {
+	// the client of the backend is not exported, so the relay keeps its own
+	if r.opensearch == nil {
+		cfg := opensearchapi.Config{}
+		if r.opensearchStorage.URL != "" {
+			cfg.Client.Addresses = strings.Split(r.opensearchStorage.URL, ",")
+		}
+		if r.opensearchStorage.Insecure {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			cfg.Client.Transport = transport
+		}
+		client, err := opensearchapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.opensearch = client
+	}
+	resp, err := r.opensearch.Search(ctx, &opensearchapi.SearchReq{
+		Indices: []string{r.opensearchStorage.IndexName},
+		Body:    strings.NewReader(fmt.Sprintf(opensearchStatsQuery, since)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Timeout || resp.Shards.Failed > 0 {
+		return nil, fmt.Errorf("partial results: timed out %v, %d of %d shards failed", resp.Timeout, resp.Shards.Failed, resp.Shards.Total)
+	}
+	return parseOpensearchStats(resp.Hits.Total.Value, resp.Aggregations)
+}
+
+func parseOpensearchStats(total int, aggregations json.RawMessage) (*eventStats, error) {
+	var aggs struct {
+		Kinds struct {
+			Buckets []struct {
+				Key      int   `json:"key"`
+				DocCount int64 `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"kinds"`
+		Authors struct {
+			Value int64 `json:"value"`
+		} `json:"authors"`
+		Recent struct {
+			DocCount int64 `json:"doc_count"`
+		} `json:"recent"`
+	}
+	if err := json.Unmarshal(aggregations, &aggs); err != nil {
+		return nil, fmt.Errorf("malformed aggregations: %w", err)
+	}
+	stats := &eventStats{
+		Total:   int64(total),
+		Kinds:   make(map[int]int64, len(aggs.Kinds.Buckets)),
+		Authors: aggs.Authors.Value,
+		Last24h: aggs.Recent.DocCount,
+	}
+	for _, b := range aggs.Kinds.Buckets {
+		stats.Kinds[b.Key] = b.DocCount
+	}
+	return stats, nil
+}
+
+// collectTrackedStats takes the counts from the usage of every pubkey, which
+// is kept up to date as events are saved and deleted, and counts only the
+// events of the last 24 hours in the store.
+func (r *Relay) collectTrackedStats(ctx context.Context, since nostr.Timestamp) (*eventStats, error) {
+	if !r.usage.scanned.Load() {
+		return nil, errUsageNotScanned
+	}
+	stats := &eventStats{}
+	stats.Kinds, stats.Authors = r.usage.totals()
+	for _, count := range stats.Kinds {
+		stats.Total += count
+	}
+	var err error
+	stats.Last24h, err = r.Storage(ctx).(*relayStore).countStored(internalQuery(ctx), nostr.Filter{Since: &since})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// info returns what /info reports. server may be nil before it is created.
+func (r *Relay) info(server *relayer.Server) Info {
+	info := Info{
+		Version:       version,
+		SupportedNIPs: supportedNIPs,
+		Reaper:        r.reaper.stats(),
+	}
+	if !r.started.IsZero() {
+		info.Uptime = int64(time.Since(r.started).Seconds())
+	}
+	if server != nil {
+		info.NumSessions = int64(server.ClientsNum())
+	}
+	info.NumSubscriptions = r.subscriptions.count()
+	if stats := r.stats.Load(); stats != nil {
+		info.NumEvents = stats.Total
+		info.Events = stats
+	}
+	return info
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCollectStats(t *testing.T) {
+	for _, r := range []*Relay{
+		{driverName: "memory", memoryStorage: &memoryStore{}},
+		{driverName: "sqlite3", sqlite3Storage: &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "stats.sqlite")}},
+	} {
+		t.Run(r.driverName, func(t *testing.T) {
+			ctx := context.Background()
+			store := r.Storage(ctx).(*relayStore)
+			if err := store.Init(); err != nil {
+				t.Fatalf("init: %v", err)
+			}
+			defer store.Close()
+			r.ready()
+			if r.tracksUsage() {
+				r.scanUsage(ctx)
+			}
+
+			now := time.Now()
+			old := signedEvent(t, bytes32Hex(0x11), 1, "old")
+			old.CreatedAt = nostr.Timestamp(now.Add(-48 * time.Hour).Unix())
+			old.Sign(bytes32Hex(0x11))
+			events := []*nostr.Event{
+				old,
+				signedEvent(t, bytes32Hex(0x11), 1, "new"),
+				signedEvent(t, bytes32Hex(0x22), 7, "+"),
+				expiringEvent(t, bytes32Hex(0x22), nostr.Timestamp(now.Add(-time.Minute).Unix())),
+			}
+			for _, evt := range events {
+				if err := store.SaveEvent(ctx, evt); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+				store.AfterSave(evt)
+			}
+
+			stats, err := r.collectStats(ctx, now)
+			if err != nil {
+				t.Fatalf("collect: %v", err)
+			}
+			if stats.Total != 3 {
+				t.Errorf("expected 3 events leaving out the expired one, got %d", stats.Total)
+			}
+			if stats.Kinds[1] != 3 || stats.Kinds[7] != 1 {
+				t.Errorf("unexpected counts by kind: %v", stats.Kinds)
+			}
+			if stats.Authors != 2 {
+				t.Errorf("expected 2 authors, got %d", stats.Authors)
+			}
+			if stats.Last24h != 3 {
+				t.Errorf("expected 3 events in the last 24h, got %d", stats.Last24h)
+			}
+
+			if err := store.DeleteEvent(ctx, events[1]); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if stats, err = r.collectStats(ctx, now); err != nil || stats.Kinds[1] != 2 || stats.Last24h != 2 {
+				t.Fatalf("expected the deleted event to be left out, got %+v %v", stats, err)
+			}
+
+			r.stats.Store(stats)
+			r.started = now.Add(-time.Hour)
+			info := r.info(nil)
+			if info.NumEvents != 2 || info.Events != stats || info.Uptime < 3600 {
+				t.Errorf("unexpected info: %+v", info)
+			}
+		})
+	}
+}
+
+func TestParseOpensearchStats(t *testing.T) {
+	stats, err := parseOpensearchStats(12, []byte(`{
+		"kinds": {"buckets": [{"key": 1, "doc_count": 10}, {"key": 7, "doc_count": 2}]},
+		"authors": {"value": 4},
+		"recent": {"doc_count": 5}
+	}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if stats.Total != 12 || stats.Kinds[1] != 10 || stats.Kinds[7] != 2 || stats.Authors != 4 || stats.Last24h != 5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer spans are started with. It is looked up every
+// time, so that it follows the provider set by setupTracing; until then it
+// does nothing.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/mattn/nostr-relay")
+}
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, a URL such as
+// http://localhost:4318, sampling the given ratio of traces. The returned
+// function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string, ratio float64) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("trace endpoint must be an http or https URL: %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", name),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// maxSpanValues and maxSpanSearch are how many values of a filter field, and
+// how many bytes of its search, are put on a span; filters may be much larger
+// than is useful to export.
+const (
+	maxSpanValues = 20
+	maxSpanSearch = 100
+)
+
+// filterAttributes describes a filter on a span: how many values each field
+// has, with the kinds, tag names and search themselves cut short.
+func filterAttributes(filter nostr.Filter) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("nostr.filter.ids", len(filter.IDs)),
+		attribute.Int("nostr.filter.authors", len(filter.Authors)),
+		attribute.IntSlice("nostr.filter.kinds", filter.Kinds[:min(len(filter.Kinds), maxSpanValues)]),
+		attribute.Int("nostr.filter.limit", filter.Limit),
+	}
+	if len(filter.Kinds) > maxSpanValues {
+		attrs = append(attrs, attribute.Int("nostr.filter.kinds_count", len(filter.Kinds)))
+	}
+	if len(filter.Tags) > 0 {
+		names := make([]string, 0, len(filter.Tags))
+		values := 0
+		for name, v := range filter.Tags {
+			names = append(names, name)
+			values += len(v)
+		}
+		slices.Sort(names)
+		attrs = append(attrs,
+			attribute.StringSlice("nostr.filter.tags", names[:min(len(names), maxSpanValues)]),
+			attribute.Int("nostr.filter.tag_values", values))
+	}
+	if filter.Since != nil {
+		attrs = append(attrs, attribute.Int64("nostr.filter.since", int64(*filter.Since)))
+	}
+	if filter.Until != nil {
+		attrs = append(attrs, attribute.Int64("nostr.filter.until", int64(*filter.Until)))
+	}
+	if filter.Search != "" {
+		search := filter.Search
+		if len(search) > maxSpanSearch {
+			search = strings.ToValidUTF8(search[:maxSpanSearch], "")
+		}
+		attrs = append(attrs, attribute.String("nostr.filter.search", search))
+	}
+	return attrs
+}
+
+// reqSpans hands the span of a REQ over to the queries of its filters. The
+// relayer starts them with the context of the connection rather than with one
+// AcceptReq could return, and handles the REQs of a connection concurrently,
+// so a query is matched to the REQ by its filter.
+type reqSpans struct {
+	mu      sync.Mutex
+	pending map[*relayer.WebSocket][]pendingQuery
+}
+
+type pendingQuery struct {
+	filter nostr.Filter
+	span   trace.SpanContext
+	added  time.Time
+}
+
+// reqSpanTimeout is how long a filter waits for its query. The relayer drops
+// the rest of a REQ when one of its filters is refused, and their entries are
+// let go of after it.
+const reqSpanTimeout = 10 * time.Second
+
+// add remembers span as the parent of the queries of filters on the connection
+// ctx comes from.
+func (s *reqSpans) add(ctx context.Context, filters nostr.Filters, span trace.SpanContext) {
+	ws, ok := ctx.Value(relayer.AUTH_CONTEXT_KEY).(*relayer.WebSocket)
+	if !ok || !span.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending = map[*relayer.WebSocket][]pendingQuery{}
+	}
+	now := time.Now()
+	queries, ok := s.pending[ws]
+	if !ok {
+		context.AfterFunc(ctx, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.pending, ws)
+		})
+	}
+	queries = slices.DeleteFunc(queries, func(q pendingQuery) bool { return now.Sub(q.added) > reqSpanTimeout })
+	for _, filter := range filters {
+		queries = append(queries, pendingQuery{filter: filter, span: span, added: now})
+	}
+	s.pending[ws] = queries
+}
+
+// take returns the span of the REQ that filter was sent in on the connection
+// ctx comes from, if there is one.
+func (s *reqSpans) take(ctx context.Context, filter nostr.Filter) (trace.SpanContext, bool) {
+	ws, ok := ctx.Value(relayer.AUTH_CONTEXT_KEY).(*relayer.WebSocket)
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := s.pending[ws]
+	i := slices.IndexFunc(queries, func(q pendingQuery) bool { return nostr.FilterEqual(q.filter, filter) })
+	if i < 0 {
+		return trace.SpanContext{}, false
+	}
+	span := queries[i].span
+	s.pending[ws] = slices.Delete(queries, i, i+1)
+	return span, true
+}
+
+// eventAttributes describes an event on a span.
+func eventAttributes(evt *nostr.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("nostr.event.id", evt.ID),
+		attribute.String("nostr.event.pubkey", evt.PubKey),
+		attribute.Int("nostr.event.kind", evt.Kind),
+	}
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
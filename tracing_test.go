@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an OTLP/HTTP trace receiver that keeps the span names it gets.
+type collector struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil || req.URL.Path != "/v1/traces" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var export collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &export); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range export.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans = append(c.spans, span.Name)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(nil)
+}
+
+func TestTracing(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+	shutdown, err := setupTracing(context.Background(), srv.URL, 1)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(context.Background()).(*relayStore)
+	store.Init()
+	ctx := context.Background()
+	r.AcceptReq(ctx, "sub", nostr.Filters{{Kinds: []int{1}}}, "")
+	if err := store.SaveEvent(ctx, signedEvent(t, bytes32Hex(0x11), 1, "hello")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	for range ch {
+	}
+	if _, err := store.CountEvents(ctx, nostr.Filter{Kinds: []int{1}}); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+
+	// shutting down flushes the spans to the collector
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range []string{"AcceptReq", "relayStore.SaveEvent", "relayStore.QueryEvents", "memory.QueryEvents", "memory.CountEvents"} {
+		if !slices.Contains(c.spans, name) {
+			t.Errorf("expected a %s span, got %v", name, c.spans)
+		}
+	}
+}
+
+func TestSetupTracingRejectsEndpoint(t *testing.T) {
+	if _, err := setupTracing(context.Background(), "localhost:4318", 1); err == nil {
+		t.Fatal("expected an endpoint without a scheme to be rejected")
+	}
+}
+
+func TestQuerySpansFollowReq(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	r := &Relay{driverName: "memory", memoryStorage: &memoryStore{}}
+	store := r.Storage(context.Background()).(*relayStore)
+	store.Init()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), relayer.AUTH_CONTEXT_KEY, &relayer.WebSocket{}))
+	defer cancel()
+
+	filters := nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{7}}}
+	r.AcceptReq(ctx, "sub", filters, "")
+	for _, filter := range filters {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		for range ch {
+		}
+	}
+
+	var req sdktrace.ReadOnlySpan
+	var queries []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "AcceptReq":
+			req = span
+		case "relayStore.QueryEvents":
+			queries = append(queries, span)
+		}
+	}
+	if req == nil || len(queries) != 2 {
+		t.Fatalf("expected a REQ and 2 query spans, got %v %d", req, len(queries))
+	}
+	for _, query := range queries {
+		if query.Parent().SpanID() != req.SpanContext().SpanID() {
+			t.Fatalf("expected the query to be a child of the REQ, got parent %s", query.Parent().SpanID())
+		}
+	}
+	if _, ok := r.reqSpans.take(ctx, filters[0]); ok {
+		t.Fatal("expected the REQ to be handed over once per filter")
+	}
+}
+
+func TestFilterAttributesBounded(t *testing.T) {
+	kinds := make([]int, 100)
+	for i := range kinds {
+		kinds[i] = i
+	}
+	attrs := filterAttributes(nostr.Filter{Kinds: kinds, Search: strings.Repeat("検索", 100)})
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "nostr.filter.kinds":
+			if n := len(attr.Value.AsInt64Slice()); n != maxSpanValues {
+				t.Errorf("expected %d kinds, got %d", maxSpanValues, n)
+			}
+		case "nostr.filter.kinds_count":
+			if attr.Value.AsInt64() != 100 {
+				t.Errorf("expected the number of kinds, got %d", attr.Value.AsInt64())
+			}
+		case "nostr.filter.search":
+			if s := attr.Value.AsString(); len(s) > maxSpanSearch || !utf8.ValidString(s) {
+				t.Errorf("expected the search to be cut on a character boundary, got %q", s)
+			}
+		}
+	}
+}
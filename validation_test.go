@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/fiatjaf/eventstore/slicestore"
 	"github.com/nbd-wtf/go-nostr"
 )
 
@@ -41,17 +43,18 @@ func TestAcceptEventAllowlistMatchesAnyEntry(t *testing.T) {
 }
 
 func TestPerformCustomSearchStreamsResponse(t *testing.T) {
+	one := signedEvent(t, bytes32Hex(0x11), 1, "one")
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			t.Fatalf("unexpected method: %s", r.Method)
 		}
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"id":"1","pubkey":"p1","created_at":1,"kind":1,"tags":[],"content":"one","sig":"s1"}`)
+		json.NewEncoder(w).Encode(one)
 	}))
 	defer srv.Close()
 
 	r := &Relay{customSearchURL: srv.URL}
-	ch, err := r.performCustomSearch(context.Background(), "test", nostr.Filter{})
+	ch, err := r.performCustomSearch(context.Background(), parseSearchQuery("test"), nostr.Filter{})
 	if err != nil {
 		t.Fatalf("perform custom search: %v", err)
 	}
@@ -65,6 +68,120 @@ func TestPerformCustomSearchStreamsResponse(t *testing.T) {
 	}
 }
 
+func TestPerformCustomSearchDropsForgedEvents(t *testing.T) {
+	valid := signedEvent(t, bytes32Hex(0x11), 1, "valid")
+	forgedSig := signedEvent(t, bytes32Hex(0x11), 1, "forged")
+	forgedSig.Sig = bytes64Hex(0x33)
+	forgedID := signedEvent(t, bytes32Hex(0x11), 1, "tampered")
+	forgedID.Content = "changed after signing"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		enc.Encode(forgedSig)
+		enc.Encode(forgedID)
+		enc.Encode(valid)
+	}))
+	defer srv.Close()
+
+	r := &Relay{customSearchURL: srv.URL}
+	ch, err := r.performCustomSearch(context.Background(), parseSearchQuery("test"), nostr.Filter{})
+	if err != nil {
+		t.Fatalf("perform custom search: %v", err)
+	}
+	var got []string
+	for evt := range ch {
+		got = append(got, evt.Content)
+	}
+	if len(got) != 1 || got[0] != "valid" {
+		t.Fatalf("expected only the valid event, got %v", got)
+	}
+	if r.searchGuard.badSig.Load() != 1 || r.searchGuard.badID.Load() != 1 {
+		t.Fatalf("unexpected drop counts: sig=%d id=%d", r.searchGuard.badSig.Load(), r.searchGuard.badID.Load())
+	}
+}
+
+func TestSearchGuardTripsOnHighFailureRate(t *testing.T) {
+	var g searchGuard
+	forged := signedEvent(t, bytes32Hex(0x11), 1, "forged")
+	forged.Sig = bytes64Hex(0x33)
+	for range searchBreakerWindow {
+		g.check(forged, nostr.Filter{})
+	}
+	if g.allow() {
+		t.Fatal("expected breaker to be open")
+	}
+}
+
+func TestQueryEventsRoutesSearchToCustomSearch(t *testing.T) {
+	one := signedEvent(t, bytes32Hex(0x11), 1, "one")
+	two := signedEvent(t, bytes32Hex(0x22), 7, "two")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(one)
+		json.NewEncoder(w).Encode(two)
+	}))
+	defer srv.Close()
+
+	backend := &slicestore.SliceStore{}
+	backend.Init()
+	store := &relayStore{Store: backend, relay: &Relay{customSearchURL: srv.URL}}
+
+	ch, err := store.QueryEvents(context.Background(), nostr.Filter{Search: "test", Kinds: []int{7}})
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	var got []string
+	for evt := range ch {
+		got = append(got, evt.ID)
+	}
+	if len(got) != 1 || got[0] != two.ID {
+		t.Fatalf("expected only the kind 7 search result, got %v", got)
+	}
+}
+
+func TestQueryEventsFallsBackWhenCustomSearchFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	backend := &slicestore.SliceStore{}
+	backend.Init()
+	backend.SaveEvent(context.Background(), &nostr.Event{ID: "local", PubKey: "p1", CreatedAt: 1, Kind: 1, Content: "test"})
+	store := &relayStore{Store: backend, relay: &Relay{customSearchURL: srv.URL}}
+
+	ch, err := store.QueryEvents(context.Background(), nostr.Filter{Search: "test"})
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	evt, ok := <-ch
+	if !ok || evt.ID != "local" {
+		t.Fatal("expected the backend result after custom search failed")
+	}
+	for range ch {
+	}
+}
+
+func TestCountByQueryPagesAcrossEqualTimestamps(t *testing.T) {
+	backend := &slicestore.SliceStore{}
+	backend.Init()
+	for i, createdAt := range []nostr.Timestamp{5, 4, 4, 4, 3, 2, 2} {
+		backend.SaveEvent(context.Background(), &nostr.Event{
+			ID:        fmt.Sprintf("%064x", i),
+			CreatedAt: createdAt,
+			Kind:      1,
+		})
+	}
+
+	count, err := countByQuery(context.Background(), backend, nostr.Filter{}, 3)
+	if err != nil {
+		t.Fatalf("count by query: %v", err)
+	}
+	if count != 7 {
+		t.Fatalf("expected 7 events, got %d", count)
+	}
+}
+
 func TestValidateDelegationRejectsForgedSignature(t *testing.T) {
 	delegateeSecret := bytes32Hex(0x11)
 	delegatorSecret := bytes32Hex(0x22)
@@ -100,6 +217,21 @@ func TestValidateDelegationRejectsForgedSignature(t *testing.T) {
 	}
 }
 
+func signedEvent(t *testing.T, secret string, kind int, content string) *nostr.Event {
+	t.Helper()
+
+	evt := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+	if err := evt.Sign(secret); err != nil {
+		t.Fatalf("sign event: %v", err)
+	}
+	return evt
+}
+
 func delegationSignature(t *testing.T, delegatorSecret, delegateePubkey, conditions string) string {
 	t.Helper()
 